@@ -2,12 +2,18 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/gcpauth"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/proxy"
 )
 
 var (
@@ -17,6 +23,24 @@ var (
 	apiKey     string
 	model      string
 	deployment string
+
+	awsAccessKey    string
+	awsSecretKey    string
+	awsSessionToken string
+	awsRegion       string
+	awsRoleARN      string
+
+	gcpServiceAccountFile string
+	gcpTokenURL           string
+
+	azureAPIVersion   string
+	azureTenantID     string
+	azureClientID     string
+	azureClientSecret string
+	azureAuthority    string
+
+	statusServer string
+	statusKey    string
 )
 
 var connCmd = &cobra.Command{
@@ -28,19 +52,53 @@ var addConnCmd = &cobra.Command{
 	Use:   "add",
 	Short: "Add a new LLM connection",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		// Self-hosted backends usually run without authentication.
+		if apiKey == "" && awsAccessKey == "" && gcpServiceAccountFile == "" && azureClientID == "" && !proxy.AllowsAnonymous(provider) {
+			return fmt.Errorf("one of --api-key, --aws-access-key-id, --gcp-service-account-file or --azure-client-id is required")
+		}
+		if (awsAccessKey == "") != (awsSecretKey == "") {
+			return fmt.Errorf("--aws-access-key-id and --aws-secret-access-key must be given together")
+		}
+		if azureClientID != "" && (azureTenantID == "" || azureClientSecret == "") {
+			return fmt.Errorf("--azure-client-id requires --azure-tenant-id and --azure-client-secret")
+		}
+		var gcpServiceAccount string
+		if gcpServiceAccountFile != "" {
+			data, err := os.ReadFile(gcpServiceAccountFile)
+			if err != nil {
+				return err
+			}
+			if _, err := gcpauth.ParseServiceAccount(data); err != nil {
+				return err
+			}
+			gcpServiceAccount = string(data)
+		}
+
 		database, err := db.InitDB(dbType, dsn)
 		if err != nil {
 			return err
 		}
 
 		conn := &models.Connection{
-			ID:        models.NewID(),
-			Name:      connName,
-			Provider:  provider,
-			Endpoint:  endpoint,
-			APIKey:    apiKey,
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
+			ID:                    models.NewID(),
+			Name:                  connName,
+			Provider:              provider,
+			Endpoint:              endpoint,
+			APIKey:                apiKey,
+			AWSAccessKeyID:        awsAccessKey,
+			AWSSecretAccessKey:    awsSecretKey,
+			AWSSessionToken:       awsSessionToken,
+			AWSRegion:             awsRegion,
+			AWSRoleARN:            awsRoleARN,
+			GCPServiceAccountJSON: gcpServiceAccount,
+			GCPTokenURL:           gcpTokenURL,
+			AzureAPIVersion:       azureAPIVersion,
+			AzureTenantID:         azureTenantID,
+			AzureClientID:         azureClientID,
+			AzureClientSecret:     azureClientSecret,
+			AzureAuthorityURL:     azureAuthority,
+			CreatedAt:             time.Now(),
+			UpdatedAt:             time.Now(),
 		}
 
 		err = database.SaveConnection(context.Background(), conn)
@@ -75,20 +133,79 @@ var listConnCmd = &cobra.Command{
 	},
 }
 
+var statusConnCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show circuit breaker state and recent error rate of each connection on a running server",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(statusServer, "/")+"/health/upstreams", nil)
+		if err != nil {
+			return err
+		}
+		if statusKey == "" {
+			statusKey = os.Getenv("MASTER_KEY")
+		}
+		if statusKey != "" {
+			req.Header.Set("Authorization", "Bearer "+statusKey)
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to reach server: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("server returned %s", resp.Status)
+		}
+
+		var report struct {
+			Upstreams []proxy.UpstreamHealth `json:"upstreams"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			return err
+		}
+
+		fmt.Printf("%-36s %-15s %-10s %-10s %-9s %-8s %-6s\n", "ID", "Name", "Provider", "State", "Requests", "ErrRate", "Consec")
+		for _, u := range report.Upstreams {
+			fmt.Printf("%-36s %-15s %-10s %-10s %-9d %-8s %-6d\n", u.ConnectionID, u.Name, u.Provider, u.State, u.Requests,
+				fmt.Sprintf("%.1f%%", u.ErrorRate*100), u.ConsecutiveFailures)
+		}
+		return nil
+	},
+}
+
 func init() {
 	rootCmd.AddCommand(connCmd)
 	connCmd.AddCommand(addConnCmd)
 	connCmd.AddCommand(listConnCmd)
+	connCmd.AddCommand(statusConnCmd)
 
 	addConnCmd.Flags().StringVar(&connName, "name", "", "Name of the connection")
-	addConnCmd.Flags().StringVar(&provider, "provider", "", "LLM Provider (openai, azure, etc.)")
+	addConnCmd.Flags().StringVar(&provider, "provider", "", "LLM Provider (openai, azure, google, aws, anthropic, ollama, vllm, llamacpp)")
 	addConnCmd.Flags().StringVar(&endpoint, "endpoint", "", "Endpoint URL")
 	addConnCmd.Flags().StringVar(&apiKey, "api-key", "", "API Key")
 	addConnCmd.Flags().StringVar(&model, "model", "", "Model Name")
 	addConnCmd.Flags().StringVar(&deployment, "deployment", "", "Deployment Name (optional)")
+	addConnCmd.Flags().StringVar(&awsAccessKey, "aws-access-key-id", "", "AWS access key ID for SigV4 signing (aws)")
+	addConnCmd.Flags().StringVar(&awsSecretKey, "aws-secret-access-key", "", "AWS secret access key (aws)")
+	addConnCmd.Flags().StringVar(&awsSessionToken, "aws-session-token", "", "AWS session token for temporary credentials (aws, optional)")
+	addConnCmd.Flags().StringVar(&awsRegion, "aws-region", "", "AWS region (aws, defaults to the endpoint's region)")
+	addConnCmd.Flags().StringVar(&awsRoleARN, "aws-role-arn", "", "IAM role to assume before signing (aws, optional)")
+	addConnCmd.Flags().StringVar(&gcpServiceAccountFile, "gcp-service-account-file", "", "Service-account JSON key file used to mint OAuth tokens (google)")
+	addConnCmd.Flags().StringVar(&gcpTokenURL, "gcp-token-url", "", "OAuth token endpoint (google, defaults to the key file's token_uri)")
+	addConnCmd.Flags().StringVar(&azureAPIVersion, "azure-api-version", "", "api-version query parameter (azure, optional)")
+	addConnCmd.Flags().StringVar(&azureTenantID, "azure-tenant-id", "", "Entra ID tenant of the service principal (azure)")
+	addConnCmd.Flags().StringVar(&azureClientID, "azure-client-id", "", "Entra ID application (client) ID; replaces the API key (azure)")
+	addConnCmd.Flags().StringVar(&azureClientSecret, "azure-client-secret", "", "Entra ID client secret (azure)")
+	addConnCmd.Flags().StringVar(&azureAuthority, "azure-authority-url", "", "Entra ID authority (azure, defaults to https://login.microsoftonline.com)")
 
 	addConnCmd.MarkFlagRequired("name")
 	addConnCmd.MarkFlagRequired("provider")
 	addConnCmd.MarkFlagRequired("endpoint")
-	addConnCmd.MarkFlagRequired("api-key")
+
+	defaultServer := "http://localhost:8132"
+	if p, ok := os.LookupEnv("PORT"); ok {
+		defaultServer = "http://localhost:" + p
+	}
+	statusConnCmd.Flags().StringVar(&statusServer, "server", defaultServer, "Base URL of the running proxy")
+	statusConnCmd.Flags().StringVar(&statusKey, "key", "", "Master key (defaults to $MASTER_KEY)")
 }
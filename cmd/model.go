@@ -8,6 +8,8 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/proxy"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/router"
 )
 
 var (
@@ -15,12 +17,21 @@ var (
 	pmRemote     string
 	pmDeployment string
 	pmConnID     string
+	pmID         string
+	pmInPrice    float64
+	pmOutPrice   float64
+	pmCachePrice float64
+	pmFallback   string
+	pmAPIMode    string
 
-	asVKID    string
-	asModelID string
-	asAlias   string
-	asTPS     float64
-	asTokens  int64
+	asVKID     string
+	asModelID  string
+	asAlias    string
+	asTPS      float64
+	asTokens   int64
+	asWeight   int
+	asStrategy string
+	asID       string
 )
 
 var modelCmd = &cobra.Command{
@@ -37,13 +48,18 @@ var addModelCmd = &cobra.Command{
 			return err
 		}
 		pm := &models.ProviderModel{
-			ID:             models.NewID(),
-			ConnectionID:   pmConnID,
-			Name:           pmName,
-			RemoteModel:    pmRemote,
-			DeploymentName: pmDeployment,
-			CreatedAt:      time.Now(),
-			UpdatedAt:      time.Now(),
+			ID:               models.NewID(),
+			ConnectionID:     pmConnID,
+			Name:             pmName,
+			RemoteModel:      pmRemote,
+			DeploymentName:   pmDeployment,
+			APIMode:          pmAPIMode,
+			InputPrice:       pmInPrice,
+			OutputPrice:      pmOutPrice,
+			CachedInputPrice: pmCachePrice,
+			FallbackModelID:  pmFallback,
+			CreatedAt:        time.Now(),
+			UpdatedAt:        time.Now(),
 		}
 		err = database.SaveProviderModel(context.Background(), pm)
 		if err != nil {
@@ -54,6 +70,57 @@ var addModelCmd = &cobra.Command{
 	},
 }
 
+var updateModelCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Update a provider model; only the flags given are changed",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		database, err := db.InitDB(dbType, dsn)
+		if err != nil {
+			return err
+		}
+		pm, err := database.GetProviderModel(context.Background(), pmID)
+		if err != nil {
+			return fmt.Errorf("failed to find model %s: %v", pmID, err)
+		}
+
+		flags := cmd.Flags()
+		if flags.Changed("name") {
+			pm.Name = pmName
+		}
+		if flags.Changed("remote") {
+			pm.RemoteModel = pmRemote
+		}
+		if flags.Changed("deployment") {
+			pm.DeploymentName = pmDeployment
+		}
+		if flags.Changed("api-mode") {
+			pm.APIMode = pmAPIMode
+		}
+		if flags.Changed("input-price") {
+			pm.InputPrice = pmInPrice
+		}
+		if flags.Changed("output-price") {
+			pm.OutputPrice = pmOutPrice
+		}
+		if flags.Changed("cached-input-price") {
+			pm.CachedInputPrice = pmCachePrice
+		}
+		if flags.Changed("fallback-id") {
+			if pmFallback == pm.ID {
+				return fmt.Errorf("a model cannot fall back to itself")
+			}
+			pm.FallbackModelID = pmFallback
+		}
+		pm.UpdatedAt = time.Now()
+
+		if err := database.SaveProviderModel(context.Background(), pm); err != nil {
+			return err
+		}
+		fmt.Printf("Model %s updated [ID: %s]\n", pm.Name, pm.ID)
+		return nil
+	},
+}
+
 var listModelCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all provider models",
@@ -66,22 +133,106 @@ var listModelCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		fmt.Printf("%-36s %-15s %-20s %-20s\n", "ID", "Name", "RemoteModel", "ConnID")
+		fmt.Printf("%-36s %-15s %-20s %-36s %-10s %-10s\n", "ID", "Name", "RemoteModel", "ConnID", "In$/1M", "Out$/1M")
 		for _, m := range pms {
-			fmt.Printf("%-36s %-15s %-20s %-20s\n", m.ID, m.Name, m.RemoteModel, m.ConnectionID)
+			fmt.Printf("%-36s %-15s %-20s %-36s %-10.4g %-10.4g\n", m.ID, m.Name, m.RemoteModel, m.ConnectionID, m.InputPrice, m.OutputPrice)
 		}
 		return nil
 	},
 }
 
+var discoverModelCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "Add the models a connection's backend lists (ollama, vllm, llamacpp)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		database, err := db.InitDB(dbType, dsn)
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+		conn, err := database.GetConnection(ctx, pmConnID)
+		if err != nil {
+			return fmt.Errorf("failed to find connection %s: %v", pmConnID, err)
+		}
+		lister, ok := proxy.LookupAdapter(conn.Provider).(proxy.ModelLister)
+		if !ok {
+			return fmt.Errorf("provider %s does not support model discovery", conn.Provider)
+		}
+		names, err := lister.ListModels(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		existing, err := database.ListProviderModels(ctx, conn.ID)
+		if err != nil {
+			return err
+		}
+		known := map[string]bool{}
+		for _, m := range existing {
+			known[m.RemoteModel] = true
+		}
+		added := 0
+		for _, name := range names {
+			if known[name] {
+				continue
+			}
+			pm := &models.ProviderModel{
+				ID:           models.NewID(),
+				ConnectionID: conn.ID,
+				Name:         name,
+				RemoteModel:  name,
+				APIMode:      pmAPIMode,
+				CreatedAt:    time.Now(),
+				UpdatedAt:    time.Now(),
+			}
+			if err := database.SaveProviderModel(ctx, pm); err != nil {
+				return err
+			}
+			known[name] = true
+			added++
+			fmt.Printf("Model %s added [ID: %s]\n", pm.Name, pm.ID)
+		}
+		fmt.Printf("%d models found on %s, %d added\n", len(names), conn.Name, added)
+		return nil
+	},
+}
+
 var assignCmd = &cobra.Command{
 	Use:   "assign",
 	Short: "Assign a model to a virtual key with rate limits",
+	Long: `Assign a model to a virtual key with rate limits.
+Assigning several models under the same alias builds a load-balanced pool; --weight sets each
+member's share and --strategy (round-robin, weighted-random, least-in-flight, lowest-latency)
+applies to the whole pool.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if !router.ValidStrategy(asStrategy) {
+			return fmt.Errorf("unknown strategy %q", asStrategy)
+		}
 		database, err := db.InitDB(dbType, dsn)
 		if err != nil {
 			return err
 		}
+		ctx := context.Background()
+
+		existing, err := database.ListVirtualKeyAssignmentsByAlias(ctx, asVKID, asAlias)
+		if err != nil {
+			return err
+		}
+		strategy := asStrategy
+		if !cmd.Flags().Changed("strategy") && len(existing) > 0 {
+			strategy = existing[0].Strategy
+		}
+		// The strategy belongs to the pool, so keep every member in agreement.
+		for i := range existing {
+			if existing[i].Strategy != strategy {
+				existing[i].Strategy = strategy
+				existing[i].UpdatedAt = time.Now()
+				if err := database.SaveVirtualKeyAssignment(ctx, &existing[i]); err != nil {
+					return err
+				}
+			}
+		}
+
 		as := &models.VirtualKeyAssignment{
 			ID:              models.NewID(),
 			VirtualKeyID:    asVKID,
@@ -89,40 +240,123 @@ var assignCmd = &cobra.Command{
 			ModelAlias:      asAlias,
 			RateLimitTPS:    asTPS,
 			RateLimitTokens: asTokens,
+			Weight:          asWeight,
+			Strategy:        strategy,
 			CreatedAt:       time.Now(),
 			UpdatedAt:       time.Now(),
 		}
-		err = database.SaveVirtualKeyAssignment(context.Background(), as)
+		err = database.SaveVirtualKeyAssignment(ctx, as)
 		if err != nil {
 			return err
 		}
 		fmt.Printf("Assigned model %s (alias: %s) to virtual key %s\n", as.ProviderModelID, as.ModelAlias, as.VirtualKeyID)
+		if len(existing) > 0 {
+			fmt.Printf("Alias %s now load-balances over %d models (%s)\n", as.ModelAlias, len(existing)+1, displayStrategy(strategy))
+		}
 		return nil
 	},
 }
 
+var assignmentsCmd = &cobra.Command{
+	Use:   "assignments",
+	Short: "List model assignments of a virtual key",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		database, err := db.InitDB(dbType, dsn)
+		if err != nil {
+			return err
+		}
+		vkas, err := database.ListVirtualKeyAssignments(context.Background(), asVKID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-36s %-20s %-36s %-6s %-16s %-8s %-10s\n", "ID", "Alias", "ModelID", "Weight", "Strategy", "TPS", "Tokens")
+		for _, a := range vkas {
+			weight := a.Weight
+			if weight <= 0 {
+				weight = 1
+			}
+			fmt.Printf("%-36s %-20s %-36s %-6d %-16s %-8.1f %-10d\n", a.ID, a.ModelAlias, a.ProviderModelID, weight, displayStrategy(a.Strategy), a.RateLimitTPS, a.RateLimitTokens)
+		}
+		return nil
+	},
+}
+
+var unassignCmd = &cobra.Command{
+	Use:   "unassign",
+	Short: "Remove a model assignment (takes the model out of its alias pool)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		database, err := db.InitDB(dbType, dsn)
+		if err != nil {
+			return err
+		}
+		if err := database.DeleteVirtualKeyAssignment(context.Background(), asID); err != nil {
+			return err
+		}
+		fmt.Printf("Assignment %s removed\n", asID)
+		return nil
+	},
+}
+
+func displayStrategy(s string) string {
+	if s == "" {
+		return router.RoundRobin
+	}
+	return s
+}
+
 func init() {
 	rootCmd.AddCommand(modelCmd)
 	modelCmd.AddCommand(addModelCmd)
+	modelCmd.AddCommand(updateModelCmd)
 	modelCmd.AddCommand(listModelCmd)
+	modelCmd.AddCommand(discoverModelCmd)
 	rootCmd.AddCommand(assignCmd)
+	rootCmd.AddCommand(assignmentsCmd)
+	rootCmd.AddCommand(unassignCmd)
 
 	addModelCmd.Flags().StringVar(&pmName, "name", "", "Display name for the model")
 	addModelCmd.Flags().StringVar(&pmRemote, "remote", "", "Remote model name (e.g. gpt-4)")
 	addModelCmd.Flags().StringVar(&pmDeployment, "deployment", "", "Azure deployment name (optional)")
 	addModelCmd.Flags().StringVar(&pmConnID, "conn-id", "", "Connection ID")
+	addModelCmd.Flags().StringVar(&pmAPIMode, "api-mode", "", "Provider API mode (aws: converse for non-Claude models; ollama: native for /api/chat)")
+	addModelCmd.Flags().Float64Var(&pmInPrice, "input-price", 0, "USD per 1M prompt tokens")
+	addModelCmd.Flags().Float64Var(&pmOutPrice, "output-price", 0, "USD per 1M completion tokens")
+	addModelCmd.Flags().Float64Var(&pmCachePrice, "cached-input-price", 0, "USD per 1M cached prompt tokens (defaults to input price)")
+	addModelCmd.Flags().StringVar(&pmFallback, "fallback-id", "", "Provider Model ID to fail over to when this model keeps failing")
 	addModelCmd.MarkFlagRequired("name")
 	addModelCmd.MarkFlagRequired("remote")
 	addModelCmd.MarkFlagRequired("conn-id")
 
+	updateModelCmd.Flags().StringVar(&pmID, "id", "", "Provider Model ID")
+	updateModelCmd.Flags().StringVar(&pmName, "name", "", "Display name for the model")
+	updateModelCmd.Flags().StringVar(&pmRemote, "remote", "", "Remote model name (e.g. gpt-4)")
+	updateModelCmd.Flags().StringVar(&pmDeployment, "deployment", "", "Azure deployment name")
+	updateModelCmd.Flags().StringVar(&pmAPIMode, "api-mode", "", "Provider API mode (aws: converse for non-Claude models; ollama: native for /api/chat)")
+	updateModelCmd.Flags().Float64Var(&pmInPrice, "input-price", 0, "USD per 1M prompt tokens")
+	updateModelCmd.Flags().Float64Var(&pmOutPrice, "output-price", 0, "USD per 1M completion tokens")
+	updateModelCmd.Flags().Float64Var(&pmCachePrice, "cached-input-price", 0, "USD per 1M cached prompt tokens (defaults to input price)")
+	updateModelCmd.Flags().StringVar(&pmFallback, "fallback-id", "", "Provider Model ID to fail over to when this model keeps failing")
+	updateModelCmd.MarkFlagRequired("id")
+
 	listModelCmd.Flags().StringVar(&pmConnID, "conn-id", "", "Filter by connection ID")
 
+	discoverModelCmd.Flags().StringVar(&pmConnID, "conn-id", "", "Connection ID")
+	discoverModelCmd.Flags().StringVar(&pmAPIMode, "api-mode", "", "Provider API mode for the added models (ollama: native for /api/chat)")
+	discoverModelCmd.MarkFlagRequired("conn-id")
+
 	assignCmd.Flags().StringVar(&asVKID, "vkey-id", "", "Virtual Key ID")
 	assignCmd.Flags().StringVar(&asModelID, "model-id", "", "Provider Model ID")
 	assignCmd.Flags().StringVar(&asAlias, "alias", "", "The model name client will use (e.g. 'gpt-4')")
 	assignCmd.Flags().Float64Var(&asTPS, "tps", 1.0, "TPS limit")
-	assignCmd.Flags().Int64Var(&asTokens, "tokens", 1000, "Token limit (simulated)")
+	assignCmd.Flags().Int64Var(&asTokens, "tokens", 1000, "Token limit per minute, charged with real provider usage")
+	assignCmd.Flags().IntVar(&asWeight, "weight", 1, "Share of the alias's traffic when it is load-balanced")
+	assignCmd.Flags().StringVar(&asStrategy, "strategy", router.RoundRobin, "Pool strategy: round-robin, weighted-random, least-in-flight, lowest-latency")
 	assignCmd.MarkFlagRequired("vkey-id")
 	assignCmd.MarkFlagRequired("model-id")
 	assignCmd.MarkFlagRequired("alias")
+
+	assignmentsCmd.Flags().StringVar(&asVKID, "vkey-id", "", "Filter by virtual key ID")
+
+	unassignCmd.Flags().StringVar(&asID, "id", "", "Assignment ID")
+	unassignCmd.MarkFlagRequired("id")
 }
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+var (
+	usVKID    string
+	usModelID string
+	usFrom    string
+	usTo      string
+	usBy      string
+)
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Report recorded usage aggregated by key, model and/or day",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		database, err := db.InitDB(dbType, dsn)
+		if err != nil {
+			return err
+		}
+
+		filter := models.UsageFilter{VirtualKeyID: usVKID, ProviderModelID: usModelID}
+		if usFrom != "" {
+			if filter.From, err = time.Parse(time.DateOnly, usFrom); err != nil {
+				return fmt.Errorf("invalid --from date: %v", err)
+			}
+		}
+		if usTo != "" {
+			to, err := time.Parse(time.DateOnly, usTo)
+			if err != nil {
+				return fmt.Errorf("invalid --to date: %v", err)
+			}
+			// --to is inclusive on the command line.
+			filter.To = to.AddDate(0, 0, 1)
+		}
+		for _, g := range strings.Split(usBy, ",") {
+			switch strings.TrimSpace(g) {
+			case "key":
+				filter.ByVirtualKey = true
+			case "model":
+				filter.ByModel = true
+			case "day":
+				filter.ByDay = true
+			case "":
+			default:
+				return fmt.Errorf("unknown grouping %q (use key, model, day)", g)
+			}
+		}
+
+		rows, err := database.AggregateUsage(context.Background(), filter)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%-36s %-36s %-10s %-8s %-12s %-12s %-12s %-10s\n", "VirtualKeyID", "ModelID", "Day", "Requests", "Prompt", "Completion", "CostUSD", "AvgLatMs")
+		for _, r := range rows {
+			fmt.Printf("%-36s %-36s %-10s %-8d %-12d %-12d %-12.4f %-10.0f\n", r.VirtualKeyID, r.ProviderModelID, r.Day, r.Requests, r.PromptTokens, r.CompletionTokens, r.CostUSD, r.AvgLatencyMs)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(usageCmd)
+
+	usageCmd.Flags().StringVar(&usVKID, "vkey-id", "", "Filter by virtual key ID")
+	usageCmd.Flags().StringVar(&usModelID, "model-id", "", "Filter by provider model ID")
+	usageCmd.Flags().StringVar(&usFrom, "from", "", "First day to include (YYYY-MM-DD, UTC)")
+	usageCmd.Flags().StringVar(&usTo, "to", "", "Last day to include (YYYY-MM-DD, UTC)")
+	usageCmd.Flags().StringVar(&usBy, "by", "key,model,day", "Comma-separated grouping: key, model, day")
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/budget"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
 	"github.com/supakornemchananon/go-llm-proxy-server/pkg/cryptoutil"
@@ -18,6 +19,15 @@ var (
 	vkModelID string
 	vkTPS     float64
 	vkTokens  int64
+
+	bgID     string
+	bgAmount float64
+	bgPeriod string
+	bgAnchor string
+	bgWarn   float64
+
+	cacheID  string
+	cacheTTL time.Duration
 )
 
 var vkeyCmd = &cobra.Command{
@@ -123,17 +133,152 @@ var listVkeyCmd = &cobra.Command{
 	},
 }
 
+var budgetVkeyCmd = &cobra.Command{
+	Use:   "budget",
+	Short: "Set or show the spend budget of a virtual key",
+	Long: `Set the USD spend budget of a virtual key, or show current spend when no budget flags are given.
+Requests are refused with 402 once the budget for the current period is used up.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		database, err := db.InitDB(dbType, dsn)
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+
+		vk, err := findVirtualKey(ctx, database, bgID)
+		if err != nil {
+			return err
+		}
+
+		flags := cmd.Flags()
+		if flags.Changed("amount") || flags.Changed("period") || flags.Changed("anchor") || flags.Changed("warn") {
+			if flags.Changed("amount") {
+				vk.BudgetAmount = bgAmount
+			}
+			if flags.Changed("period") {
+				if !budget.ValidPeriod(bgPeriod) {
+					return fmt.Errorf("invalid period %q (use daily, weekly or monthly)", bgPeriod)
+				}
+				vk.BudgetPeriod = bgPeriod
+			}
+			if flags.Changed("anchor") {
+				vk.BudgetResetAt = time.Time{}
+				if bgAnchor != "" {
+					anchor, err := time.Parse(time.DateOnly, bgAnchor)
+					if err != nil {
+						if anchor, err = time.Parse(time.RFC3339, bgAnchor); err != nil {
+							return fmt.Errorf("invalid --anchor (use YYYY-MM-DD or RFC3339): %v", err)
+						}
+					}
+					vk.BudgetResetAt = anchor.UTC()
+				}
+			}
+			if flags.Changed("warn") {
+				vk.BudgetWarnPercent = bgWarn
+			}
+			if vk.BudgetPeriod == "" {
+				vk.BudgetPeriod = budget.Monthly
+			}
+			vk.UpdatedAt = time.Now()
+			if err := database.UpdateVirtualKeySettings(ctx, vk); err != nil {
+				return err
+			}
+			fmt.Printf("Budget updated for virtual key %s\n", vk.Name)
+		}
+
+		if vk.BudgetAmount <= 0 {
+			fmt.Printf("Virtual key %s has no budget\n", vk.Name)
+			return nil
+		}
+		start, end := budget.Window(vk.BudgetPeriod, vk.BudgetResetAt, time.Now())
+		spent, err := budget.Spent(ctx, database, vk.ID, start, end)
+		if err != nil {
+			return err
+		}
+		status := budget.Status{Amount: vk.BudgetAmount, Spent: spent, Period: vk.BudgetPeriod, Start: start, End: end}
+		fmt.Printf("Key:      %s [ID: %s]\n", vk.Name, vk.ID)
+		fmt.Printf("Budget:   $%.2f %s (warn at %.0f%%)\n", vk.BudgetAmount, vk.BudgetPeriod, vk.BudgetWarnPercent)
+		fmt.Printf("Window:   %s -> %s\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+		fmt.Printf("Spent:    $%.4f (%.1f%%)\n", spent, status.UsedPercent())
+		return nil
+	},
+}
+
+var cacheVkeyCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Set or show the response cache TTL of a virtual key",
+	Long: `Set how long responses to deterministic requests (embeddings, temperature 0) made with a
+virtual key are cached, or show the current TTL when --ttl is not given. A TTL of 0 disables the cache.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		database, err := db.InitDB(dbType, dsn)
+		if err != nil {
+			return err
+		}
+		ctx := context.Background()
+
+		vk, err := findVirtualKey(ctx, database, cacheID)
+		if err != nil {
+			return err
+		}
+
+		if cmd.Flags().Changed("ttl") {
+			if cacheTTL < 0 {
+				return fmt.Errorf("invalid --ttl %s", cacheTTL)
+			}
+			vk.CacheTTLSeconds = int64(cacheTTL / time.Second)
+			vk.UpdatedAt = time.Now()
+			if err := database.UpdateVirtualKeySettings(ctx, vk); err != nil {
+				return err
+			}
+		}
+
+		if vk.CacheTTLSeconds <= 0 {
+			fmt.Printf("Response cache disabled for virtual key %s\n", vk.Name)
+			return nil
+		}
+		fmt.Printf("Response cache TTL for virtual key %s: %s\n", vk.Name, time.Duration(vk.CacheTTLSeconds)*time.Second)
+		return nil
+	},
+}
+
+// findVirtualKey looks a virtual key up by ID.
+func findVirtualKey(ctx context.Context, database db.DB, id string) (*models.VirtualKey, error) {
+	vks, err := database.ListVirtualKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vks {
+		if vks[i].ID == id {
+			return &vks[i], nil
+		}
+	}
+	return nil, fmt.Errorf("virtual key %s not found", id)
+}
+
 func init() {
 	rootCmd.AddCommand(vkeyCmd)
 	vkeyCmd.AddCommand(addVkeyCmd)
 	vkeyCmd.AddCommand(listVkeyCmd)
+	vkeyCmd.AddCommand(budgetVkeyCmd)
+	vkeyCmd.AddCommand(cacheVkeyCmd)
 
 	addVkeyCmd.Flags().StringVar(&vkName, "name", "", "Name of the virtual key")
 	addVkeyCmd.Flags().StringVar(&vkKey, "key", "", "Actual virtual key value for users")
 	addVkeyCmd.Flags().StringVar(&vkConnID, "conn-id", "", "Connection ID to auto-assign all models")
 	addVkeyCmd.Flags().StringVar(&vkModelID, "model-id", "", "Model ID to assign a single model")
 	addVkeyCmd.Flags().Float64Var(&vkTPS, "tps", 10.0, "TPS limit for the assigned models")
-	addVkeyCmd.Flags().Int64Var(&vkTokens, "tokens", 100000, "Token limit for the assigned models")
+	addVkeyCmd.Flags().Int64Var(&vkTokens, "tokens", 100000, "Token limit per minute for the assigned models")
+
+	budgetVkeyCmd.Flags().StringVar(&bgID, "id", "", "Virtual Key ID")
+	budgetVkeyCmd.Flags().Float64Var(&bgAmount, "amount", 0, "Budget in USD per period (0 removes the budget)")
+	budgetVkeyCmd.Flags().StringVar(&bgPeriod, "period", budget.Monthly, "Budget period: daily, weekly or monthly")
+	budgetVkeyCmd.Flags().StringVar(&bgAnchor, "anchor", "", "Date periods reset from (YYYY-MM-DD); calendar periods if empty")
+	budgetVkeyCmd.Flags().Float64Var(&bgWarn, "warn", 0, "Soft-warning threshold in percent of the budget (e.g. 80)")
+	budgetVkeyCmd.MarkFlagRequired("id")
+
+	cacheVkeyCmd.Flags().StringVar(&cacheID, "id", "", "Virtual Key ID")
+	cacheVkeyCmd.Flags().DurationVar(&cacheTTL, "ttl", 0, "How long cached responses are served, e.g. 1h (0 disables the cache)")
+	cacheVkeyCmd.MarkFlagRequired("id")
 
 	addVkeyCmd.MarkFlagRequired("name")
 	addVkeyCmd.MarkFlagRequired("key")
@@ -0,0 +1,103 @@
+package awsauth_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/awsauth"
+)
+
+// The cases below come from the AWS Signature Version 4 test suite (aws-sig-v4-test-suite).
+var (
+	suiteCreds = awsauth.Credentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	suiteTime = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+)
+
+const suiteScope = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "
+
+func signSuiteRequest(t *testing.T, method, target, body string, header map[string]string) *http.Request {
+	t.Helper()
+	var req *http.Request
+	var err error
+	if body == "" {
+		req, err = http.NewRequest(method, "https://example.amazonaws.com"+target, nil)
+	} else {
+		req, err = http.NewRequest(method, "https://example.amazonaws.com"+target, strings.NewReader(body))
+	}
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	require.NoError(t, awsauth.Sign(req, suiteCreds, "us-east-1", "service", suiteTime))
+	return req
+}
+
+func TestSign_GetVanilla(t *testing.T) {
+	req := signSuiteRequest(t, http.MethodGet, "/", "", nil)
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, suiteScope+"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func TestSign_GetVanillaQueryOrderKeyCase(t *testing.T) {
+	req := signSuiteRequest(t, http.MethodGet, "/?Param2=value2&Param1=value1", "", nil)
+	assert.Equal(t, suiteScope+"SignedHeaders=host;x-amz-date, Signature=b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		req.Header.Get("Authorization"))
+}
+
+func TestSign_PostVanilla(t *testing.T) {
+	req := signSuiteRequest(t, http.MethodPost, "/", "", nil)
+	assert.Equal(t, suiteScope+"SignedHeaders=host;x-amz-date, Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		req.Header.Get("Authorization"))
+}
+
+func TestSign_PostXWWWFormURLEncoded(t *testing.T) {
+	req := signSuiteRequest(t, http.MethodPost, "/", "Param1=value1",
+		map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+	assert.Equal(t, suiteScope+"SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a",
+		req.Header.Get("Authorization"))
+}
+
+func TestSign_SessionToken(t *testing.T) {
+	creds := suiteCreds
+	creds.SessionToken = "session-token"
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	require.NoError(t, awsauth.Sign(req, creds, "us-east-1", "service", suiteTime))
+	assert.Equal(t, "session-token", req.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,")
+}
+
+func TestRoleCache_AssumesRoleOnce(t *testing.T) {
+	var calls int
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "AssumeRole", r.Form.Get("Action"))
+		assert.Equal(t, "arn:aws:iam::123456789012:role/bedrock", r.Form.Get("RoleArn"))
+		assert.Contains(t, r.Header.Get("Authorization"), "Credential=AKIDEXAMPLE/")
+		fmt.Fprintf(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>
+<AccessKeyId>ASIATEMP</AccessKeyId><SecretAccessKey>temp-secret</SecretAccessKey>
+<SessionToken>temp-token</SessionToken><Expiration>%s</Expiration>
+</Credentials></AssumeRoleResult></AssumeRoleResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer sts.Close()
+
+	cache := awsauth.NewRoleCache(sts.Client())
+	cache.Endpoint = func(string) string { return sts.URL }
+	for i := 0; i < 3; i++ {
+		creds, err := cache.Get(context.Background(), suiteCreds, "us-east-1", "arn:aws:iam::123456789012:role/bedrock")
+		require.NoError(t, err)
+		assert.Equal(t, awsauth.Credentials{AccessKeyID: "ASIATEMP", SecretAccessKey: "temp-secret", SessionToken: "temp-token"}, creds)
+	}
+	assert.Equal(t, 1, calls)
+}
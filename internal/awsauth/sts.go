@@ -0,0 +1,90 @@
+package awsauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/credcache"
+)
+
+// STSEndpoint is the regional STS endpoint used to assume roles.
+func STSEndpoint(region string) string {
+	return "https://sts." + region + ".amazonaws.com/"
+}
+
+// AssumeRole exchanges base credentials for temporary credentials of roleARN through the STS
+// AssumeRole API at endpoint.
+func AssumeRole(ctx context.Context, client *http.Client, endpoint string, base Credentials, region, roleARN, sessionName string) (Credentials, time.Time, error) {
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {roleARN},
+		"RoleSessionName": {sessionName},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader([]byte(form.Encode())))
+	if err != nil {
+		return Credentials{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := Sign(req, base, region, "sts", time.Now()); err != nil {
+		return Credentials{}, time.Time{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return Credentials{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return Credentials{}, time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Credentials{}, time.Time{}, fmt.Errorf("awsauth: AssumeRole %s failed: %s: %s", roleARN, resp.Status, bytes.TrimSpace(body))
+	}
+
+	var out struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &out); err != nil {
+		return Credentials{}, time.Time{}, fmt.Errorf("awsauth: invalid AssumeRole response: %v", err)
+	}
+	c := out.Credentials
+	if c.AccessKeyId == "" {
+		return Credentials{}, time.Time{}, fmt.Errorf("awsauth: AssumeRole response has no credentials")
+	}
+	return Credentials{AccessKeyID: c.AccessKeyId, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken}, c.Expiration, nil
+}
+
+// RoleCache keeps assumed-role credentials until shortly before they expire, so the proxy calls
+// STS once per role and hour rather than once per request.
+type RoleCache struct {
+	client *http.Client
+	creds  *credcache.Cache[Credentials]
+	// Endpoint overrides STSEndpoint, e.g. for tests or VPC endpoints.
+	Endpoint func(region string) string
+}
+
+func NewRoleCache(client *http.Client) *RoleCache {
+	return &RoleCache{client: client, creds: credcache.New[Credentials](), Endpoint: STSEndpoint}
+}
+
+// Get returns credentials for roleARN assumed with base, assuming the role again when the cached
+// credentials are missing or about to expire.
+func (rc *RoleCache) Get(ctx context.Context, base Credentials, region, roleARN string) (Credentials, error) {
+	key := base.AccessKeyID + "|" + region + "|" + roleARN
+	return rc.creds.Get(key, func() (Credentials, time.Time, error) {
+		return AssumeRole(ctx, rc.client, rc.Endpoint(region), base, region, roleARN, "llm-proxy")
+	})
+}
@@ -0,0 +1,110 @@
+// Package azureauth obtains Microsoft Entra ID (Azure AD) access tokens with the OAuth client
+// credentials grant, for Azure OpenAI resources that have API keys disabled.
+package azureauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/credcache"
+)
+
+const (
+	// DefaultAuthority is the Entra ID authority of the public cloud, used when a connection
+	// does not name one.
+	DefaultAuthority = "https://login.microsoftonline.com"
+	// CognitiveServicesScope grants access to Azure OpenAI and Azure AI Foundry.
+	CognitiveServicesScope = "https://cognitiveservices.azure.com/.default"
+)
+
+// ClientCredentials identifies an app registration (service principal) in a tenant.
+type ClientCredentials struct {
+	TenantID     string
+	ClientID     string
+	ClientSecret string
+	// Authority overrides DefaultAuthority, e.g. for sovereign clouds or tests.
+	Authority string
+}
+
+// TokenURL is the v2.0 token endpoint of the credentials' tenant.
+func (c ClientCredentials) TokenURL() string {
+	authority := strings.TrimSuffix(c.Authority, "/")
+	if authority == "" {
+		authority = DefaultAuthority
+	}
+	return authority + "/" + url.PathEscape(c.TenantID) + "/oauth2/v2.0/token"
+}
+
+// Exchange requests an access token for scope with the client credentials grant.
+func Exchange(ctx context.Context, client *http.Client, creds ClientCredentials, scope string) (string, time.Time, error) {
+	if creds.TenantID == "" || creds.ClientID == "" || creds.ClientSecret == "" {
+		return "", time.Time{}, errors.New("azureauth: tenant ID, client ID and client secret are required")
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {creds.ClientID},
+		"client_secret": {creds.ClientSecret},
+		"scope":         {scope},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, creds.TokenURL(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("azureauth: token request failed: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", time.Time{}, fmt.Errorf("azureauth: invalid token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, errors.New("azureauth: token response has no access_token")
+	}
+	return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+// TokenCache keeps one Cognitive Services token per service principal, requesting a new one
+// shortly before the current one expires.
+type TokenCache struct {
+	client *http.Client
+	tokens *credcache.Cache[string]
+}
+
+func NewTokenCache(client *http.Client) *TokenCache {
+	return &TokenCache{client: client, tokens: credcache.New[string]()}
+}
+
+// Token returns a Cognitive Services access token for creds.
+func (tc *TokenCache) Token(ctx context.Context, creds ClientCredentials) (string, error) {
+	// The secret is part of the key so a rotated secret is used, and checked, immediately.
+	sum := sha256.Sum256([]byte(creds.ClientSecret))
+	key := creds.TokenURL() + "|" + creds.ClientID + "|" + hex.EncodeToString(sum[:])
+	return tc.tokens.Get(key, func() (string, time.Time, error) {
+		return Exchange(ctx, tc.client, creds, CognitiveServicesScope)
+	})
+}
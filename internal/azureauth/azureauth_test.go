@@ -0,0 +1,77 @@
+package azureauth_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/azureauth"
+)
+
+// fakeAuthority checks the client credentials grant and hands out numbered tokens that live for
+// expiresIn seconds.
+func fakeAuthority(t *testing.T, expiresIn int) (*httptest.Server, *int) {
+	calls := new(int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		assert.Equal(t, "/tenant-1/oauth2/v2.0/token", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+		assert.Equal(t, "client-1", r.Form.Get("client_id"))
+		assert.Equal(t, azureauth.CognitiveServicesScope, r.Form.Get("scope"))
+		if r.Form.Get("client_secret") != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"token_type":"Bearer","access_token":"eyJ.token-%d","expires_in":%d}`, *calls, expiresIn)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, calls
+}
+
+func TestTokenCache_RequestsAndCaches(t *testing.T) {
+	srv, calls := fakeAuthority(t, 3600)
+	cache := azureauth.NewTokenCache(srv.Client())
+	creds := azureauth.ClientCredentials{TenantID: "tenant-1", ClientID: "client-1", ClientSecret: "s3cret", Authority: srv.URL + "/"}
+
+	for i := 0; i < 3; i++ {
+		token, err := cache.Token(context.Background(), creds)
+		require.NoError(t, err)
+		assert.Equal(t, "eyJ.token-1", token)
+	}
+	assert.Equal(t, 1, *calls)
+}
+
+func TestTokenCache_RefreshesBeforeExpiry(t *testing.T) {
+	// Tokens that expire within the refresh margin are replaced on every use.
+	srv, calls := fakeAuthority(t, 60)
+	cache := azureauth.NewTokenCache(srv.Client())
+	creds := azureauth.ClientCredentials{TenantID: "tenant-1", ClientID: "client-1", ClientSecret: "s3cret", Authority: srv.URL}
+
+	first, err := cache.Token(context.Background(), creds)
+	require.NoError(t, err)
+	second, err := cache.Token(context.Background(), creds)
+	require.NoError(t, err)
+	assert.Equal(t, "eyJ.token-1", first)
+	assert.Equal(t, "eyJ.token-2", second)
+	assert.Equal(t, 2, *calls)
+}
+
+func TestTokenCache_ReportsRejectedSecret(t *testing.T) {
+	srv, _ := fakeAuthority(t, 3600)
+	cache := azureauth.NewTokenCache(srv.Client())
+
+	_, err := cache.Token(context.Background(), azureauth.ClientCredentials{TenantID: "tenant-1", ClientID: "client-1", ClientSecret: "wrong", Authority: srv.URL})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid_client")
+}
+
+func TestClientCredentials_TokenURL(t *testing.T) {
+	creds := azureauth.ClientCredentials{TenantID: "contoso.onmicrosoft.com"}
+	assert.Equal(t, "https://login.microsoftonline.com/contoso.onmicrosoft.com/oauth2/v2.0/token", creds.TokenURL())
+}
@@ -0,0 +1,267 @@
+// Package breaker implements per-connection circuit breakers so a failing upstream (a dead
+// region, a provider outage) stops receiving traffic until it has had time to recover.
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the position of a breaker.
+type State int
+
+const (
+	// Closed lets every request through while failures are counted.
+	Closed State = iota
+	// Open rejects requests until the cool-down has passed.
+	Open
+	// HalfOpen lets a single probe through; its outcome closes or re-opens the breaker.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Config decides when a breaker trips.
+type Config struct {
+	// Window is the sliding window the error rate is computed over.
+	Window time.Duration
+	// MinRequests is the number of requests in the window before the error rate counts.
+	MinRequests int
+	// ErrorRate in [0,1] at or above which the breaker opens.
+	ErrorRate float64
+	// ConsecutiveFailures opens the breaker regardless of the error rate.
+	ConsecutiveFailures int
+	// Cooldown is how long the breaker stays open before letting a probe through.
+	Cooldown time.Duration
+}
+
+// DefaultConfig opens after 5 failures in a row, or a 50% error rate over at least 10 requests
+// in the last minute, and probes again after 30 seconds.
+var DefaultConfig = Config{
+	Window:              time.Minute,
+	MinRequests:         10,
+	ErrorRate:           0.5,
+	ConsecutiveFailures: 5,
+	Cooldown:            30 * time.Second,
+}
+
+// buckets splits the window so old outcomes expire in steps rather than all at once.
+const buckets = 10
+
+type bucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+// Breaker tracks the health of one connection. It is safe for concurrent use.
+type Breaker struct {
+	mu          sync.Mutex
+	cfg         Config
+	state       State
+	openedAt    time.Time
+	consecutive int
+	probing     bool
+	probeStart  time.Time
+	window      [buckets]bucket
+}
+
+func New(cfg Config) *Breaker {
+	return &Breaker{cfg: cfg}
+}
+
+// Ready reports whether a request could currently be let through, without reserving anything.
+// Routers use it to skip deployments whose connection is open.
+func (b *Breaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ready(time.Now())
+}
+
+func (b *Breaker) ready(now time.Time) bool {
+	switch b.state {
+	case Open:
+		return now.Sub(b.openedAt) >= b.cfg.Cooldown
+	case HalfOpen:
+		// A probe that never reported back must not wedge the breaker.
+		return !b.probing || now.Sub(b.probeStart) >= b.cfg.Cooldown
+	}
+	return true
+}
+
+// State returns the position of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow reserves the right to send a request. When the breaker is open and the cool-down has
+// passed, the caller becomes the half-open probe. Every allowed request must be followed by
+// Record or Release.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if !b.ready(now) {
+		return false
+	}
+	if b.state != Closed {
+		b.state = HalfOpen
+		b.probing = true
+		b.probeStart = now
+	}
+	return true
+}
+
+// Record reports the outcome of an allowed request.
+func (b *Breaker) Record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	bk := b.bucketAt(now)
+	bk.requests++
+	if !success {
+		bk.failures++
+		b.consecutive++
+	} else {
+		b.consecutive = 0
+	}
+
+	switch b.state {
+	case HalfOpen:
+		b.probing = false
+		if success {
+			b.state = Closed
+			b.window = [buckets]bucket{}
+		} else {
+			b.trip(now)
+		}
+	case Closed:
+		if !success && b.shouldTrip(now) {
+			b.trip(now)
+		}
+	}
+}
+
+// Release gives back an allowed request that ended without telling anything about the upstream,
+// e.g. because the client went away.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *Breaker) shouldTrip(now time.Time) bool {
+	if b.cfg.ConsecutiveFailures > 0 && b.consecutive >= b.cfg.ConsecutiveFailures {
+		return true
+	}
+	requests, failures := b.counts(now)
+	return requests >= b.cfg.MinRequests && requests > 0 &&
+		float64(failures)/float64(requests) >= b.cfg.ErrorRate
+}
+
+func (b *Breaker) trip(now time.Time) {
+	b.state = Open
+	b.openedAt = now
+}
+
+// bucketAt returns the bucket for now, recycling it if it holds outcomes from an earlier lap.
+func (b *Breaker) bucketAt(now time.Time) *bucket {
+	width := b.cfg.Window / buckets
+	if width <= 0 {
+		width = time.Second
+	}
+	start := now.Truncate(width)
+	bk := &b.window[(start.UnixNano()/int64(width))%buckets]
+	if !bk.start.Equal(start) {
+		*bk = bucket{start: start}
+	}
+	return bk
+}
+
+// counts sums the buckets that still fall inside the window.
+func (b *Breaker) counts(now time.Time) (requests, failures int) {
+	for _, bk := range b.window {
+		if now.Sub(bk.start) < b.cfg.Window {
+			requests += bk.requests
+			failures += bk.failures
+		}
+	}
+	return requests, failures
+}
+
+// Snapshot is a point-in-time view of a breaker for health reporting. OpenedAt is when the
+// breaker last opened, and nil while it is closed.
+type Snapshot struct {
+	State               string     `json:"state"`
+	Requests            int        `json:"requests"`
+	Failures            int        `json:"failures"`
+	ErrorRate           float64    `json:"error_rate"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+}
+
+func (b *Breaker) Snapshot() Snapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	requests, failures := b.counts(now)
+	s := Snapshot{
+		State:               b.state.String(),
+		Requests:            requests,
+		Failures:            failures,
+		ConsecutiveFailures: b.consecutive,
+	}
+	if requests > 0 {
+		s.ErrorRate = float64(failures) / float64(requests)
+	}
+	if b.state != Closed {
+		openedAt := b.openedAt
+		s.OpenedAt = &openedAt
+	}
+	return s
+}
+
+// Set holds one breaker per connection ID, created on first use.
+type Set struct {
+	mu       sync.Mutex
+	cfg      Config
+	breakers map[string]*Breaker
+}
+
+func NewSet(cfg Config) *Set {
+	return &Set{cfg: cfg, breakers: make(map[string]*Breaker)}
+}
+
+func (s *Set) Get(id string) *Breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.breakers[id]
+	if !ok {
+		b = New(s.cfg)
+		s.breakers[id] = b
+	}
+	return b
+}
+
+// Snapshots returns the state of every breaker seen so far, keyed by connection ID.
+func (s *Set) Snapshots() map[string]Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]Snapshot, len(s.breakers))
+	for id, b := range s.breakers {
+		out[id] = b.Snapshot()
+	}
+	return out
+}
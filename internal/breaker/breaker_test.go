@@ -0,0 +1,94 @@
+package breaker_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/breaker"
+)
+
+func testConfig() breaker.Config {
+	return breaker.Config{
+		Window:              time.Minute,
+		MinRequests:         4,
+		ErrorRate:           0.5,
+		ConsecutiveFailures: 3,
+		Cooldown:            20 * time.Millisecond,
+	}
+}
+
+func record(b *breaker.Breaker, outcomes ...bool) {
+	for _, ok := range outcomes {
+		b.Allow()
+		b.Record(ok)
+	}
+}
+
+func TestBreaker_OpensOnConsecutiveFailures(t *testing.T) {
+	b := breaker.New(testConfig())
+	record(b, false, false)
+	assert.True(t, b.Ready())
+	record(b, false)
+	assert.False(t, b.Allow())
+	snap := b.Snapshot()
+	assert.Equal(t, "open", snap.State)
+	assert.NotNil(t, snap.OpenedAt)
+}
+
+func TestBreaker_OpensOnErrorRate(t *testing.T) {
+	b := breaker.New(testConfig())
+	record(b, true, false, true, false)
+	snap := b.Snapshot()
+	assert.Equal(t, "open", snap.State)
+	assert.Equal(t, 4, snap.Requests)
+	assert.InDelta(t, 0.5, snap.ErrorRate, 1e-9)
+}
+
+func TestBreaker_HalfOpenProbe(t *testing.T) {
+	b := breaker.New(testConfig())
+	record(b, false, false, false)
+	assert.False(t, b.Ready())
+
+	time.Sleep(25 * time.Millisecond)
+	assert.True(t, b.Allow(), "first request after the cool-down is the probe")
+	assert.Equal(t, "half-open", b.Snapshot().State)
+	assert.Equal(t, breaker.HalfOpen, b.State())
+	assert.False(t, b.Allow(), "only one probe at a time")
+
+	// A failed probe re-opens the breaker.
+	b.Record(false)
+	assert.Equal(t, "open", b.Snapshot().State)
+
+	time.Sleep(25 * time.Millisecond)
+	assert.True(t, b.Allow())
+	b.Record(true)
+	snap := b.Snapshot()
+	assert.Equal(t, "closed", snap.State)
+	assert.Zero(t, snap.Requests, "closing starts a fresh window")
+}
+
+func TestBreaker_ReleaseFreesProbe(t *testing.T) {
+	b := breaker.New(testConfig())
+	record(b, false, false, false)
+	time.Sleep(25 * time.Millisecond)
+	assert.True(t, b.Allow())
+	b.Release()
+	assert.True(t, b.Allow())
+}
+
+func TestSet_Snapshots(t *testing.T) {
+	s := breaker.NewSet(testConfig())
+	record(s.Get("conn-a"), true)
+	assert.Same(t, s.Get("conn-a"), s.Get("conn-a"))
+	snaps := s.Snapshots()
+	assert.Len(t, snaps, 1)
+	assert.Equal(t, "closed", snaps["conn-a"].State)
+
+	// Closed breakers leave opened_at out rather than reporting the zero time.
+	raw, err := json.Marshal(snaps["conn-a"])
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "opened_at")
+}
@@ -0,0 +1,227 @@
+// Package budget enforces USD spend limits on virtual keys over daily, weekly or monthly windows.
+package budget
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+const (
+	Daily   = "daily"
+	Weekly  = "weekly"
+	Monthly = "monthly"
+)
+
+// refreshInterval bounds how stale the cached spend may get relative to the usage ledger, which
+// matters when several proxy instances share one database.
+const refreshInterval = time.Minute
+
+// ValidPeriod reports whether period is one of Daily, Weekly or Monthly.
+func ValidPeriod(period string) bool {
+	return period == Daily || period == Weekly || period == Monthly
+}
+
+// Window returns the budget window containing now. Windows repeat every period starting at
+// anchor; without an anchor they follow UTC calendar days, ISO weeks and months.
+func Window(period string, anchor, now time.Time) (start, end time.Time) {
+	now = now.UTC()
+	if anchor.IsZero() {
+		y, m, d := now.Date()
+		switch period {
+		case Daily:
+			anchor = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		case Weekly:
+			anchor = time.Date(y, m, d-(int(now.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+		default:
+			anchor = time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+		}
+	}
+	anchor = anchor.UTC()
+
+	// at returns the start of the k-th window after anchor.
+	at := func(k int) time.Time {
+		switch period {
+		case Daily:
+			return anchor.AddDate(0, 0, k)
+		case Weekly:
+			return anchor.AddDate(0, 0, 7*k)
+		default:
+			return addMonths(anchor, k)
+		}
+	}
+
+	var k int
+	switch period {
+	case Daily:
+		k = int(math.Floor(now.Sub(anchor).Hours() / 24))
+	case Weekly:
+		k = int(math.Floor(now.Sub(anchor).Hours() / (24 * 7)))
+	default:
+		k = monthsBetween(anchor, now)
+	}
+	// The estimate can be one off around month ends; settle on the window that contains now.
+	for at(k).After(now) {
+		k--
+	}
+	for !at(k + 1).After(now) {
+		k++
+	}
+	return at(k), at(k + 1)
+}
+
+// addMonths moves t by k calendar months, keeping its day of the month where the target month
+// has it and otherwise using the month's last day, so an anchor on the 31st resets at the end of
+// February instead of early March.
+func addMonths(t time.Time, k int) time.Time {
+	y, m, d := t.Date()
+	if last := time.Date(y, m+time.Month(k)+1, 0, 0, 0, 0, 0, time.UTC).Day(); d > last {
+		d = last
+	}
+	return time.Date(y, m+time.Month(k), d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+func monthsBetween(from, to time.Time) int {
+	return (to.Year()-from.Year())*12 + int(to.Month()) - int(from.Month())
+}
+
+// Status is a key's spend against its budget for the current window.
+type Status struct {
+	Amount float64
+	Spent  float64
+	Period string
+	Start  time.Time
+	End    time.Time
+	// WarnPercent is the soft threshold configured on the key; zero disables warnings.
+	WarnPercent float64
+}
+
+func (s Status) Exceeded() bool {
+	return s.Amount > 0 && s.Spent >= s.Amount
+}
+
+// UsedPercent is the share of the budget spent so far.
+func (s Status) UsedPercent() float64 {
+	if s.Amount <= 0 {
+		return 0
+	}
+	return s.Spent / s.Amount * 100
+}
+
+// Warn reports whether spend has crossed the soft-warning threshold.
+func (s Status) Warn() bool {
+	return s.WarnPercent > 0 && s.UsedPercent() >= s.WarnPercent
+}
+
+func (s Status) String() string {
+	return fmt.Sprintf("%.1f%% of %s budget used ($%.4f of $%.2f)", s.UsedPercent(), s.Period, s.Spent, s.Amount)
+}
+
+type entry struct {
+	start    time.Time
+	spent    float64
+	loadedAt time.Time
+}
+
+// Pending reports spend that has been charged but not yet written to the usage ledger, such as
+// records still queued by a batching writer.
+type Pending interface {
+	PendingCost(virtualKeyID string) float64
+}
+
+// Tracker keeps the current-window spend of each key in memory. It is seeded from the usage
+// ledger plus the spend still pending a write, and then advanced with the cost of every call
+// the proxy makes.
+type Tracker struct {
+	db      db.DB
+	pending Pending
+	mu      sync.Mutex
+	entries map[string]*entry
+	now     func() time.Time
+}
+
+// NewTracker returns a tracker reading spend from database. pending may be nil when every
+// charge is written to the ledger before Add is called.
+func NewTracker(database db.DB, pending Pending) *Tracker {
+	return &Tracker{db: database, pending: pending, entries: make(map[string]*entry), now: time.Now}
+}
+
+// Check returns vk's budget status. Keys without a budget always pass. When the ledger cannot be
+// read, the spend cached for the current window is used if there is one; otherwise the error is
+// returned and the caller should refuse the request rather than let it through unmetered.
+func (t *Tracker) Check(ctx context.Context, vk *models.VirtualKey) (Status, error) {
+	if vk.BudgetAmount <= 0 {
+		return Status{}, nil
+	}
+	now := t.now()
+	start, end := Window(vk.BudgetPeriod, vk.BudgetResetAt, now)
+	status := Status{Amount: vk.BudgetAmount, Period: vk.BudgetPeriod, Start: start, End: end, WarnPercent: vk.BudgetWarnPercent}
+
+	t.mu.Lock()
+	e, ok := t.entries[vk.ID]
+	if ok && e.start.Equal(start) && now.Sub(e.loadedAt) < refreshInterval {
+		status.Spent = e.spent
+		t.mu.Unlock()
+		return status, nil
+	}
+	t.mu.Unlock()
+
+	// Pending spend is read before the ledger: a batch written in between is then counted twice,
+	// which errs on the side of the budget, rather than not at all.
+	var pending float64
+	if t.pending != nil {
+		pending = t.pending.PendingCost(vk.ID)
+	}
+	spent, err := Spent(ctx, t.db, vk.ID, start, end)
+	if err != nil {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if e, ok := t.entries[vk.ID]; ok && e.start.Equal(start) {
+			log.Printf("failed to refresh spend of key %s, using cached spend: %v", vk.ID, err)
+			status.Spent = e.spent
+			return status, nil
+		}
+		return status, err
+	}
+	spent += pending
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[vk.ID] = &entry{start: start, spent: spent, loadedAt: now}
+	status.Spent = spent
+	return status, nil
+}
+
+// Add charges cost to the key's current window. Keys that have not been checked yet have nothing
+// cached to advance; their first Check reads the charge from the ledger or the pending spend.
+func (t *Tracker) Add(vk *models.VirtualKey, cost float64) {
+	if vk.BudgetAmount <= 0 || cost <= 0 {
+		return
+	}
+	start, _ := Window(vk.BudgetPeriod, vk.BudgetResetAt, t.now())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.entries[vk.ID]; ok && e.start.Equal(start) {
+		e.spent += cost
+	}
+}
+
+// Spent sums the recorded cost of a key between start and end.
+func Spent(ctx context.Context, database db.DB, virtualKeyID string, start, end time.Time) (float64, error) {
+	rows, err := database.AggregateUsage(ctx, models.UsageFilter{VirtualKeyID: virtualKeyID, From: start, To: end})
+	if err != nil {
+		return 0, err
+	}
+	var spent float64
+	for _, r := range rows {
+		spent += r.CostUSD
+	}
+	return spent, nil
+}
@@ -0,0 +1,108 @@
+package budget_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/budget"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/usage"
+)
+
+func date(y int, m time.Month, d, h int) time.Time {
+	return time.Date(y, m, d, h, 0, 0, 0, time.UTC)
+}
+
+func TestWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		period     string
+		anchor     time.Time
+		now        time.Time
+		start, end time.Time
+	}{
+		{"calendar month", budget.Monthly, time.Time{}, date(2026, 3, 15, 12), date(2026, 3, 1, 0), date(2026, 4, 1, 0)},
+		{"iso week", budget.Weekly, time.Time{}, date(2026, 10, 17, 9), date(2026, 10, 12, 0), date(2026, 10, 19, 0)},
+		{"calendar day", budget.Daily, time.Time{}, date(2026, 10, 17, 23), date(2026, 10, 17, 0), date(2026, 10, 18, 0)},
+		{"anchored month", budget.Monthly, date(2026, 1, 15, 0), date(2026, 3, 10, 0), date(2026, 2, 15, 0), date(2026, 3, 15, 0)},
+		{"anchored day", budget.Daily, date(2026, 1, 1, 6), date(2026, 1, 5, 3), date(2026, 1, 4, 6), date(2026, 1, 5, 6)},
+		{"anchor in the future", budget.Weekly, date(2026, 6, 1, 0), date(2026, 5, 20, 0), date(2026, 5, 18, 0), date(2026, 5, 25, 0)},
+		{"on the boundary", budget.Monthly, date(2026, 1, 15, 0), date(2026, 2, 15, 0), date(2026, 2, 15, 0), date(2026, 3, 15, 0)},
+		{"anchor past the end of february", budget.Monthly, date(2026, 1, 31, 0), date(2026, 2, 10, 0), date(2026, 1, 31, 0), date(2026, 2, 28, 0)},
+		{"back on the anchor day", budget.Monthly, date(2026, 1, 31, 0), date(2026, 3, 1, 0), date(2026, 2, 28, 0), date(2026, 3, 31, 0)},
+		{"anchor past the end of april", budget.Monthly, date(2026, 1, 31, 0), date(2026, 4, 30, 12), date(2026, 4, 30, 0), date(2026, 5, 31, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := budget.Window(tt.period, tt.anchor, tt.now)
+			assert.Equal(t, tt.start, start)
+			assert.Equal(t, tt.end, end)
+		})
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s := budget.Status{Amount: 500, Spent: 420, Period: budget.Monthly, WarnPercent: 80}
+	assert.False(t, s.Exceeded())
+	assert.True(t, s.Warn())
+	assert.Equal(t, "84.0% of monthly budget used ($420.0000 of $500.00)", s.String())
+
+	s.Spent = 500
+	assert.True(t, s.Exceeded())
+
+	assert.False(t, budget.Status{}.Exceeded(), "keys without a budget are never cut off")
+}
+
+func TestTracker_CountsSpendNotYetWritten(t *testing.T) {
+	database, err := db.InitDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	recorder := usage.NewRecorder(database, usage.DefaultBatchSize, time.Hour)
+	tracker := budget.NewTracker(database, recorder)
+	vk := &models.VirtualKey{ID: models.NewID(), BudgetAmount: 1, BudgetPeriod: budget.Daily}
+	ctx := context.Background()
+
+	// The charge is still queued, so only the pending spend knows about it.
+	recorder.Record(models.UsageRecord{VirtualKeyID: vk.ID, CostUSD: 0.6})
+	tracker.Add(vk, 0.6)
+	status, err := tracker.Check(ctx, vk)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.6, status.Spent, 1e-9)
+
+	tracker.Add(vk, 0.5)
+	status, err = tracker.Check(ctx, vk)
+	require.NoError(t, err)
+	assert.True(t, status.Exceeded())
+
+	// Once written it is counted from the ledger, and only once.
+	recorder.Close()
+	assert.Zero(t, recorder.PendingCost(vk.ID))
+	status, err = budget.NewTracker(database, recorder).Check(ctx, vk)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.6, status.Spent, 1e-9)
+}
+
+// unreadableLedger fails every usage query.
+type unreadableLedger struct {
+	db.DB
+}
+
+func (unreadableLedger) AggregateUsage(context.Context, models.UsageFilter) ([]models.UsageSummary, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestTracker_FailsWhenLedgerIsUnreadable(t *testing.T) {
+	tracker := budget.NewTracker(unreadableLedger{}, nil)
+	ctx := context.Background()
+
+	_, err := tracker.Check(ctx, &models.VirtualKey{ID: "vk", BudgetAmount: 1, BudgetPeriod: budget.Daily})
+	assert.Error(t, err, "a budget that cannot be read must not silently pass")
+
+	_, err = tracker.Check(ctx, &models.VirtualKey{ID: "vk"})
+	assert.NoError(t, err, "keys without a budget do not need the ledger")
+}
@@ -0,0 +1,172 @@
+// Package cache keeps upstream responses so identical deterministic requests can be answered
+// without calling the provider again.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+const (
+	// DefaultMaxBytes bounds the in-memory store.
+	DefaultMaxBytes = 256 << 20
+	// pruneInterval is how often the database store deletes expired entries.
+	pruneInterval = 10 * time.Minute
+)
+
+// Entry is a cached response body as it was sent to the client.
+type Entry struct {
+	ContentType string
+	Body        []byte
+}
+
+// Store holds cached responses.
+type Store interface {
+	// Get returns the entry stored under key, or nil if there is none or it has expired.
+	Get(ctx context.Context, key string) (*Entry, error)
+	// Set stores e under key for ttl.
+	Set(ctx context.Context, key string, e *Entry, ttl time.Duration) error
+}
+
+// FromEnv returns the store PROXY_CACHE_STORE selects: "db" keeps entries in the database, shared
+// by every proxy instance; anything else an in-memory store of PROXY_CACHE_MAX_BYTES
+// (DefaultMaxBytes if unset).
+func FromEnv(database db.DB) Store {
+	if os.Getenv("PROXY_CACHE_STORE") == "db" {
+		return NewDBStore(database)
+	}
+	maxBytes := int64(DefaultMaxBytes)
+	if v, err := strconv.ParseInt(os.Getenv("PROXY_CACHE_MAX_BYTES"), 10, 64); err == nil && v > 0 {
+		maxBytes = v
+	}
+	return NewMemory(maxBytes)
+}
+
+// Key returns the cache key of virtualKeyID's request to target, which names the models that may
+// answer it: a hash of both, the path and query, and the body with its keys sorted, so clients
+// that order fields differently share entries. Entries are never shared between virtual keys.
+// `user` is left out, since it only identifies the caller.
+func Key(virtualKeyID, target, path string, body map[string]interface{}) string {
+	normalized := make(map[string]interface{}, len(body))
+	for k, v := range body {
+		if k != "user" {
+			normalized[k] = v
+		}
+	}
+	raw, _ := json.Marshal(normalized)
+	h := sha256.New()
+	h.Write([]byte(virtualKeyID + "\n" + target + "\n" + path + "\n"))
+	h.Write(raw)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Memory is an in-process Store that evicts the least recently used entries once the bodies it
+// holds exceed its size.
+type Memory struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List // Most recently used first
+	entries  map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key       string
+	entry     *Entry
+	expiresAt time.Time
+}
+
+func NewMemory(maxBytes int64) *Memory {
+	return &Memory{maxBytes: maxBytes, order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (m *Memory) Get(ctx context.Context, key string) (*Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if e := el.Value.(*memoryEntry); time.Now().After(e.expiresAt) {
+		m.remove(el)
+		return nil, nil
+	}
+	m.order.MoveToFront(el)
+	return el.Value.(*memoryEntry).entry, nil
+}
+
+func (m *Memory) Set(ctx context.Context, key string, e *Entry, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+	if int64(len(e.Body)) > m.maxBytes {
+		return nil
+	}
+	m.entries[key] = m.order.PushFront(&memoryEntry{key: key, entry: e, expiresAt: time.Now().Add(ttl)})
+	m.size += int64(len(e.Body))
+	for m.size > m.maxBytes {
+		m.remove(m.order.Back())
+	}
+	return nil
+}
+
+func (m *Memory) remove(el *list.Element) {
+	e := m.order.Remove(el).(*memoryEntry)
+	delete(m.entries, e.key)
+	m.size -= int64(len(e.entry.Body))
+}
+
+// DBStore keeps entries in the proxy's database, so they are shared by every proxy instance and
+// survive restarts. Expired entries are deleted now and then as new ones are stored.
+type DBStore struct {
+	db db.DB
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func NewDBStore(database db.DB) *DBStore {
+	return &DBStore{db: database}
+}
+
+func (s *DBStore) Get(ctx context.Context, key string) (*Entry, error) {
+	cr, err := s.db.GetCachedResponse(ctx, key)
+	if err != nil || cr == nil || !time.Now().Before(cr.ExpiresAt) {
+		return nil, err
+	}
+	return &Entry{ContentType: cr.ContentType, Body: cr.Body}, nil
+}
+
+func (s *DBStore) Set(ctx context.Context, key string, e *Entry, ttl time.Duration) error {
+	now := time.Now()
+	s.mu.Lock()
+	prune := now.Sub(s.lastPrune) >= pruneInterval
+	if prune {
+		s.lastPrune = now
+	}
+	s.mu.Unlock()
+	if prune {
+		if err := s.db.DeleteExpiredCachedResponses(ctx, now); err != nil {
+			return err
+		}
+	}
+	return s.db.SaveCachedResponse(ctx, &models.CachedResponse{
+		Hash:        key,
+		ContentType: e.ContentType,
+		Body:        e.Body,
+		ExpiresAt:   now.Add(ttl),
+		CreatedAt:   now,
+	})
+}
@@ -0,0 +1,77 @@
+package cache_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/cache"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
+)
+
+func TestKey(t *testing.T) {
+	body := map[string]interface{}{"model": "gpt-4o", "temperature": 0.0, "messages": []interface{}{"hi"}}
+	key := cache.Key("vk-1", "pm-1", "/v1/chat/completions", body)
+
+	reordered := map[string]interface{}{"messages": []interface{}{"hi"}, "temperature": 0.0, "model": "gpt-4o", "user": "ci-runner-7"}
+	assert.Equal(t, key, cache.Key("vk-1", "pm-1", "/v1/chat/completions", reordered), "field order and `user` do not matter")
+	assert.NotEqual(t, key, cache.Key("vk-1", "pm-2", "/v1/chat/completions", body), "each provider model has its own entries")
+	assert.NotEqual(t, key, cache.Key("vk-2", "pm-1", "/v1/chat/completions", body), "each virtual key has its own entries")
+	assert.NotEqual(t, key, cache.Key("vk-1", "pm-1", "/v1/chat/completions", map[string]interface{}{"model": "gpt-4o", "temperature": 0.0, "messages": []interface{}{"hello"}}))
+}
+
+func TestMemory_EvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	m := cache.NewMemory(10)
+	require.NoError(t, m.Set(ctx, "a", &cache.Entry{Body: []byte("aaaa")}, time.Hour))
+	require.NoError(t, m.Set(ctx, "b", &cache.Entry{Body: []byte("bbbb")}, time.Hour))
+	// Reading a makes b the least recently used entry.
+	e, err := m.Get(ctx, "a")
+	require.NoError(t, err)
+	require.NotNil(t, e)
+
+	require.NoError(t, m.Set(ctx, "c", &cache.Entry{Body: []byte("cccc")}, time.Hour))
+	b, _ := m.Get(ctx, "b")
+	assert.Nil(t, b)
+	a, _ := m.Get(ctx, "a")
+	assert.NotNil(t, a)
+	c, _ := m.Get(ctx, "c")
+	assert.NotNil(t, c)
+
+	// Entries larger than the whole store are not kept.
+	require.NoError(t, m.Set(ctx, "d", &cache.Entry{Body: []byte("dddddddddddd")}, time.Hour))
+	d, _ := m.Get(ctx, "d")
+	assert.Nil(t, d)
+}
+
+func TestStores_Expire(t *testing.T) {
+	database, err := db.InitDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	stores := map[string]cache.Store{"memory": cache.NewMemory(cache.DefaultMaxBytes), "db": cache.NewDBStore(database)}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			require.NoError(t, store.Set(ctx, "long", &cache.Entry{ContentType: "application/json", Body: []byte(`{"ok":true}`)}, time.Hour))
+			require.NoError(t, store.Set(ctx, "short", &cache.Entry{Body: []byte("x")}, 10*time.Millisecond))
+			time.Sleep(20 * time.Millisecond)
+
+			e, err := store.Get(ctx, "long")
+			require.NoError(t, err)
+			require.NotNil(t, e)
+			assert.Equal(t, "application/json", e.ContentType)
+			assert.Equal(t, `{"ok":true}`, string(e.Body))
+
+			e, err = store.Get(ctx, "short")
+			require.NoError(t, err)
+			assert.Nil(t, e)
+
+			e, err = store.Get(ctx, "missing")
+			require.NoError(t, err)
+			assert.Nil(t, e)
+		})
+	}
+}
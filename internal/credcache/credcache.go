@@ -0,0 +1,54 @@
+// Package credcache keeps short-lived upstream credentials, such as OAuth access tokens and
+// assumed-role keys, until shortly before they expire.
+package credcache
+
+import (
+	"sync"
+	"time"
+)
+
+// RefreshMargin is how long before they expire credentials are renewed, so a request never
+// goes out with credentials that lapse in flight.
+const RefreshMargin = 5 * time.Minute
+
+// Cache holds one credential per key. Each key is fetched under its own lock: concurrent
+// callers for a key wait for a single fetch, and a slow fetch never holds up other keys.
+type Cache[T any] struct {
+	mu      sync.Mutex
+	entries map[string]*entry[T]
+}
+
+type entry[T any] struct {
+	mu      sync.Mutex // Held while the credential is fetched
+	value   T
+	expires time.Time
+}
+
+func New[T any]() *Cache[T] {
+	return &Cache[T]{entries: make(map[string]*entry[T])}
+}
+
+// Get returns the credential cached under key, calling fetch for a new one when there is none
+// or it expires within RefreshMargin. Failed fetches are not cached.
+func (c *Cache[T]) Get(key string, fetch func() (T, time.Time, error)) (T, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &entry[T]{}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Until(e.expires) > RefreshMargin {
+		return e.value, nil
+	}
+	value, expires, err := fetch()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	e.value, e.expires = value, expires
+	return value, nil
+}
@@ -0,0 +1,83 @@
+package credcache_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/credcache"
+)
+
+func TestCache_FetchesOncePerKey(t *testing.T) {
+	c := credcache.New[string]()
+	var fetches atomic.Int32
+	fetch := func() (string, time.Time, error) {
+		fetches.Add(1)
+		time.Sleep(10 * time.Millisecond)
+		return "token", time.Now().Add(time.Hour), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Get("key", fetch)
+			assert.NoError(t, err)
+			assert.Equal(t, "token", v)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), fetches.Load())
+}
+
+func TestCache_SlowFetchDoesNotBlockOtherKeys(t *testing.T) {
+	c := credcache.New[string]()
+	release := make(chan struct{})
+	go c.Get("slow", func() (string, time.Time, error) {
+		<-release
+		return "slow", time.Now().Add(time.Hour), nil
+	})
+	defer close(release)
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		v, err := c.Get("fast", func() (string, time.Time, error) {
+			return "fast", time.Now().Add(time.Hour), nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "fast", v)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("fetch of another key waited for the slow one")
+	}
+}
+
+func TestCache_RenewsBeforeExpiryAndSkipsFailures(t *testing.T) {
+	c := credcache.New[int]()
+	n := 0
+	fetch := func() (int, time.Time, error) {
+		n++
+		return n, time.Now().Add(time.Minute), nil
+	}
+	first, err := c.Get("key", fetch)
+	require.NoError(t, err)
+	second, err := c.Get("key", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, 1, first)
+	assert.Equal(t, 2, second, "credentials inside the refresh margin are renewed")
+
+	_, err = c.Get("other", func() (int, time.Time, error) { return 0, time.Time{}, errors.New("denied") })
+	require.Error(t, err)
+	v, err := c.Get("other", func() (int, time.Time, error) { return 7, time.Now().Add(time.Hour), nil })
+	require.NoError(t, err)
+	assert.Equal(t, 7, v)
+}
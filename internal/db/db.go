@@ -2,8 +2,10 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/cryptoutil"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
@@ -25,18 +27,56 @@ type DB interface {
 	SaveProviderModel(ctx context.Context, pm *models.ProviderModel) error
 	GetProviderModel(ctx context.Context, id string) (*models.ProviderModel, error)
 	GetProviderModelByName(ctx context.Context, name string) (*models.ProviderModel, error)
+	ListProviderModelsByName(ctx context.Context, name string) ([]models.ProviderModel, error)
 	ListProviderModels(ctx context.Context, connectionID string) ([]models.ProviderModel, error)
 	DeleteProviderModel(ctx context.Context, id string) error
 
 	SaveVirtualKey(ctx context.Context, vk *models.VirtualKey) error
 	GetVirtualKey(ctx context.Context, key string) (*models.VirtualKey, error)
 	ListVirtualKeys(ctx context.Context) ([]models.VirtualKey, error)
+	// UpdateVirtualKeySettings writes the budget and response cache settings of vk, leaving its
+	// name and key as they are stored.
+	UpdateVirtualKeySettings(ctx context.Context, vk *models.VirtualKey) error
 	DeleteVirtualKey(ctx context.Context, id string) error
 
 	SaveVirtualKeyAssignment(ctx context.Context, vka *models.VirtualKeyAssignment) error
 	GetVirtualKeyAssignment(ctx context.Context, virtualKeyID, modelAlias string) (*models.VirtualKeyAssignment, error)
+	ListVirtualKeyAssignmentsByAlias(ctx context.Context, virtualKeyID, modelAlias string) ([]models.VirtualKeyAssignment, error)
 	ListVirtualKeyAssignments(ctx context.Context, virtualKeyID string) ([]models.VirtualKeyAssignment, error)
 	DeleteVirtualKeyAssignment(ctx context.Context, id string) error
+
+	SaveUsageRecords(ctx context.Context, records []models.UsageRecord) error
+	AggregateUsage(ctx context.Context, filter models.UsageFilter) ([]models.UsageSummary, error)
+
+	// GetCachedResponse returns nil without an error when nothing is stored under hash.
+	GetCachedResponse(ctx context.Context, hash string) (*models.CachedResponse, error)
+	SaveCachedResponse(ctx context.Context, cr *models.CachedResponse) error
+	DeleteExpiredCachedResponses(ctx context.Context, now time.Time) error
+}
+
+// connectionSecrets lists the Connection fields stored encrypted.
+func connectionSecrets(conn *models.Connection) []*string {
+	return []*string{&conn.APIKey, &conn.AWSSecretAccessKey, &conn.AWSSessionToken, &conn.GCPServiceAccountJSON, &conn.AzureClientSecret}
+}
+
+func encryptConnection(conn *models.Connection) {
+	for _, secret := range connectionSecrets(conn) {
+		if *secret != "" {
+			if encrypted, err := cryptoutil.Encrypt(*secret); err == nil {
+				*secret = encrypted
+			}
+		}
+	}
+}
+
+func decryptConnection(conn *models.Connection) {
+	for _, secret := range connectionSecrets(conn) {
+		if *secret != "" {
+			if decrypted, err := cryptoutil.Decrypt(*secret); err == nil {
+				*secret = decrypted
+			}
+		}
+	}
 }
 
 type SQLDB struct {
@@ -44,12 +84,7 @@ type SQLDB struct {
 }
 
 func (s *SQLDB) SaveConnection(ctx context.Context, conn *models.Connection) error {
-	if conn.APIKey != "" {
-		encrypted, err := cryptoutil.Encrypt(conn.APIKey)
-		if err == nil {
-			conn.APIKey = encrypted
-		}
-	}
+	encryptConnection(conn)
 	return s.db.WithContext(ctx).Save(conn).Error
 }
 
@@ -59,12 +94,7 @@ func (s *SQLDB) GetConnection(ctx context.Context, id string) (*models.Connectio
 	if err != nil {
 		return nil, err
 	}
-	if conn.APIKey != "" {
-		decrypted, err := cryptoutil.Decrypt(conn.APIKey)
-		if err == nil {
-			conn.APIKey = decrypted
-		}
-	}
+	decryptConnection(&conn)
 	return &conn, nil
 }
 
@@ -73,10 +103,7 @@ func (s *SQLDB) ListConnections(ctx context.Context) ([]models.Connection, error
 	err := s.db.WithContext(ctx).Find(&conns).Error
 	if err == nil {
 		for i := range conns {
-			if conns[i].APIKey != "" {
-				decrypted, _ := cryptoutil.Decrypt(conns[i].APIKey)
-				conns[i].APIKey = decrypted
-			}
+			decryptConnection(&conns[i])
 		}
 	}
 	return conns, err
@@ -102,6 +129,12 @@ func (s *SQLDB) GetProviderModelByName(ctx context.Context, name string) (*model
 	return &pm, err
 }
 
+func (s *SQLDB) ListProviderModelsByName(ctx context.Context, name string) ([]models.ProviderModel, error) {
+	var pms []models.ProviderModel
+	err := s.db.WithContext(ctx).Where("name = ?", name).Find(&pms).Error
+	return pms, err
+}
+
 func (s *SQLDB) ListProviderModels(ctx context.Context, connectionID string) ([]models.ProviderModel, error) {
 	var pms []models.ProviderModel
 	q := s.db.WithContext(ctx)
@@ -157,6 +190,21 @@ func (s *SQLDB) ListVirtualKeys(ctx context.Context) ([]models.VirtualKey, error
 	return vks, err
 }
 
+func (s *SQLDB) UpdateVirtualKeySettings(ctx context.Context, vk *models.VirtualKey) error {
+	res := s.db.WithContext(ctx).Model(&models.VirtualKey{}).Where("id = ?", vk.ID).Updates(map[string]interface{}{
+		"budget_amount":       vk.BudgetAmount,
+		"budget_period":       vk.BudgetPeriod,
+		"budget_reset_at":     vk.BudgetResetAt,
+		"budget_warn_percent": vk.BudgetWarnPercent,
+		"cache_ttl_seconds":   vk.CacheTTLSeconds,
+		"updated_at":          vk.UpdatedAt,
+	})
+	if res.Error == nil && res.RowsAffected == 0 {
+		return fmt.Errorf("virtual key %s not found", vk.ID)
+	}
+	return res.Error
+}
+
 func (s *SQLDB) DeleteVirtualKey(ctx context.Context, id string) error {
 	return s.db.WithContext(ctx).Delete(&models.VirtualKey{}, "id = ?", id).Error
 }
@@ -171,6 +219,12 @@ func (s *SQLDB) GetVirtualKeyAssignment(ctx context.Context, virtualKeyID, model
 	return &vka, err
 }
 
+func (s *SQLDB) ListVirtualKeyAssignmentsByAlias(ctx context.Context, virtualKeyID, modelAlias string) ([]models.VirtualKeyAssignment, error) {
+	var vkas []models.VirtualKeyAssignment
+	err := s.db.WithContext(ctx).Where("virtual_key_id = ? AND model_alias = ?", virtualKeyID, modelAlias).Order("created_at").Find(&vkas).Error
+	return vkas, err
+}
+
 func (s *SQLDB) ListVirtualKeyAssignments(ctx context.Context, virtualKeyID string) ([]models.VirtualKeyAssignment, error) {
 	var vkas []models.VirtualKeyAssignment
 	q := s.db.WithContext(ctx)
@@ -185,6 +239,73 @@ func (s *SQLDB) DeleteVirtualKeyAssignment(ctx context.Context, id string) error
 	return s.db.WithContext(ctx).Delete(&models.VirtualKeyAssignment{}, "id = ?", id).Error
 }
 
+func (s *SQLDB) SaveUsageRecords(ctx context.Context, records []models.UsageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	return s.db.WithContext(ctx).CreateInBatches(records, 100).Error
+}
+
+func (s *SQLDB) AggregateUsage(ctx context.Context, filter models.UsageFilter) ([]models.UsageSummary, error) {
+	var groups []string
+	if filter.ByVirtualKey {
+		groups = append(groups, "virtual_key_id")
+	}
+	if filter.ByModel {
+		groups = append(groups, "provider_model_id")
+	}
+	if filter.ByDay {
+		groups = append(groups, "day")
+	}
+
+	selects := append([]string{}, groups...)
+	selects = append(selects,
+		"COUNT(*) AS requests",
+		"COALESCE(SUM(prompt_tokens), 0) AS prompt_tokens",
+		"COALESCE(SUM(completion_tokens), 0) AS completion_tokens",
+		"COALESCE(SUM(cost_usd), 0) AS cost_usd",
+		"COALESCE(AVG(latency_ms), 0) AS avg_latency_ms",
+	)
+
+	q := s.db.WithContext(ctx).Model(&models.UsageRecord{}).Select(strings.Join(selects, ", "))
+	if filter.VirtualKeyID != "" {
+		q = q.Where("virtual_key_id = ?", filter.VirtualKeyID)
+	}
+	if filter.ProviderModelID != "" {
+		q = q.Where("provider_model_id = ?", filter.ProviderModelID)
+	}
+	if !filter.From.IsZero() {
+		q = q.Where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		q = q.Where("created_at < ?", filter.To)
+	}
+	if len(groups) > 0 {
+		q = q.Group(strings.Join(groups, ", ")).Order(strings.Join(groups, ", "))
+	}
+
+	var out []models.UsageSummary
+	err := q.Scan(&out).Error
+	return out, err
+}
+
+func (s *SQLDB) GetCachedResponse(ctx context.Context, hash string) (*models.CachedResponse, error) {
+	var crs []models.CachedResponse
+	err := s.db.WithContext(ctx).Where("hash = ?", hash).Limit(1).Find(&crs).Error
+	if err != nil || len(crs) == 0 {
+		return nil, err
+	}
+	return &crs[0], nil
+}
+
+func (s *SQLDB) SaveCachedResponse(ctx context.Context, cr *models.CachedResponse) error {
+	return s.db.WithContext(ctx).Save(cr).Error
+}
+
+func (s *SQLDB) DeleteExpiredCachedResponses(ctx context.Context, now time.Time) error {
+	return s.db.WithContext(ctx).Delete(&models.CachedResponse{}, "expires_at <= ?", now).Error
+}
+
 type MongoDB struct {
 	client *mongo.Client
 	db     *mongo.Database
@@ -192,12 +313,7 @@ type MongoDB struct {
 
 func (m *MongoDB) SaveConnection(ctx context.Context, conn *models.Connection) error {
 	coll := m.db.Collection("connections")
-	if conn.APIKey != "" {
-		encrypted, err := cryptoutil.Encrypt(conn.APIKey)
-		if err == nil {
-			conn.APIKey = encrypted
-		}
-	}
+	encryptConnection(conn)
 	_, err := coll.UpdateOne(ctx, bson.M{"_id": conn.ID}, bson.M{"$set": conn}, options.UpdateOne().SetUpsert(true))
 	return err
 }
@@ -209,12 +325,7 @@ func (m *MongoDB) GetConnection(ctx context.Context, id string) (*models.Connect
 	if err != nil {
 		return nil, err
 	}
-	if conn.APIKey != "" {
-		decrypted, err := cryptoutil.Decrypt(conn.APIKey)
-		if err == nil {
-			conn.APIKey = decrypted
-		}
-	}
+	decryptConnection(&conn)
 	return &conn, nil
 }
 
@@ -228,10 +339,7 @@ func (m *MongoDB) ListConnections(ctx context.Context) ([]models.Connection, err
 	err = cursor.All(ctx, &conns)
 	if err == nil {
 		for i := range conns {
-			if conns[i].APIKey != "" {
-				decrypted, _ := cryptoutil.Decrypt(conns[i].APIKey)
-				conns[i].APIKey = decrypted
-			}
+			decryptConnection(&conns[i])
 		}
 	}
 	return conns, err
@@ -263,6 +371,17 @@ func (m *MongoDB) GetProviderModelByName(ctx context.Context, name string) (*mod
 	return &pm, err
 }
 
+func (m *MongoDB) ListProviderModelsByName(ctx context.Context, name string) ([]models.ProviderModel, error) {
+	coll := m.db.Collection("provider_models")
+	cursor, err := coll.Find(ctx, bson.M{"name": name})
+	if err != nil {
+		return nil, err
+	}
+	var pms []models.ProviderModel
+	err = cursor.All(ctx, &pms)
+	return pms, err
+}
+
 func (m *MongoDB) ListProviderModels(ctx context.Context, connectionID string) ([]models.ProviderModel, error) {
 	coll := m.db.Collection("provider_models")
 	filter := bson.M{}
@@ -333,6 +452,22 @@ func (m *MongoDB) ListVirtualKeys(ctx context.Context) ([]models.VirtualKey, err
 	return vks, err
 }
 
+func (m *MongoDB) UpdateVirtualKeySettings(ctx context.Context, vk *models.VirtualKey) error {
+	coll := m.db.Collection("virtual_keys")
+	res, err := coll.UpdateOne(ctx, bson.M{"_id": vk.ID}, bson.M{"$set": bson.M{
+		"budget_amount":       vk.BudgetAmount,
+		"budget_period":       vk.BudgetPeriod,
+		"budget_reset_at":     vk.BudgetResetAt,
+		"budget_warn_percent": vk.BudgetWarnPercent,
+		"cache_ttl_seconds":   vk.CacheTTLSeconds,
+		"updated_at":          vk.UpdatedAt,
+	}})
+	if err == nil && res.MatchedCount == 0 {
+		return fmt.Errorf("virtual key %s not found", vk.ID)
+	}
+	return err
+}
+
 func (m *MongoDB) DeleteVirtualKey(ctx context.Context, id string) error {
 	coll := m.db.Collection("virtual_keys")
 	_, err := coll.DeleteOne(ctx, bson.M{"_id": id})
@@ -352,6 +487,18 @@ func (m *MongoDB) GetVirtualKeyAssignment(ctx context.Context, virtualKeyID, mod
 	return &vka, err
 }
 
+func (m *MongoDB) ListVirtualKeyAssignmentsByAlias(ctx context.Context, virtualKeyID, modelAlias string) ([]models.VirtualKeyAssignment, error) {
+	coll := m.db.Collection("virtual_key_assignments")
+	filter := bson.M{"virtual_key_id": virtualKeyID, "model_alias": modelAlias}
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var vkas []models.VirtualKeyAssignment
+	err = cursor.All(ctx, &vkas)
+	return vkas, err
+}
+
 func (m *MongoDB) ListVirtualKeyAssignments(ctx context.Context, virtualKeyID string) ([]models.VirtualKeyAssignment, error) {
 	coll := m.db.Collection("virtual_key_assignments")
 	filter := bson.M{}
@@ -373,6 +520,107 @@ func (m *MongoDB) DeleteVirtualKeyAssignment(ctx context.Context, id string) err
 	return err
 }
 
+func (m *MongoDB) SaveUsageRecords(ctx context.Context, records []models.UsageRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	coll := m.db.Collection("usage_records")
+	_, err := coll.InsertMany(ctx, records)
+	return err
+}
+
+func (m *MongoDB) AggregateUsage(ctx context.Context, filter models.UsageFilter) ([]models.UsageSummary, error) {
+	coll := m.db.Collection("usage_records")
+
+	match := bson.M{}
+	if filter.VirtualKeyID != "" {
+		match["virtual_key_id"] = filter.VirtualKeyID
+	}
+	if filter.ProviderModelID != "" {
+		match["provider_model_id"] = filter.ProviderModelID
+	}
+	created := bson.M{}
+	if !filter.From.IsZero() {
+		created["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		created["$lt"] = filter.To
+	}
+	if len(created) > 0 {
+		match["created_at"] = created
+	}
+
+	groupID := bson.M{}
+	if filter.ByVirtualKey {
+		groupID["virtual_key_id"] = "$virtual_key_id"
+	}
+	if filter.ByModel {
+		groupID["provider_model_id"] = "$provider_model_id"
+	}
+	if filter.ByDay {
+		groupID["day"] = "$day"
+	}
+
+	pipeline := bson.A{
+		bson.M{"$match": match},
+		bson.M{"$group": bson.M{
+			"_id":               groupID,
+			"requests":          bson.M{"$sum": 1},
+			"prompt_tokens":     bson.M{"$sum": "$prompt_tokens"},
+			"completion_tokens": bson.M{"$sum": "$completion_tokens"},
+			"cost_usd":          bson.M{"$sum": "$cost_usd"},
+			"avg_latency_ms":    bson.M{"$avg": "$latency_ms"},
+		}},
+		// bson.D, not bson.M: the sort keys are applied in order.
+		bson.M{"$sort": bson.D{{Key: "_id.virtual_key_id", Value: 1}, {Key: "_id.provider_model_id", Value: 1}, {Key: "_id.day", Value: 1}}},
+	}
+	cursor, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ID                  models.UsageSummary `bson:"_id"`
+		models.UsageSummary `bson:",inline"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	out := make([]models.UsageSummary, len(rows))
+	for i, row := range rows {
+		out[i] = row.UsageSummary
+		out[i].VirtualKeyID = row.ID.VirtualKeyID
+		out[i].ProviderModelID = row.ID.ProviderModelID
+		out[i].Day = row.ID.Day
+	}
+	return out, nil
+}
+
+func (m *MongoDB) GetCachedResponse(ctx context.Context, hash string) (*models.CachedResponse, error) {
+	coll := m.db.Collection("cached_responses")
+	var cr models.CachedResponse
+	err := coll.FindOne(ctx, bson.M{"_id": hash}).Decode(&cr)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cr, nil
+}
+
+func (m *MongoDB) SaveCachedResponse(ctx context.Context, cr *models.CachedResponse) error {
+	coll := m.db.Collection("cached_responses")
+	_, err := coll.UpdateOne(ctx, bson.M{"_id": cr.Hash}, bson.M{"$set": cr}, options.UpdateOne().SetUpsert(true))
+	return err
+}
+
+func (m *MongoDB) DeleteExpiredCachedResponses(ctx context.Context, now time.Time) error {
+	coll := m.db.Collection("cached_responses")
+	_, err := coll.DeleteMany(ctx, bson.M{"expires_at": bson.M{"$lte": now}})
+	return err
+}
+
 func InitDB(dbType, dsn string) (DB, error) {
 	switch strings.ToLower(dbType) {
 	case "sqlite":
@@ -380,21 +628,21 @@ func InitDB(dbType, dsn string) (DB, error) {
 		if err != nil {
 			return nil, err
 		}
-		db.AutoMigrate(&models.Connection{}, &models.ProviderModel{}, &models.VirtualKey{}, &models.VirtualKeyAssignment{})
+		db.AutoMigrate(&models.Connection{}, &models.ProviderModel{}, &models.VirtualKey{}, &models.VirtualKeyAssignment{}, &models.UsageRecord{}, &models.CachedResponse{})
 		return &SQLDB{db: db}, nil
 	case "postgres":
 		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 		if err != nil {
 			return nil, err
 		}
-		db.AutoMigrate(&models.Connection{}, &models.ProviderModel{}, &models.VirtualKey{}, &models.VirtualKeyAssignment{})
+		db.AutoMigrate(&models.Connection{}, &models.ProviderModel{}, &models.VirtualKey{}, &models.VirtualKeyAssignment{}, &models.UsageRecord{}, &models.CachedResponse{})
 		return &SQLDB{db: db}, nil
 	case "mssql":
 		db, err := gorm.Open(sqlserver.Open(dsn), &gorm.Config{})
 		if err != nil {
 			return nil, err
 		}
-		db.AutoMigrate(&models.Connection{}, &models.ProviderModel{}, &models.VirtualKey{}, &models.VirtualKeyAssignment{})
+		db.AutoMigrate(&models.Connection{}, &models.ProviderModel{}, &models.VirtualKey{}, &models.VirtualKeyAssignment{}, &models.UsageRecord{}, &models.CachedResponse{})
 		return &SQLDB{db: db}, nil
 	case "mongodb":
 		client, err := mongo.Connect(options.Client().ApplyURI(dsn))
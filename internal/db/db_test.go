@@ -0,0 +1,75 @@
+package db_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+func newSQLite(t *testing.T) db.DB {
+	t.Helper()
+	database, err := db.InitDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	return database
+}
+
+func TestSQLDB_AggregateUsage(t *testing.T) {
+	database := newSQLite(t)
+	ctx := context.Background()
+
+	day1 := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	records := []models.UsageRecord{
+		{ID: models.NewID(), VirtualKeyID: "vk-a", ProviderModelID: "pm-1", PromptTokens: 10, CompletionTokens: 5, LatencyMs: 100, Day: "2026-03-01", CreatedAt: day1},
+		{ID: models.NewID(), VirtualKeyID: "vk-a", ProviderModelID: "pm-2", PromptTokens: 20, CompletionTokens: 5, LatencyMs: 300, Day: "2026-03-01", CreatedAt: day1},
+		{ID: models.NewID(), VirtualKeyID: "vk-b", ProviderModelID: "pm-1", PromptTokens: 7, CompletionTokens: 3, LatencyMs: 50, Day: "2026-03-02", CreatedAt: day2},
+	}
+	require.NoError(t, database.SaveUsageRecords(ctx, records))
+
+	byKey, err := database.AggregateUsage(ctx, models.UsageFilter{ByVirtualKey: true})
+	require.NoError(t, err)
+	require.Len(t, byKey, 2)
+	assert.Equal(t, models.UsageSummary{VirtualKeyID: "vk-a", Requests: 2, PromptTokens: 30, CompletionTokens: 10, AvgLatencyMs: 200}, byKey[0])
+	assert.Equal(t, "vk-b", byKey[1].VirtualKeyID)
+
+	byDay, err := database.AggregateUsage(ctx, models.UsageFilter{ByModel: true, ByDay: true, ProviderModelID: "pm-1"})
+	require.NoError(t, err)
+	require.Len(t, byDay, 2)
+	assert.Equal(t, "2026-03-01", byDay[0].Day)
+	assert.Equal(t, "2026-03-02", byDay[1].Day)
+
+	total, err := database.AggregateUsage(ctx, models.UsageFilter{From: day2})
+	require.NoError(t, err)
+	require.Len(t, total, 1)
+	assert.Equal(t, int64(1), total[0].Requests)
+	assert.Equal(t, int64(7), total[0].PromptTokens)
+}
+
+func TestSQLDB_UpdateVirtualKeySettings(t *testing.T) {
+	database := newSQLite(t)
+	ctx := context.Background()
+	vk := &models.VirtualKey{ID: models.NewID(), Name: "team", Key: "sk-team"}
+	require.NoError(t, database.SaveVirtualKey(ctx, vk))
+
+	// A record whose key could not be decrypted must not overwrite the stored one.
+	vk.Key = "garbled"
+	vk.BudgetAmount = 50
+	vk.BudgetPeriod = "daily"
+	vk.CacheTTLSeconds = 300
+	require.NoError(t, database.UpdateVirtualKeySettings(ctx, vk))
+
+	got, err := database.GetVirtualKey(ctx, "sk-team")
+	require.NoError(t, err)
+	assert.Equal(t, "sk-team", got.Key)
+	assert.Equal(t, 50.0, got.BudgetAmount)
+	assert.Equal(t, "daily", got.BudgetPeriod)
+	assert.Equal(t, int64(300), got.CacheTTLSeconds)
+
+	assert.Error(t, database.UpdateVirtualKeySettings(ctx, &models.VirtualKey{ID: "missing"}))
+}
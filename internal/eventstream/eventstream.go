@@ -0,0 +1,186 @@
+// Package eventstream reads and writes the AWS event-stream binary framing
+// (application/vnd.amazon.eventstream) used by Bedrock's streaming APIs.
+//
+// Each message is laid out as:
+//
+//	total length (4) | headers length (4) | prelude CRC (4) | headers | payload | message CRC (4)
+//
+// with big-endian integers and CRC32 (IEEE) checksums over everything that precedes them.
+package eventstream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	preludeLen = 12
+	crcLen     = 4
+	// maxMessageLen guards against corrupt length prefixes; AWS caps messages at 16 MiB.
+	maxMessageLen = 16 << 20
+)
+
+// Header value types defined by the format.
+const (
+	typeTrue = iota
+	typeFalse
+	typeByte
+	typeInt16
+	typeInt32
+	typeInt64
+	typeBytes
+	typeString
+	typeTimestamp
+	typeUUID
+)
+
+var ErrChecksum = errors.New("eventstream: checksum mismatch")
+
+// Message is one decoded event-stream message. String-valued headers, which carry everything
+// Bedrock sends (:event-type, :message-type, :exception-type, :content-type), are kept as
+// strings; other header types are decoded and kept with their Go type.
+type Message struct {
+	Headers map[string]interface{}
+	Payload []byte
+}
+
+// Header returns a string header, or "" if it is absent or not a string.
+func (m Message) Header(name string) string {
+	s, _ := m.Headers[name].(string)
+	return s
+}
+
+// Decoder reads messages from a stream.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode returns the next message. It returns io.EOF at a clean end of stream and
+// io.ErrUnexpectedEOF if the stream ends inside a message.
+func (d *Decoder) Decode() (Message, error) {
+	prelude := make([]byte, preludeLen)
+	if _, err := io.ReadFull(d.r, prelude); err != nil {
+		return Message{}, err
+	}
+	totalLen := binary.BigEndian.Uint32(prelude[0:4])
+	headersLen := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return Message{}, ErrChecksum
+	}
+	if totalLen < preludeLen+crcLen || totalLen > maxMessageLen || headersLen > totalLen-preludeLen-crcLen {
+		return Message{}, fmt.Errorf("eventstream: invalid message length %d (headers %d)", totalLen, headersLen)
+	}
+
+	buf := make([]byte, totalLen)
+	copy(buf, prelude)
+	if _, err := io.ReadFull(d.r, buf[preludeLen:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Message{}, err
+	}
+	if crc32.ChecksumIEEE(buf[:totalLen-crcLen]) != binary.BigEndian.Uint32(buf[totalLen-crcLen:]) {
+		return Message{}, ErrChecksum
+	}
+
+	headers, err := decodeHeaders(buf[preludeLen : preludeLen+headersLen])
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Headers: headers, Payload: buf[preludeLen+headersLen : totalLen-crcLen]}, nil
+}
+
+func decodeHeaders(b []byte) (map[string]interface{}, error) {
+	headers := map[string]interface{}{}
+	for len(b) > 0 {
+		nameLen := int(b[0])
+		if len(b) < 1+nameLen+1 {
+			return nil, errShortHeader
+		}
+		name := string(b[1 : 1+nameLen])
+		typ := b[1+nameLen]
+		b = b[2+nameLen:]
+
+		var value interface{}
+		var n int
+		switch typ {
+		case typeTrue:
+			value = true
+		case typeFalse:
+			value = false
+		case typeByte:
+			n = 1
+		case typeInt16:
+			n = 2
+		case typeInt32:
+			n = 4
+		case typeInt64, typeTimestamp:
+			n = 8
+		case typeUUID:
+			n = 16
+		case typeBytes, typeString:
+			if len(b) < 2 {
+				return nil, errShortHeader
+			}
+			n = 2 + int(binary.BigEndian.Uint16(b))
+		default:
+			return nil, fmt.Errorf("eventstream: unknown header type %d", typ)
+		}
+		if len(b) < n {
+			return nil, errShortHeader
+		}
+		switch typ {
+		case typeByte:
+			value = int8(b[0])
+		case typeInt16:
+			value = int16(binary.BigEndian.Uint16(b))
+		case typeInt32:
+			value = int32(binary.BigEndian.Uint32(b))
+		case typeInt64, typeTimestamp:
+			value = int64(binary.BigEndian.Uint64(b))
+		case typeUUID:
+			value = append([]byte(nil), b[:16]...)
+		case typeBytes:
+			value = append([]byte(nil), b[2:n]...)
+		case typeString:
+			value = string(b[2:n])
+		}
+		headers[name] = value
+		b = b[n:]
+	}
+	return headers, nil
+}
+
+var errShortHeader = errors.New("eventstream: truncated header")
+
+// Encode writes a message whose headers are all strings, which is what Bedrock emits. It exists
+// mainly to build fixtures for tests.
+func Encode(w io.Writer, headers map[string]string, payload []byte) error {
+	var hb []byte
+	for name, value := range headers {
+		hb = append(hb, byte(len(name)))
+		hb = append(hb, name...)
+		hb = append(hb, typeString)
+		hb = binary.BigEndian.AppendUint16(hb, uint16(len(value)))
+		hb = append(hb, value...)
+	}
+
+	total := preludeLen + len(hb) + len(payload) + crcLen
+	msg := make([]byte, 0, total)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(total))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(hb)))
+	msg = binary.BigEndian.AppendUint32(msg, crc32.ChecksumIEEE(msg))
+	msg = append(msg, hb...)
+	msg = append(msg, payload...)
+	msg = binary.BigEndian.AppendUint32(msg, crc32.ChecksumIEEE(msg))
+	_, err := w.Write(msg)
+	return err
+}
@@ -0,0 +1,71 @@
+package eventstream_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/eventstream"
+)
+
+func TestDecode_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, eventstream.Encode(&buf, map[string]string{":event-type": "chunk", ":message-type": "event"}, []byte(`{"bytes":"e30="}`)))
+	require.NoError(t, eventstream.Encode(&buf, map[string]string{":message-type": "event"}, nil))
+
+	d := eventstream.NewDecoder(&buf)
+	msg, err := d.Decode()
+	require.NoError(t, err)
+	assert.Equal(t, "chunk", msg.Header(":event-type"))
+	assert.Equal(t, `{"bytes":"e30="}`, string(msg.Payload))
+
+	msg, err = d.Decode()
+	require.NoError(t, err)
+	assert.Empty(t, msg.Payload)
+
+	_, err = d.Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDecode_NonStringHeaders(t *testing.T) {
+	// Header "n" of type int32 (4) with value 7, plus a true flag "t" (type 0).
+	headers := []byte{1, 'n', 4, 0, 0, 0, 7, 1, 't', 0}
+	payload := []byte("hi")
+	total := 12 + len(headers) + len(payload) + 4
+	msg := binary.BigEndian.AppendUint32(nil, uint32(total))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(headers)))
+	msg = binary.BigEndian.AppendUint32(msg, crc32.ChecksumIEEE(msg))
+	msg = append(msg, headers...)
+	msg = append(msg, payload...)
+	msg = binary.BigEndian.AppendUint32(msg, crc32.ChecksumIEEE(msg))
+
+	decoded, err := eventstream.NewDecoder(bytes.NewReader(msg)).Decode()
+	require.NoError(t, err)
+	assert.Equal(t, int32(7), decoded.Headers["n"])
+	assert.Equal(t, true, decoded.Headers["t"])
+	assert.Equal(t, "", decoded.Header("n"))
+	assert.Equal(t, "hi", string(decoded.Payload))
+}
+
+func TestDecode_DetectsCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, eventstream.Encode(&buf, map[string]string{":event-type": "chunk"}, []byte("payload")))
+	raw := buf.Bytes()
+
+	corrupt := append([]byte(nil), raw...)
+	corrupt[len(corrupt)-6] ^= 0xff
+	_, err := eventstream.NewDecoder(bytes.NewReader(corrupt)).Decode()
+	assert.ErrorIs(t, err, eventstream.ErrChecksum)
+
+	corrupt = append([]byte(nil), raw...)
+	corrupt[1] ^= 0xff
+	_, err = eventstream.NewDecoder(bytes.NewReader(corrupt)).Decode()
+	assert.ErrorIs(t, err, eventstream.ErrChecksum)
+
+	_, err = eventstream.NewDecoder(bytes.NewReader(raw[:len(raw)-3])).Decode()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
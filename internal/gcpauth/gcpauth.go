@@ -0,0 +1,177 @@
+// Package gcpauth mints OAuth access tokens for Google Cloud service accounts using the
+// JWT bearer grant (RFC 7523), as Vertex AI requires.
+package gcpauth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/credcache"
+)
+
+const (
+	// DefaultTokenURL is Google's OAuth token endpoint, used when neither the connection nor the
+	// key file names one.
+	DefaultTokenURL = "https://oauth2.googleapis.com/token"
+	// CloudPlatformScope grants access to Vertex AI.
+	CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	assertionLifetime = time.Hour
+)
+
+// ServiceAccount is the subset of a service-account key file needed to mint tokens.
+type ServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ProjectID    string `json:"project_id"`
+
+	key *rsa.PrivateKey
+}
+
+// ParseServiceAccount reads a service-account JSON key file.
+func ParseServiceAccount(data []byte) (*ServiceAccount, error) {
+	var sa ServiceAccount
+	if err := json.Unmarshal(data, &sa); err != nil {
+		return nil, fmt.Errorf("gcpauth: invalid service account JSON: %v", err)
+	}
+	if sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, errors.New("gcpauth: service account JSON lacks client_email or private_key")
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, errors.New("gcpauth: private_key is not PEM encoded")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("gcpauth: invalid private_key: %v", err)
+		}
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("gcpauth: private_key is not an RSA key")
+	}
+	sa.key = key
+	return &sa, nil
+}
+
+// Assertion returns a signed JWT asking tokenURL for a token with the given scope.
+func (sa *ServiceAccount) Assertion(tokenURL, scope string, now time.Time) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if sa.PrivateKeyID != "" {
+		header["kid"] = sa.PrivateKeyID
+	}
+	claims := map[string]interface{}{
+		"iss":   sa.ClientEmail,
+		"scope": scope,
+		"aud":   tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(assertionLifetime).Unix(),
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, sa.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Exchange trades a JWT assertion for an access token at tokenURL.
+func Exchange(ctx context.Context, client *http.Client, tokenURL, assertion string) (string, time.Time, error) {
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("gcpauth: token exchange failed: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", time.Time{}, fmt.Errorf("gcpauth: invalid token response: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", time.Time{}, errors.New("gcpauth: token response has no access_token")
+	}
+	return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+// TokenCache keeps one access token per service account and token URL, minting a new one
+// shortly before the current one expires.
+type TokenCache struct {
+	client *http.Client
+	tokens *credcache.Cache[string]
+}
+
+func NewTokenCache(client *http.Client) *TokenCache {
+	return &TokenCache{client: client, tokens: credcache.New[string]()}
+}
+
+// Token returns an access token for the service account in saJSON. tokenURL overrides the key
+// file's token_uri; both fall back to DefaultTokenURL.
+func (tc *TokenCache) Token(ctx context.Context, saJSON, tokenURL string) (string, error) {
+	sum := sha256.Sum256([]byte(saJSON))
+	key := hex.EncodeToString(sum[:]) + "|" + tokenURL
+	return tc.tokens.Get(key, func() (string, time.Time, error) {
+		sa, err := ParseServiceAccount([]byte(saJSON))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if tokenURL == "" {
+			tokenURL = sa.TokenURI
+		}
+		if tokenURL == "" {
+			tokenURL = DefaultTokenURL
+		}
+		assertion, err := sa.Assertion(tokenURL, CloudPlatformScope, time.Now())
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return Exchange(ctx, tc.client, tokenURL, assertion)
+	})
+}
@@ -0,0 +1,105 @@
+package gcpauth_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/gcpauth"
+)
+
+func serviceAccountJSON(t *testing.T, key *rsa.PrivateKey, tokenURI string) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	sa, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "proxy@project.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokenURI,
+	})
+	return string(sa)
+}
+
+// fakeTokenServer verifies the JWT assertion with the service account's public key and hands
+// out numbered tokens that live for expiresIn seconds.
+func fakeTokenServer(t *testing.T, pub *rsa.PublicKey, expiresIn int) (*httptest.Server, *int) {
+	calls := new(int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		require.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.Form.Get("grant_type"))
+
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		require.Len(t, parts, 3)
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		require.NoError(t, err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		assert.NoError(t, rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig))
+
+		var claims map[string]interface{}
+		raw, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, json.Unmarshal(raw, &claims))
+		assert.Equal(t, "proxy@project.iam.gserviceaccount.com", claims["iss"])
+		assert.Equal(t, gcpauth.CloudPlatformScope, claims["scope"])
+		assert.Equal(t, "http://"+r.Host+r.URL.Path, claims["aud"])
+
+		fmt.Fprintf(w, `{"access_token":"ya29.token-%d","expires_in":%d,"token_type":"Bearer"}`, *calls, expiresIn)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, calls
+}
+
+func TestTokenCache_MintsAndCaches(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	srv, calls := fakeTokenServer(t, &key.PublicKey, 3600)
+
+	cache := gcpauth.NewTokenCache(srv.Client())
+	sa := serviceAccountJSON(t, key, "https://oauth2.googleapis.com/token")
+	for i := 0; i < 3; i++ {
+		// The configured URL wins over the key file's token_uri.
+		token, err := cache.Token(context.Background(), sa, srv.URL+"/token")
+		require.NoError(t, err)
+		assert.Equal(t, "ya29.token-1", token)
+	}
+	assert.Equal(t, 1, *calls)
+}
+
+func TestTokenCache_RefreshesBeforeExpiry(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	// Tokens that expire within the refresh margin are replaced on every use.
+	srv, calls := fakeTokenServer(t, &key.PublicKey, 60)
+
+	cache := gcpauth.NewTokenCache(srv.Client())
+	sa := serviceAccountJSON(t, key, srv.URL+"/token")
+	first, err := cache.Token(context.Background(), sa, "")
+	require.NoError(t, err)
+	second, err := cache.Token(context.Background(), sa, "")
+	require.NoError(t, err)
+	assert.Equal(t, "ya29.token-1", first)
+	assert.Equal(t, "ya29.token-2", second)
+	assert.Equal(t, 2, *calls)
+}
+
+func TestParseServiceAccount_Rejects(t *testing.T) {
+	_, err := gcpauth.ParseServiceAccount([]byte(`{"client_email":"a@b"}`))
+	assert.Error(t, err)
+	_, err = gcpauth.ParseServiceAccount([]byte(`{"client_email":"a@b","private_key":"not pem"}`))
+	assert.Error(t, err)
+}
@@ -7,32 +7,65 @@ import (
 )
 
 type Connection struct {
-	ID        string    `gorm:"primaryKey" bson:"_id" json:"id"`
-	Name      string    `gorm:"uniqueIndex" bson:"name" json:"name"`
-	Provider  string    `bson:"provider" json:"provider"` // e.g., openai, azure, google
-	Endpoint  string    `bson:"endpoint" json:"endpoint"`
-	APIKey    string    `bson:"api_key" json:"api_key"`
+	ID       string `gorm:"primaryKey" bson:"_id" json:"id"`
+	Name     string `gorm:"uniqueIndex" bson:"name" json:"name"`
+	Provider string `bson:"provider" json:"provider"` // e.g., openai, azure, google
+	Endpoint string `bson:"endpoint" json:"endpoint"`
+	APIKey   string `bson:"api_key" json:"api_key"`
+
+	// IAM credentials for AWS connections. When set, requests are SigV4-signed instead of
+	// sending APIKey as a Bedrock API key.
+	AWSAccessKeyID     string `bson:"aws_access_key_id" json:"aws_access_key_id"`
+	AWSSecretAccessKey string `bson:"aws_secret_access_key" json:"aws_secret_access_key"` // Encrypted
+	AWSSessionToken    string `bson:"aws_session_token" json:"aws_session_token"`         // Encrypted
+	AWSRegion          string `bson:"aws_region" json:"aws_region"`                       // Taken from the endpoint host if empty
+	AWSRoleARN         string `bson:"aws_role_arn" json:"aws_role_arn"`                   // Assumed with the keys above if set
+
+	// Service-account key file for google connections. When set, the proxy mints OAuth access
+	// tokens for Vertex AI instead of sending APIKey.
+	GCPServiceAccountJSON string `bson:"gcp_service_account_json" json:"gcp_service_account_json"` // Encrypted
+	GCPTokenURL           string `bson:"gcp_token_url" json:"gcp_token_url"`                       // Key file's token_uri if empty
+
+	AzureAPIVersion string `bson:"azure_api_version" json:"azure_api_version"` // api-version for azure connections; a recent preview if empty
+
+	// Entra ID service principal for azure connections. When set, requests carry an OAuth token
+	// from the client credentials grant instead of APIKey.
+	AzureTenantID     string `bson:"azure_tenant_id" json:"azure_tenant_id"`
+	AzureClientID     string `bson:"azure_client_id" json:"azure_client_id"`
+	AzureClientSecret string `bson:"azure_client_secret" json:"azure_client_secret"` // Encrypted
+	AzureAuthorityURL string `bson:"azure_authority_url" json:"azure_authority_url"` // https://login.microsoftonline.com if empty
+
 	CreatedAt time.Time `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
 }
 
 type ProviderModel struct {
-	ID             string    `gorm:"primaryKey" bson:"_id" json:"id"`
-	ConnectionID   string    `gorm:"index" bson:"connection_id" json:"connection_id"`
-	Name           string    `bson:"name" json:"name"`                       // Name used by provider or general identifier
-	RemoteModel    string    `bson:"remote_model" json:"remote_model"`       // Internal model ID
-	DeploymentName string    `bson:"deployment_name" json:"deployment_name"` // For Azure
-	CreatedAt      time.Time `bson:"created_at" json:"created_at"`
-	UpdatedAt      time.Time `bson:"updated_at" json:"updated_at"`
+	ID               string    `gorm:"primaryKey" bson:"_id" json:"id"`
+	ConnectionID     string    `gorm:"index" bson:"connection_id" json:"connection_id"`
+	Name             string    `bson:"name" json:"name"`                             // Name used by provider or general identifier
+	RemoteModel      string    `bson:"remote_model" json:"remote_model"`             // Internal model ID
+	DeploymentName   string    `bson:"deployment_name" json:"deployment_name"`       // For Azure
+	APIMode          string    `bson:"api_mode" json:"api_mode"`                     // Provider API flavour, e.g. "converse" on aws, "native" on ollama
+	InputPrice       float64   `bson:"input_price" json:"input_price"`               // USD per 1M prompt tokens
+	OutputPrice      float64   `bson:"output_price" json:"output_price"`             // USD per 1M completion tokens
+	CachedInputPrice float64   `bson:"cached_input_price" json:"cached_input_price"` // USD per 1M cached prompt tokens; InputPrice if zero
+	FallbackModelID  string    `bson:"fallback_model_id" json:"fallback_model_id"`   // Tried when every deployment of the alias fails
+	CreatedAt        time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt        time.Time `bson:"updated_at" json:"updated_at"`
 }
 
 type VirtualKey struct {
-	ID        string    `gorm:"primaryKey" bson:"_id" json:"id"`
-	Name      string    `gorm:"uniqueIndex" bson:"name" json:"name"`
-	Key       string    `gorm:"index" bson:"key" json:"key"`          // Encrypted
-	KeyHash   string    `gorm:"uniqueIndex" bson:"key_hash" json:"-"` // SHA-256 hash for lookup
-	CreatedAt time.Time `bson:"created_at" json:"created_at"`
-	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	ID                string    `gorm:"primaryKey" bson:"_id" json:"id"`
+	Name              string    `gorm:"uniqueIndex" bson:"name" json:"name"`
+	Key               string    `gorm:"index" bson:"key" json:"key"`                    // Encrypted
+	KeyHash           string    `gorm:"uniqueIndex" bson:"key_hash" json:"-"`           // SHA-256 hash for lookup
+	BudgetAmount      float64   `bson:"budget_amount" json:"budget_amount"`             // USD per period; 0 means unlimited
+	BudgetPeriod      string    `bson:"budget_period" json:"budget_period"`             // daily, weekly or monthly
+	BudgetResetAt     time.Time `bson:"budget_reset_at" json:"budget_reset_at"`         // Anchor periods repeat from; zero for calendar periods
+	BudgetWarnPercent float64   `bson:"budget_warn_percent" json:"budget_warn_percent"` // Soft-warning threshold in percent; 0 disables
+	CacheTTLSeconds   int64     `bson:"cache_ttl_seconds" json:"cache_ttl_seconds"`     // Lifetime of cached deterministic responses; 0 disables the cache
+	CreatedAt         time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt         time.Time `bson:"updated_at" json:"updated_at"`
 }
 
 type VirtualKeyAssignment struct {
@@ -42,10 +75,62 @@ type VirtualKeyAssignment struct {
 	ModelAlias      string    `bson:"model_alias" json:"model_alias"` // The model name the user sends in request
 	RateLimitTPS    float64   `bson:"rate_limit_tps" json:"rate_limit_tps"`
 	RateLimitTokens int64     `bson:"rate_limit_tokens" json:"rate_limit_tokens"`
+	Weight          int       `bson:"weight" json:"weight"`     // Share of traffic when several assignments use the same alias; 0 counts as 1
+	Strategy        string    `bson:"strategy" json:"strategy"` // Load-balancing strategy of the alias pool (round-robin if empty)
 	CreatedAt       time.Time `bson:"created_at" json:"created_at"`
 	UpdatedAt       time.Time `bson:"updated_at" json:"updated_at"`
 }
 
+// CachedResponse is an upstream response kept by the database-backed response cache.
+type CachedResponse struct {
+	Hash        string    `gorm:"primaryKey" bson:"_id" json:"hash"` // Cache key of the request
+	ContentType string    `bson:"content_type" json:"content_type"`
+	Body        []byte    `bson:"body" json:"body"`
+	ExpiresAt   time.Time `gorm:"index" bson:"expires_at" json:"expires_at"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+}
+
+// UsageRecord is one proxied call as written to the usage ledger.
+type UsageRecord struct {
+	ID               string    `gorm:"primaryKey" bson:"_id" json:"id"`
+	VirtualKeyID     string    `gorm:"index" bson:"virtual_key_id" json:"virtual_key_id"`
+	ModelAlias       string    `bson:"model_alias" json:"model_alias"`
+	ProviderModelID  string    `gorm:"index" bson:"provider_model_id" json:"provider_model_id"`
+	ConnectionID     string    `gorm:"index" bson:"connection_id" json:"connection_id"`
+	PromptTokens     int64     `bson:"prompt_tokens" json:"prompt_tokens"`
+	CompletionTokens int64     `bson:"completion_tokens" json:"completion_tokens"`
+	CachedTokens     int64     `bson:"cached_tokens" json:"cached_tokens"`
+	CostUSD          float64   `bson:"cost_usd" json:"cost_usd"`
+	LatencyMs        int64     `bson:"latency_ms" json:"latency_ms"`
+	StatusCode       int       `bson:"status_code" json:"status_code"`
+	Day              string    `gorm:"index" bson:"day" json:"day"` // UTC date (YYYY-MM-DD), stored for portable per-day grouping
+	CreatedAt        time.Time `gorm:"index" bson:"created_at" json:"created_at"`
+}
+
+// UsageFilter selects and groups usage records for aggregation. Zero values match everything.
+type UsageFilter struct {
+	VirtualKeyID    string
+	ProviderModelID string
+	From            time.Time // Inclusive
+	To              time.Time // Exclusive
+
+	ByVirtualKey bool
+	ByModel      bool
+	ByDay        bool
+}
+
+// UsageSummary is one aggregated row. Grouping fields that were not requested are empty.
+type UsageSummary struct {
+	VirtualKeyID     string  `bson:"virtual_key_id" json:"virtual_key_id,omitempty"`
+	ProviderModelID  string  `bson:"provider_model_id" json:"provider_model_id,omitempty"`
+	Day              string  `bson:"day" json:"day,omitempty"`
+	Requests         int64   `bson:"requests" json:"requests"`
+	PromptTokens     int64   `bson:"prompt_tokens" json:"prompt_tokens"`
+	CompletionTokens int64   `bson:"completion_tokens" json:"completion_tokens"`
+	CostUSD          float64 `bson:"cost_usd" json:"cost_usd"`
+	AvgLatencyMs     float64 `bson:"avg_latency_ms" json:"avg_latency_ms"`
+}
+
 func NewID() string {
 	return uuid.New().String()
 }
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// Usage is the token consumption a provider reported for a single call.
+type Usage struct {
+	PromptTokens     int64 // Includes CachedPromptTokens
+	CompletionTokens int64
+	// CachedPromptTokens is the part of the prompt served from the provider's prompt cache.
+	CachedPromptTokens int64
+}
+
+// Total returns prompt plus completion tokens.
+func (u Usage) Total() int64 {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// UpstreamRequest describes the call that is about to be sent to a provider. Adapters mutate it
+// in RewriteRequest; the proxy turns it into an *http.Request afterwards.
+type UpstreamRequest struct {
+	Connection *models.Connection
+	Model      *models.ProviderModel
+	Alias      string // Model name the client asked for
+
+	BaseURL  string // Connection endpoint without trailing slash
+	Path     string // Request path without leading slash
+	RawQuery string
+	Body     map[string]interface{}
+
+	// Stream is set when the client asked for a streamed response.
+	Stream bool
+	// StripUsageChunk is set by adapters that requested a usage-only stream chunk the client did
+	// not ask for; the proxy reads it for accounting and does not forward it.
+	StripUsageChunk bool
+	// OpenAIResponse is set by adapters that speak a different protocol upstream and convert the
+	// provider's response back into the OpenAI shape the client expects.
+	OpenAIResponse bool
+	// EncodingFormat is set when an OpenAI embeddings request was translated to another
+	// protocol: "float" or "base64", as the client asked, so vectors are returned that way.
+	EncodingFormat string
+
+	// clientBody is the map Body started as, and edited the fields changed in it through
+	// SetField and DeleteField. Adapters that translate the body assign a new Body instead.
+	clientBody map[string]interface{}
+	edited     []string
+}
+
+// SetField sets a top-level field of the client's body. Unlike assigning to Body, the change is
+// patched into the bytes the client sent, so fields the proxy does not know about and the
+// formatting of numbers reach the provider exactly as sent.
+func (r *UpstreamRequest) SetField(key string, value interface{}) {
+	if r.Body == nil {
+		r.Body = map[string]interface{}{}
+	}
+	r.Body[key] = value
+	r.edited = append(r.edited, key)
+}
+
+// DeleteField removes a top-level field of the client's body, like SetField.
+func (r *UpstreamRequest) DeleteField(key string) {
+	delete(r.Body, key)
+	r.edited = append(r.edited, key)
+}
+
+// URL joins the endpoint, path and query, merging with any query already present on the endpoint.
+func (r *UpstreamRequest) URL() string {
+	u := r.BaseURL + "/" + r.Path
+	if r.RawQuery != "" {
+		if strings.Contains(u, "?") {
+			u += "&" + r.RawQuery
+		} else {
+			u += "?" + r.RawQuery
+		}
+	}
+	return u
+}
+
+// ProviderAdapter encapsulates everything that differs between LLM providers so HandleProxy
+// can stay provider-agnostic.
+type ProviderAdapter interface {
+	// RewriteRequest maps the client request onto the provider's path, query and body.
+	RewriteRequest(r *UpstreamRequest) error
+	// SetAuth attaches the connection credentials to the outgoing request.
+	SetAuth(req *http.Request, conn *models.Connection) error
+	// TransformResponse may adjust the upstream response before it is relayed to the client.
+	TransformResponse(resp *http.Response, r *UpstreamRequest) error
+	// ParseUsage extracts token usage from a response body or a single stream event payload.
+	ParseUsage(body []byte) (Usage, bool)
+}
+
+// HTTPClientProvider is implemented by adapters whose backends need different connection
+// handling than http.DefaultClient provides.
+type HTTPClientProvider interface {
+	HTTPClient() *http.Client
+}
+
+// ModelLister is implemented by adapters that can ask a backend which models it serves.
+type ModelLister interface {
+	ListModels(ctx context.Context, conn *models.Connection) ([]string, error)
+}
+
+// EmbeddingBatcher is implemented by adapters whose providers cap the number of inputs one
+// embeddings call may carry. Larger requests are split into batches and the results merged.
+type EmbeddingBatcher interface {
+	// MaxEmbeddingInputs returns the most inputs one call to pm may carry, or 0 for no limit.
+	MaxEmbeddingInputs(conn *models.Connection, pm *models.ProviderModel) int
+}
+
+var (
+	adaptersMu sync.RWMutex
+	adapters   = map[string]ProviderAdapter{}
+)
+
+// RegisterAdapter makes an adapter available for connections whose Provider equals name.
+// Registering the same name twice replaces the previous adapter.
+func RegisterAdapter(name string, a ProviderAdapter) {
+	adaptersMu.Lock()
+	defer adaptersMu.Unlock()
+	adapters[strings.ToLower(name)] = a
+}
+
+// LookupAdapter returns the adapter registered for provider, falling back to the OpenAI adapter
+// because most self-hosted and third-party endpoints speak the OpenAI protocol.
+func LookupAdapter(provider string) ProviderAdapter {
+	adaptersMu.RLock()
+	defer adaptersMu.RUnlock()
+	if a, ok := adapters[strings.ToLower(provider)]; ok {
+		return a
+	}
+	return adapters["openai"]
+}
+
+func init() {
+	RegisterAdapter("openai", &OpenAIAdapter{})
+	RegisterAdapter("azure", &AzureAdapter{})
+	RegisterAdapter("google", &GoogleAdapter{})
+	RegisterAdapter("aws", &AWSAdapter{})
+	RegisterAdapter("anthropic", &AnthropicAdapter{})
+	RegisterAdapter("ollama", &OllamaAdapter{})
+	RegisterAdapter("vllm", &VLLMAdapter{})
+	RegisterAdapter("llamacpp", &LlamaCppAdapter{})
+	RegisterAdapter("llama.cpp", &LlamaCppAdapter{})
+}
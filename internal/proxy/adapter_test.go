@@ -0,0 +1,671 @@
+package proxy_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/azureauth"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/gcpauth"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/proxy"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/tokencount"
+)
+
+func newUpstreamRequest(provider, endpoint, path, query string, body map[string]interface{}) *proxy.UpstreamRequest {
+	return &proxy.UpstreamRequest{
+		Connection: &models.Connection{Provider: provider, Endpoint: endpoint, APIKey: "secret"},
+		Model:      &models.ProviderModel{Name: "alias", RemoteModel: "remote-model"},
+		Alias:      "alias",
+		BaseURL:    endpoint,
+		Path:       path,
+		RawQuery:   query,
+		Body:       body,
+	}
+}
+
+func TestLookupAdapter(t *testing.T) {
+	assert.IsType(t, &proxy.AzureAdapter{}, proxy.LookupAdapter("azure"))
+	assert.IsType(t, &proxy.GoogleAdapter{}, proxy.LookupAdapter("Google"))
+	assert.IsType(t, &proxy.AnthropicAdapter{}, proxy.LookupAdapter("anthropic"))
+	assert.IsType(t, &proxy.AWSAdapter{}, proxy.LookupAdapter("aws"))
+	// Unknown providers are assumed to be OpenAI-compatible.
+	assert.IsType(t, &proxy.OpenAIAdapter{}, proxy.LookupAdapter("some-new-provider"))
+}
+
+func TestOpenAIAdapter(t *testing.T) {
+	a := proxy.LookupAdapter("openai")
+	r := newUpstreamRequest("openai", "https://api.openai.com", "v1/chat/completions", "", map[string]interface{}{"model": "remote-model"})
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "https://api.openai.com/v1/chat/completions", r.URL())
+
+	req, _ := http.NewRequest(http.MethodPost, r.URL(), nil)
+	require.NoError(t, a.SetAuth(req, r.Connection))
+	assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+
+	u, ok := a.ParseUsage([]byte(`{"usage":{"prompt_tokens":12,"completion_tokens":30,"total_tokens":42}}`))
+	assert.True(t, ok)
+	assert.Equal(t, proxy.Usage{PromptTokens: 12, CompletionTokens: 30}, u)
+
+	_, ok = a.ParseUsage([]byte(`{"choices":[]}`))
+	assert.False(t, ok)
+}
+
+func TestAzureAdapter(t *testing.T) {
+	a := proxy.LookupAdapter("azure")
+	r := newUpstreamRequest("azure", "https://res.services.ai.azure.com", "v1/chat/completions", "", nil)
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "https://res.services.ai.azure.com/models/chat/completions?api-version=2024-05-01-preview", r.URL())
+
+	// An explicit api-version from the client wins.
+	r = newUpstreamRequest("azure", "https://res.services.ai.azure.com", "v1/chat/completions", "api-version=2025-01-01", nil)
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "api-version=2025-01-01", r.RawQuery)
+
+	// Models with a deployment use classic Azure OpenAI routing and the connection's api-version.
+	r = newUpstreamRequest("azure", "https://res.openai.azure.com", "v1/embeddings", "", nil)
+	r.Model.DeploymentName = "text-embedding-3-small"
+	r.Connection.AzureAPIVersion = "2024-10-21"
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "https://res.openai.azure.com/openai/deployments/text-embedding-3-small/embeddings?api-version=2024-10-21", r.URL())
+
+	r = newUpstreamRequest("azure", "https://res.openai.azure.com/openai", "chat/completions", "", nil)
+	r.Model.DeploymentName = "gpt-4o"
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "https://res.openai.azure.com/openai/deployments/gpt-4o/chat/completions?api-version=2024-05-01-preview", r.URL())
+
+	req, _ := http.NewRequest(http.MethodPost, r.URL(), nil)
+	require.NoError(t, a.SetAuth(req, r.Connection))
+	assert.Equal(t, "secret", req.Header.Get("api-key"))
+
+	// Streams ask for usage unless the api-version predates stream_options.
+	r = newUpstreamRequest("azure", "https://res.services.ai.azure.com", "v1/chat/completions", "", map[string]interface{}{"stream": true})
+	r.Stream = true
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, map[string]interface{}{"include_usage": true}, r.Body["stream_options"])
+	assert.True(t, r.StripUsageChunk)
+
+	r = newUpstreamRequest("azure", "https://res.services.ai.azure.com", "v1/chat/completions", "api-version=2024-02-01", map[string]interface{}{"stream": true})
+	r.Stream = true
+	require.NoError(t, a.RewriteRequest(r))
+	assert.NotContains(t, r.Body, "stream_options")
+}
+
+func TestAzureAdapter_UsesEntraIDToken(t *testing.T) {
+	calls := 0
+	authority := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, "/tenant/oauth2/v2.0/token", r.URL.Path)
+		w.Write([]byte(`{"access_token":"entra-token","expires_in":3600}`))
+	}))
+	defer authority.Close()
+
+	a := &proxy.AzureAdapter{Tokens: azureauth.NewTokenCache(authority.Client())}
+	conn := &models.Connection{
+		Provider:          "azure",
+		AzureTenantID:     "tenant",
+		AzureClientID:     "client",
+		AzureClientSecret: "secret",
+		AzureAuthorityURL: authority.URL,
+	}
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, "https://res.openai.azure.com/openai/deployments/gpt-4o/chat/completions", nil)
+		req.Header.Set("api-key", "client-key")
+		require.NoError(t, a.SetAuth(req, conn))
+		assert.Equal(t, "Bearer entra-token", req.Header.Get("Authorization"))
+		assert.Empty(t, req.Header.Get("api-key"))
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestGoogleAdapter(t *testing.T) {
+	a := proxy.LookupAdapter("google")
+	r := newUpstreamRequest("google", "https://generativelanguage.googleapis.com", "v1beta/publishers/google/models/remote-model:generateContent", "key=client&alt=sse", nil)
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "v1beta/models/remote-model:generateContent", r.Path)
+	assert.Equal(t, "alt=sse&key=secret", r.RawQuery)
+
+	r = newUpstreamRequest("google", "https://generativelanguage.googleapis.com/v1beta/openai", "v1/chat/completions", "", nil)
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "chat/completions", r.Path)
+
+	req, _ := http.NewRequest(http.MethodPost, r.URL(), nil)
+	require.NoError(t, a.SetAuth(req, r.Connection))
+	assert.Equal(t, "secret", req.Header.Get("x-goog-api-key"))
+	assert.Empty(t, req.Header.Get("Authorization"))
+
+	u, ok := a.ParseUsage([]byte(`{"usageMetadata":{"promptTokenCount":5,"candidatesTokenCount":7,"totalTokenCount":12}}`))
+	assert.True(t, ok)
+	assert.Equal(t, proxy.Usage{PromptTokens: 5, CompletionTokens: 7}, u)
+}
+
+func TestGoogleAdapter_MintsServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	saJSON, _ := json.Marshal(map[string]string{
+		"client_email": "proxy@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+
+	calls := 0
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"access_token":"ya29.minted","expires_in":3600}`))
+	}))
+	defer tokenSrv.Close()
+
+	a := &proxy.GoogleAdapter{Tokens: gcpauth.NewTokenCache(tokenSrv.Client())}
+	r := newUpstreamRequest("google", "https://us-central1-aiplatform.googleapis.com/v1/projects/p/locations/us-central1", "v1/chat/completions", "key=client", nil)
+	r.Connection.GCPServiceAccountJSON = string(saJSON)
+	r.Connection.GCPTokenURL = tokenSrv.URL
+	require.NoError(t, a.RewriteRequest(r))
+	assert.NotContains(t, r.RawQuery, "key=")
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, r.URL(), nil)
+		req.Header.Set("x-goog-api-key", "client")
+		require.NoError(t, a.SetAuth(req, r.Connection))
+		assert.Equal(t, "Bearer ya29.minted", req.Header.Get("Authorization"))
+		assert.Empty(t, req.Header.Get("x-goog-api-key"))
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestAWSAdapter(t *testing.T) {
+	a := proxy.LookupAdapter("aws")
+	r := newUpstreamRequest("aws", "https://bedrock-runtime.us-east-1.amazonaws.com", "v1/chat/completions", "", map[string]interface{}{"model": "remote-model"})
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "model/remote-model/invoke", r.Path)
+	assert.NotContains(t, r.Body, "model")
+	assert.Equal(t, 4096, r.Body["max_tokens"])
+	assert.Equal(t, "bedrock-2023-05-31", r.Body["anthropic_version"])
+
+	u, ok := a.ParseUsage([]byte(`{"usage":{"input_tokens":3,"output_tokens":9}}`))
+	assert.True(t, ok)
+	assert.Equal(t, proxy.Usage{PromptTokens: 3, CompletionTokens: 9}, u)
+}
+
+func TestAWSAdapter_SignsWithIAMCredentials(t *testing.T) {
+	a := proxy.LookupAdapter("aws")
+	conn := &models.Connection{
+		Provider:           "aws",
+		Endpoint:           "https://bedrock-runtime.eu-west-1.amazonaws.com",
+		AWSAccessKeyID:     "AKIDEXAMPLE",
+		AWSSecretAccessKey: "secret",
+		AWSSessionToken:    "token",
+	}
+	req, _ := http.NewRequest(http.MethodPost, conn.Endpoint+"/model/anthropic.claude-3-haiku-20240307-v1:0/invoke", strings.NewReader(`{}`))
+	req.Header.Set("X-Amz-Security-Token", "client-token")
+	require.NoError(t, a.SetAuth(req, conn))
+
+	auth := req.Header.Get("Authorization")
+	assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"), auth)
+	assert.Contains(t, auth, "/eu-west-1/bedrock/aws4_request")
+	assert.Equal(t, "token", req.Header.Get("X-Amz-Security-Token"))
+
+	// Without IAM credentials the API key is sent as a Bedrock API key.
+	req, _ = http.NewRequest(http.MethodPost, conn.Endpoint+"/model/m/invoke", nil)
+	require.NoError(t, a.SetAuth(req, &models.Connection{Provider: "aws", APIKey: "secret"}))
+	assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+}
+
+func TestAWSAdapter_TranslatesOpenAIChatRequest(t *testing.T) {
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "remote-model",
+		"max_completion_tokens": 512,
+		"stop": "END",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": [
+				{"type": "text", "text": "What is this?"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}}
+			]},
+			{"role": "assistant", "content": null, "tool_calls": [
+				{"id": "call_1", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":\"png\"}"}}
+			]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "a logo"},
+			{"role": "user", "content": "Thanks"}
+		],
+		"tools": [{"type": "function", "function": {"name": "lookup", "description": "Search", "parameters": {"type": "object"}}}],
+		"tool_choice": "required"
+	}`), &body))
+
+	a := proxy.LookupAdapter("aws")
+	r := newUpstreamRequest("aws", "https://bedrock-runtime.us-east-1.amazonaws.com", "v1/chat/completions", "", body)
+	require.NoError(t, a.RewriteRequest(r))
+	assert.True(t, r.OpenAIResponse)
+
+	got, _ := json.Marshal(r.Body)
+	assert.JSONEq(t, `{
+		"anthropic_version": "bedrock-2023-05-31",
+		"max_tokens": 512,
+		"stop_sequences": ["END"],
+		"system": "Be brief.",
+		"messages": [
+			{"role": "user", "content": [
+				{"type": "text", "text": "What is this?"},
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBORw0KGgo="}}
+			]},
+			{"role": "assistant", "content": [
+				{"type": "tool_use", "id": "call_1", "name": "lookup", "input": {"q": "png"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "call_1", "content": "a logo"},
+				{"type": "text", "text": "Thanks"}
+			]}
+		],
+		"tools": [{"name": "lookup", "description": "Search", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any"}
+	}`, string(got))
+
+	// Remote image URLs cannot be inlined and are rejected.
+	require.NoError(t, json.Unmarshal([]byte(`{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]}]}`), &body))
+	r = newUpstreamRequest("aws", "https://bedrock-runtime.us-east-1.amazonaws.com", "v1/chat/completions", "", body)
+	assert.Error(t, a.RewriteRequest(r))
+}
+
+func TestAWSAdapter_TranslatesAnthropicResponse(t *testing.T) {
+	a := proxy.LookupAdapter("aws")
+	r := newUpstreamRequest("aws", "https://bedrock-runtime.us-east-1.amazonaws.com", "v1/chat/completions", "", map[string]interface{}{})
+	require.NoError(t, a.RewriteRequest(r))
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body: io.NopCloser(strings.NewReader(`{"id":"msg_1","type":"message","role":"assistant","content":[
+			{"type":"text","text":"Let me check."},
+			{"type":"tool_use","id":"toolu_1","name":"lookup","input":{"q":"png"}}
+		],"stop_reason":"tool_use","usage":{"input_tokens":10,"output_tokens":5,"cache_read_input_tokens":4}}`)),
+	}
+	require.NoError(t, a.TransformResponse(resp, r))
+	body, _ := io.ReadAll(resp.Body)
+
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &out))
+	delete(out, "created")
+	got, _ := json.Marshal(out)
+	assert.JSONEq(t, `{
+		"id": "msg_1",
+		"object": "chat.completion",
+		"model": "alias",
+		"choices": [{"index": 0, "finish_reason": "tool_calls", "message": {
+			"role": "assistant",
+			"content": "Let me check.",
+			"tool_calls": [{"id": "toolu_1", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":\"png\"}"}}]
+		}}],
+		"usage": {"prompt_tokens": 14, "completion_tokens": 5, "total_tokens": 19, "prompt_tokens_details": {"cached_tokens": 4}}
+	}`, string(got))
+
+	u, ok := a.ParseUsage(body)
+	assert.True(t, ok)
+	assert.Equal(t, proxy.Usage{PromptTokens: 14, CompletionTokens: 5, CachedPromptTokens: 4}, u)
+
+	// Provider errors come back in OpenAI's error shape.
+	resp = &http.Response{
+		StatusCode: http.StatusBadRequest,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"message":"messages: field required"}`)),
+	}
+	require.NoError(t, a.TransformResponse(resp, r))
+	body, _ = io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"error":{"message":"messages: field required","type":"upstream_error","code":400}}`, string(body))
+}
+
+func TestAWSAdapter_ConverseMode(t *testing.T) {
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "remote-model",
+		"max_tokens": 256,
+		"temperature": 0.2,
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Weather in Paris?"}
+		],
+		"tools": [{"type": "function", "function": {"name": "weather", "parameters": {"type": "object"}}}],
+		"tool_choice": {"type": "function", "function": {"name": "weather"}}
+	}`), &body))
+
+	a := proxy.LookupAdapter("aws")
+	r := newUpstreamRequest("aws", "https://bedrock-runtime.us-east-1.amazonaws.com", "v1/chat/completions", "", body)
+	r.Model.RemoteModel = "meta.llama3-70b-instruct-v1:0"
+	r.Model.APIMode = proxy.APIModeConverse
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "model/meta.llama3-70b-instruct-v1:0/converse", r.Path)
+
+	got, _ := json.Marshal(r.Body)
+	assert.JSONEq(t, `{
+		"system": [{"text": "Be brief."}],
+		"messages": [{"role": "user", "content": [{"text": "Weather in Paris?"}]}],
+		"inferenceConfig": {"maxTokens": 256, "temperature": 0.2},
+		"toolConfig": {
+			"tools": [{"toolSpec": {"name": "weather", "inputSchema": {"json": {"type": "object"}}}}],
+			"toolChoice": {"tool": {"name": "weather"}}
+		}
+	}`, string(got))
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body: io.NopCloser(strings.NewReader(`{"output":{"message":{"role":"assistant","content":[
+			{"toolUse":{"toolUseId":"t1","name":"weather","input":{"city":"Paris"}}}
+		]}},"stopReason":"tool_use","usage":{"inputTokens":20,"outputTokens":8,"totalTokens":28}}`)),
+	}
+	require.NoError(t, a.TransformResponse(resp, r))
+	out, _ := io.ReadAll(resp.Body)
+	var completion struct {
+		Choices []struct {
+			FinishReason string `json:"finish_reason"`
+			Message      struct {
+				ToolCalls []struct {
+					ID       string `json:"id"`
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	require.NoError(t, json.Unmarshal(out, &completion))
+	require.Len(t, completion.Choices, 1)
+	assert.Equal(t, "tool_calls", completion.Choices[0].FinishReason)
+	require.Len(t, completion.Choices[0].Message.ToolCalls, 1)
+	assert.Equal(t, "t1", completion.Choices[0].Message.ToolCalls[0].ID)
+	assert.JSONEq(t, `{"city":"Paris"}`, completion.Choices[0].Message.ToolCalls[0].Function.Arguments)
+
+	u, ok := a.ParseUsage(out)
+	assert.True(t, ok)
+	assert.Equal(t, proxy.Usage{PromptTokens: 20, CompletionTokens: 8}, u)
+
+	// Usage in native Converse responses is read as well.
+	u, ok = a.ParseUsage([]byte(`{"usage":{"inputTokens":3,"outputTokens":4}}`))
+	assert.True(t, ok)
+	assert.Equal(t, proxy.Usage{PromptTokens: 3, CompletionTokens: 4}, u)
+}
+
+func TestAWSAdapter_ConverseModeOmitsToolsForToolChoiceNone(t *testing.T) {
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "remote-model",
+		"max_tokens": 256,
+		"messages": [{"role": "user", "content": "Weather in Paris?"}],
+		"tools": [{"type": "function", "function": {"name": "weather", "parameters": {"type": "object"}}}],
+		"tool_choice": "none"
+	}`), &body))
+
+	a := proxy.LookupAdapter("aws")
+	r := newUpstreamRequest("aws", "https://bedrock-runtime.us-east-1.amazonaws.com", "v1/chat/completions", "", body)
+	r.Model.RemoteModel = "meta.llama3-70b-instruct-v1:0"
+	r.Model.APIMode = proxy.APIModeConverse
+	require.NoError(t, a.RewriteRequest(r))
+
+	got, _ := json.Marshal(r.Body)
+	assert.JSONEq(t, `{
+		"messages": [{"role": "user", "content": [{"text": "Weather in Paris?"}]}],
+		"inferenceConfig": {"maxTokens": 256}
+	}`, string(got))
+}
+
+func TestGoogleAdapter_TranslatesOpenAIChatRequest(t *testing.T) {
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "remote-model",
+		"max_tokens": 100,
+		"temperature": 0.5,
+		"stop": ["END"],
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": [
+				{"type": "text", "text": "Describe"},
+				{"type": "image_url", "image_url": {"url": "data:image/jpeg;base64,/9j/4AA="}}
+			]},
+			{"role": "assistant", "tool_calls": [{"id": "call_0", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":1}"}}]},
+			{"role": "tool", "tool_call_id": "call_0", "content": "not json"}
+		],
+		"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object", "additionalProperties": false}}}],
+		"tool_choice": "auto"
+	}`), &body))
+
+	a := proxy.LookupAdapter("google")
+	r := newUpstreamRequest("google", "https://generativelanguage.googleapis.com", "v1/chat/completions", "", body)
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "v1beta/models/remote-model:generateContent", r.Path)
+	assert.True(t, r.OpenAIResponse)
+
+	got, _ := json.Marshal(r.Body)
+	assert.JSONEq(t, `{
+		"systemInstruction": {"parts": [{"text": "Be brief."}]},
+		"contents": [
+			{"role": "user", "parts": [{"text": "Describe"}, {"inlineData": {"mimeType": "image/jpeg", "data": "/9j/4AA="}}]},
+			{"role": "model", "parts": [{"functionCall": {"name": "lookup", "args": {"q": 1}}}]},
+			{"role": "user", "parts": [{"functionResponse": {"name": "lookup", "response": {"content": "not json"}}}]}
+		],
+		"generationConfig": {"maxOutputTokens": 100, "temperature": 0.5, "stopSequences": ["END"]},
+		"tools": [{"functionDeclarations": [{"name": "lookup", "parameters": {"type": "object"}}]}],
+		"toolConfig": {"functionCallingConfig": {"mode": "AUTO"}}
+	}`, string(got))
+
+	// Streaming requests go to streamGenerateContent with SSE framing.
+	r = newUpstreamRequest("google", "https://us-central1-aiplatform.googleapis.com/v1/projects/p/locations/us-central1", "v1/chat/completions", "",
+		map[string]interface{}{"messages": []interface{}{}})
+	r.Stream = true
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "publishers/google/models/remote-model:streamGenerateContent", r.Path)
+	assert.Equal(t, "alt=sse&key=secret", r.RawQuery)
+
+	// Without a project and location there is no Vertex URL to call.
+	r = newUpstreamRequest("google", "https://us-central1-aiplatform.googleapis.com", "v1/chat/completions", "", map[string]interface{}{})
+	assert.Error(t, a.RewriteRequest(r))
+}
+
+func TestGoogleAdapter_TranslatesEmbeddings(t *testing.T) {
+	a := proxy.LookupAdapter("google")
+	r := newUpstreamRequest("google", "https://generativelanguage.googleapis.com", "v1/embeddings", "",
+		map[string]interface{}{"model": "remote-model", "input": []interface{}{"hello", "world"}, "dimensions": 2, "encoding_format": "base64"})
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "v1beta/models/remote-model:batchEmbedContents", r.Path)
+	got, _ := json.Marshal(r.Body)
+	assert.JSONEq(t, `{"requests": [
+		{"model": "models/remote-model", "content": {"parts": [{"text": "hello"}]}, "outputDimensionality": 2},
+		{"model": "models/remote-model", "content": {"parts": [{"text": "world"}]}, "outputDimensionality": 2}
+	]}`, string(got))
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"embeddings":[{"values":[1,0]},{"values":[0,-2]}]}`)),
+	}
+	require.NoError(t, a.TransformResponse(resp, r))
+	out, _ := io.ReadAll(resp.Body)
+	// Vectors come back as base64 little-endian float32, as the client asked; the Gemini API
+	// reports no usage, so the inputs are counted.
+	counter := tokencount.ForModel("remote-model")
+	tokens := counter.Count("hello") + counter.Count("world")
+	assert.JSONEq(t, fmt.Sprintf(`{"object": "list", "model": "alias", "data": [
+		{"object": "embedding", "index": 0, "embedding": "AACAPwAAAAA="},
+		{"object": "embedding", "index": 1, "embedding": "AAAAAAAAAMA="}
+	], "usage": {"prompt_tokens": %d, "total_tokens": %d}}`, tokens, tokens), string(out))
+
+	// Vertex serves embedding models through predict and counts tokens itself.
+	r = newUpstreamRequest("google", "https://us-central1-aiplatform.googleapis.com/v1/projects/p/locations/us-central1", "v1/embeddings", "",
+		map[string]interface{}{"input": "hello"})
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "publishers/google/models/remote-model:predict", r.Path)
+	got, _ = json.Marshal(r.Body)
+	assert.JSONEq(t, `{"instances": [{"content": "hello"}]}`, string(got))
+	resp = &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"predictions":[{"embeddings":{"values":[0.5],"statistics":{"token_count":3,"truncated":false}}}]}`)),
+	}
+	require.NoError(t, a.TransformResponse(resp, r))
+	out, _ = io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"object": "list", "model": "alias", "data": [{"object": "embedding", "index": 0, "embedding": [0.5]}],
+		"usage": {"prompt_tokens": 3, "total_tokens": 3}}`, string(out))
+
+	// Token arrays cannot be embedded by Gemini.
+	r = newUpstreamRequest("google", "https://generativelanguage.googleapis.com", "v1/embeddings", "",
+		map[string]interface{}{"input": []interface{}{1.0, 2.0}})
+	assert.Error(t, a.RewriteRequest(r))
+}
+
+func TestAWSAdapter_TranslatesEmbeddings(t *testing.T) {
+	a := proxy.LookupAdapter("aws")
+	r := newUpstreamRequest("aws", "https://bedrock-runtime.us-east-1.amazonaws.com", "v1/embeddings", "",
+		map[string]interface{}{"model": "remote-model", "input": []interface{}{"a", "b"}, "input_type": "search_query"})
+	r.Model.RemoteModel = "cohere.embed-english-v3"
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "model/cohere.embed-english-v3/invoke", r.Path)
+	got, _ := json.Marshal(r.Body)
+	assert.JSONEq(t, `{"texts": ["a", "b"], "input_type": "search_query"}`, string(got))
+
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}, "X-Amzn-Bedrock-Input-Token-Count": {"7"}},
+		Body:       io.NopCloser(strings.NewReader(`{"id":"x","response_type":"embeddings_floats","embeddings":[[0.1],[0.2]],"texts":["a","b"]}`)),
+	}
+	require.NoError(t, a.TransformResponse(resp, r))
+	out, _ := io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"object": "list", "model": "alias", "data": [
+		{"object": "embedding", "index": 0, "embedding": [0.1]},
+		{"object": "embedding", "index": 1, "embedding": [0.2]}
+	], "usage": {"prompt_tokens": 7, "total_tokens": 7}}`, string(out))
+	u, ok := a.ParseUsage(out)
+	assert.True(t, ok)
+	assert.Equal(t, proxy.Usage{PromptTokens: 7}, u)
+
+	// Titan embeds a single input per call.
+	r = newUpstreamRequest("aws", "https://bedrock-runtime.us-east-1.amazonaws.com", "v1/embeddings", "",
+		map[string]interface{}{"input": "a", "dimensions": 256})
+	r.Model.RemoteModel = "amazon.titan-embed-text-v2:0"
+	require.NoError(t, a.RewriteRequest(r))
+	got, _ = json.Marshal(r.Body)
+	assert.JSONEq(t, `{"inputText": "a", "dimensions": 256}`, string(got))
+	assert.Equal(t, 1, a.(proxy.EmbeddingBatcher).MaxEmbeddingInputs(r.Connection, r.Model))
+
+	r = newUpstreamRequest("aws", "https://bedrock-runtime.us-east-1.amazonaws.com", "v1/embeddings", "",
+		map[string]interface{}{"input": "a"})
+	assert.Error(t, a.RewriteRequest(r), "only Titan and Cohere embedding models are known")
+}
+
+func TestOllamaAdapter_TranslatesOpenAIChatRequest(t *testing.T) {
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"model": "llama3.1:8b",
+		"max_tokens": 100,
+		"temperature": 0.5,
+		"stop": "END",
+		"response_format": {"type": "json_object"},
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": [
+				{"type": "text", "text": "Describe"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0="}}
+			]},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_0", "type": "function", "function": {"name": "lookup", "arguments": "{\"q\":1}"}}]},
+			{"role": "tool", "tool_call_id": "call_0", "content": "42"}
+		],
+		"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object"}}}]
+	}`), &body))
+
+	a := proxy.LookupAdapter("ollama")
+	r := newUpstreamRequest("ollama", "http://gpu-1:11434/v1", "v1/chat/completions", "", body)
+	r.Model.APIMode = proxy.APIModeNative
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "http://gpu-1:11434/api/chat", r.URL())
+	assert.True(t, r.OpenAIResponse)
+
+	got, _ := json.Marshal(r.Body)
+	assert.JSONEq(t, `{
+		"model": "remote-model",
+		"stream": false,
+		"format": "json",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Describe", "images": ["iVBORw0="]},
+			{"role": "assistant", "content": "", "tool_calls": [{"function": {"name": "lookup", "arguments": {"q": 1}}}]},
+			{"role": "tool", "content": "42", "tool_name": "lookup"}
+		],
+		"tools": [{"type": "function", "function": {"name": "lookup", "parameters": {"type": "object"}}}],
+		"options": {"num_predict": 100, "temperature": 0.5, "stop": ["END"]}
+	}`, string(got))
+
+	// Without the native mode chat completions use Ollama's OpenAI-compatible endpoint.
+	r = newUpstreamRequest("ollama", "http://gpu-1:11434", "v1/chat/completions", "", map[string]interface{}{})
+	require.NoError(t, a.RewriteRequest(r))
+	assert.Equal(t, "http://gpu-1:11434/v1/chat/completions", r.URL())
+	assert.False(t, r.OpenAIResponse)
+
+	u, ok := a.ParseUsage([]byte(`{"message":{"content":""},"done":true,"prompt_eval_count":26,"eval_count":290}`))
+	assert.True(t, ok)
+	assert.Equal(t, proxy.Usage{PromptTokens: 26, CompletionTokens: 290}, u)
+	_, ok = a.ParseUsage([]byte(`{"message":{"content":"Hi"},"done":false}`))
+	assert.False(t, ok)
+}
+
+func TestLocalAdapters(t *testing.T) {
+	for _, provider := range []string{"ollama", "vllm", "llamacpp"} {
+		assert.True(t, proxy.AllowsAnonymous(provider), provider)
+		a := proxy.LookupAdapter(provider)
+		_, ok := a.(proxy.HTTPClientProvider)
+		assert.True(t, ok, provider)
+
+		// Connections without a key send no Authorization header.
+		req, _ := http.NewRequest(http.MethodPost, "http://gpu-1:8000/v1/chat/completions", nil)
+		require.NoError(t, a.SetAuth(req, &models.Connection{Provider: provider}))
+		assert.Empty(t, req.Header.Get("Authorization"))
+		require.NoError(t, a.SetAuth(req, &models.Connection{Provider: provider, APIKey: "secret"}))
+		assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+	}
+	assert.False(t, proxy.AllowsAnonymous("openai"))
+
+	r := newUpstreamRequest("vllm", "http://gpu-1:8000/v1", "v1/chat/completions", "", map[string]interface{}{})
+	r.Stream = true
+	require.NoError(t, proxy.LookupAdapter("vllm").RewriteRequest(r))
+	assert.Equal(t, "http://gpu-1:8000/v1/chat/completions", r.URL())
+	assert.True(t, r.StripUsageChunk)
+
+	u, ok := proxy.LookupAdapter("llamacpp").ParseUsage([]byte(`{"choices":[{"delta":{},"finish_reason":"stop"}],"timings":{"prompt_n":11,"predicted_n":5}}`))
+	assert.True(t, ok)
+	assert.Equal(t, proxy.Usage{PromptTokens: 11, CompletionTokens: 5}, u)
+}
+
+func TestLocalAdapters_ListModels(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tags":
+			w.Write([]byte(`{"models":[{"name":"llama3.1:8b"},{"name":"qwen2.5-coder:7b"}]}`))
+		case "/v1/models":
+			w.Write([]byte(`{"object":"list","data":[{"id":"meta-llama/Llama-3.1-8B-Instruct","object":"model"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer backend.Close()
+
+	ctx := context.Background()
+	names, err := proxy.LookupAdapter("ollama").(proxy.ModelLister).ListModels(ctx, &models.Connection{Endpoint: backend.URL + "/v1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"llama3.1:8b", "qwen2.5-coder:7b"}, names)
+
+	names, err = proxy.LookupAdapter("vllm").(proxy.ModelLister).ListModels(ctx, &models.Connection{Endpoint: backend.URL})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"meta-llama/Llama-3.1-8B-Instruct"}, names)
+
+	_, isLister := proxy.LookupAdapter("openai").(proxy.ModelLister)
+	assert.False(t, isLister)
+}
@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// defaultAnthropicMaxTokens is sent when an OpenAI client leaves the output length open, since
+// the Messages API requires max_tokens.
+const defaultAnthropicMaxTokens = 4096
+
+// anthropicAPIVersion is sent when the client did not pick an anthropic-version itself.
+const anthropicAPIVersion = "2023-06-01"
+
+// AnthropicAdapter targets the Anthropic API. Messages API calls from Anthropic SDKs pass
+// through unchanged; OpenAI chat completions are translated to /v1/messages and back.
+type AnthropicAdapter struct{}
+
+func (a *AnthropicAdapter) RewriteRequest(r *UpstreamRequest) error {
+	if r.Path == "v1/chat/completions" || r.Path == "chat/completions" {
+		opts, _ := r.Body["stream_options"].(map[string]interface{})
+		includeUsage, _ := opts["include_usage"].(bool)
+
+		body, err := openAIToAnthropic(r.Body)
+		if err != nil {
+			return err
+		}
+		body["model"] = remoteModelName(r.Model, r.Alias)
+		if r.Stream {
+			body["stream"] = true
+			r.StripUsageChunk = !includeUsage
+		}
+		r.Body = body
+		r.OpenAIResponse = true
+		r.Path = "v1/messages"
+	}
+
+	// Endpoints may be configured as https://api.anthropic.com or https://api.anthropic.com/v1.
+	if strings.HasSuffix(r.BaseURL, "/v1") {
+		r.Path = strings.TrimPrefix(r.Path, "v1/")
+	}
+	return nil
+}
+
+func (a *AnthropicAdapter) SetAuth(req *http.Request, conn *models.Connection) error {
+	req.Header.Set("x-api-key", conn.APIKey)
+	if req.Header.Get("anthropic-version") == "" {
+		req.Header.Set("anthropic-version", anthropicAPIVersion)
+	}
+	return nil
+}
+
+func (a *AnthropicAdapter) TransformResponse(resp *http.Response, r *UpstreamRequest) error {
+	if !r.OpenAIResponse {
+		return nil
+	}
+	if r.Stream && resp.StatusCode == http.StatusOK && isEventStream(resp) {
+		replaceWithEventStream(resp, func(upstream io.Reader, w io.Writer) error {
+			return translateAnthropicStream(upstream, w, newAnthropicChunker(r.Alias))
+		})
+		return nil
+	}
+	return translateJSONResponse(resp, func(body []byte) ([]byte, error) {
+		return anthropicToOpenAI(body, r.Alias)
+	})
+}
+
+// ParseUsage reads native Messages usage, including the `message.usage` of the message_start
+// stream event, or OpenAI-style usage from responses translated for OpenAI clients.
+func (a *AnthropicAdapter) ParseUsage(body []byte) (Usage, bool) {
+	if u, ok := parseOpenAIUsage(body); ok && u.Total() > 0 {
+		return u, true
+	}
+	return parseAnthropicUsage(body)
+}
+
+// openAIToAnthropic converts an OpenAI chat completion request body into an Anthropic Messages
+// request. The model and stream fields are left for the caller to set.
+func openAIToAnthropic(body map[string]interface{}) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+
+	var system []string
+	var messages []map[string]interface{}
+	// appendMessage merges consecutive turns of the same role, which the Messages API rejects.
+	appendMessage := func(role string, blocks []interface{}) {
+		if len(blocks) == 0 {
+			return
+		}
+		if n := len(messages); n > 0 && messages[n-1]["role"] == role {
+			messages[n-1]["content"] = append(messages[n-1]["content"].([]interface{}), blocks...)
+			return
+		}
+		messages = append(messages, map[string]interface{}{"role": role, "content": blocks})
+	}
+
+	rawMessages, _ := body["messages"].([]interface{})
+	for i, raw := range rawMessages {
+		msg, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("messages[%d] is not an object", i)
+		}
+		role, _ := msg["role"].(string)
+		switch role {
+		case "system", "developer":
+			system = append(system, textContent(msg["content"]))
+		case "user":
+			blocks, err := anthropicContent(msg["content"])
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			appendMessage("user", blocks)
+		case "assistant":
+			blocks, err := anthropicContent(msg["content"])
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			calls, _ := msg["tool_calls"].([]interface{})
+			for _, c := range calls {
+				call, _ := c.(map[string]interface{})
+				fn, _ := call["function"].(map[string]interface{})
+				var input interface{} = map[string]interface{}{}
+				if args, _ := fn["arguments"].(string); args != "" {
+					if err := json.Unmarshal([]byte(args), &input); err != nil {
+						return nil, fmt.Errorf("messages[%d]: tool call arguments are not valid JSON", i)
+					}
+				}
+				blocks = append(blocks, map[string]interface{}{
+					"type":  "tool_use",
+					"id":    call["id"],
+					"name":  fn["name"],
+					"input": input,
+				})
+			}
+			appendMessage("assistant", blocks)
+		case "tool":
+			appendMessage("user", []interface{}{map[string]interface{}{
+				"type":        "tool_result",
+				"tool_use_id": msg["tool_call_id"],
+				"content":     textContent(msg["content"]),
+			}})
+		default:
+			return nil, fmt.Errorf("messages[%d]: unsupported role %q", i, role)
+		}
+	}
+	out["messages"] = messages
+	if len(system) > 0 {
+		out["system"] = strings.Join(system, "\n\n")
+	}
+
+	switch {
+	case body["max_completion_tokens"] != nil:
+		out["max_tokens"] = body["max_completion_tokens"]
+	case body["max_tokens"] != nil:
+		out["max_tokens"] = body["max_tokens"]
+	default:
+		out["max_tokens"] = defaultAnthropicMaxTokens
+	}
+	for _, key := range []string{"temperature", "top_p", "top_k"} {
+		if v, ok := body[key]; ok {
+			out[key] = v
+		}
+	}
+	switch stop := body["stop"].(type) {
+	case string:
+		out["stop_sequences"] = []interface{}{stop}
+	case []interface{}:
+		out["stop_sequences"] = stop
+	}
+	if user, _ := body["user"].(string); user != "" {
+		out["metadata"] = map[string]interface{}{"user_id": user}
+	}
+
+	if rawTools, _ := body["tools"].([]interface{}); len(rawTools) > 0 {
+		var tools []interface{}
+		for _, t := range rawTools {
+			tool, _ := t.(map[string]interface{})
+			fn, _ := tool["function"].(map[string]interface{})
+			if fn == nil {
+				continue
+			}
+			schema := fn["parameters"]
+			if schema == nil {
+				schema = map[string]interface{}{"type": "object", "properties": map[string]interface{}{}}
+			}
+			converted := map[string]interface{}{"name": fn["name"], "input_schema": schema}
+			if desc, ok := fn["description"]; ok {
+				converted["description"] = desc
+			}
+			tools = append(tools, converted)
+		}
+		out["tools"] = tools
+
+		choice := map[string]interface{}{"type": "auto"}
+		switch tc := body["tool_choice"].(type) {
+		case string:
+			switch tc {
+			case "required":
+				choice["type"] = "any"
+			case "none":
+				choice["type"] = "none"
+			}
+		case map[string]interface{}:
+			if fn, _ := tc["function"].(map[string]interface{}); fn != nil {
+				choice = map[string]interface{}{"type": "tool", "name": fn["name"]}
+			}
+		}
+		if parallel, ok := body["parallel_tool_calls"].(bool); ok && !parallel && choice["type"] != "none" {
+			choice["disable_parallel_tool_use"] = true
+		}
+		out["tool_choice"] = choice
+	}
+	return out, nil
+}
+
+// textContent flattens OpenAI message content (a string or an array of parts) to its text.
+func textContent(content interface{}) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case []interface{}:
+		var parts []string
+		for _, p := range c {
+			if part, _ := p.(map[string]interface{}); part != nil {
+				if text, ok := part["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
+
+// anthropicContent converts OpenAI message content into Anthropic content blocks.
+func anthropicContent(content interface{}) ([]interface{}, error) {
+	switch c := content.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if c == "" {
+			return nil, nil
+		}
+		return []interface{}{map[string]interface{}{"type": "text", "text": c}}, nil
+	case []interface{}:
+		var blocks []interface{}
+		for _, p := range c {
+			part, _ := p.(map[string]interface{})
+			switch part["type"] {
+			case "text":
+				blocks = append(blocks, map[string]interface{}{"type": "text", "text": part["text"]})
+			case "image_url":
+				var url string
+				switch iu := part["image_url"].(type) {
+				case string:
+					url = iu
+				case map[string]interface{}:
+					url, _ = iu["url"].(string)
+				}
+				mediaType, data, ok := parseDataURL(url)
+				if !ok {
+					return nil, fmt.Errorf("images must be given as base64 data: URLs")
+				}
+				blocks = append(blocks, map[string]interface{}{
+					"type":   "image",
+					"source": map[string]interface{}{"type": "base64", "media_type": mediaType, "data": data},
+				})
+			}
+		}
+		return blocks, nil
+	}
+	return nil, fmt.Errorf("unsupported content type %T", content)
+}
+
+// parseDataURL splits data:<media type>;base64,<data>.
+func parseDataURL(url string) (mediaType, data string, ok bool) {
+	rest, ok := strings.CutPrefix(url, "data:")
+	if !ok {
+		return "", "", false
+	}
+	meta, data, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", "", false
+	}
+	mediaType, ok = strings.CutSuffix(meta, ";base64")
+	return mediaType, data, ok && mediaType != ""
+}
+
+// anthropicMessage is a non-streaming Messages API response.
+type anthropicMessage struct {
+	ID      string `json:"id"`
+	Content []struct {
+		Type  string          `json:"type"`
+		Text  string          `json:"text"`
+		ID    string          `json:"id"`
+		Name  string          `json:"name"`
+		Input json.RawMessage `json:"input"`
+	} `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      anthropicUsage `json:"usage"`
+}
+
+// anthropicToOpenAI converts a Messages API response into an OpenAI chat completion reported
+// under the model name the client used.
+func anthropicToOpenAI(body []byte, model string) ([]byte, error) {
+	var msg anthropicMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+
+	var text []string
+	var toolCalls []interface{}
+	for _, block := range msg.Content {
+		switch block.Type {
+		case "text":
+			text = append(text, block.Text)
+		case "tool_use":
+			args := string(block.Input)
+			if args == "" {
+				args = "{}"
+			}
+			toolCalls = append(toolCalls, map[string]interface{}{
+				"id":       block.ID,
+				"type":     "function",
+				"function": map[string]interface{}{"name": block.Name, "arguments": args},
+			})
+		}
+	}
+
+	message := map[string]interface{}{"role": "assistant", "content": nil}
+	if len(text) > 0 {
+		message["content"] = strings.Join(text, "")
+	}
+	if len(toolCalls) > 0 {
+		message["tool_calls"] = toolCalls
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"id":      msg.ID,
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []interface{}{map[string]interface{}{
+			"index":         0,
+			"message":       message,
+			"finish_reason": openAIFinishReason(msg.StopReason),
+		}},
+		"usage": newOpenAIUsage(msg.Usage.toUsage()),
+	})
+}
+
+// openAIError reshapes a provider error body into OpenAI's {"error": {...}} form, understanding
+// Anthropic's {"type":"error","error":{...}}, Google's {"error":{"status":...}} and Bedrock's
+// {"message": ...}. Bodies it cannot read are wrapped verbatim as the message.
+func openAIError(body []byte, status int) []byte {
+	var payload struct {
+		Message string `json:"message"`
+		Error   *struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	errType, message := "upstream_error", strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &payload) == nil {
+		switch {
+		case payload.Error != nil:
+			errType, message = payload.Error.Type, payload.Error.Message
+			if errType == "" {
+				errType = payload.Error.Status
+			}
+		case payload.Message != "":
+			message = payload.Message
+		}
+	}
+	out, _ := json.Marshal(map[string]interface{}{"error": map[string]interface{}{
+		"message": message,
+		"type":    errType,
+		"code":    status,
+	}})
+	return out
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// openAIChunk is an OpenAI `chat.completion.chunk` stream event.
+type openAIChunk struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []openAIChunkChoice `json:"choices"`
+	Usage   *openAIUsage        `json:"usage,omitempty"`
+}
+
+type openAIChunkChoice struct {
+	Index        int                    `json:"index"`
+	Delta        map[string]interface{} `json:"delta"`
+	FinishReason *string                `json:"finish_reason"`
+}
+
+type openAIUsage struct {
+	PromptTokens        int64 `json:"prompt_tokens"`
+	CompletionTokens    int64 `json:"completion_tokens"`
+	TotalTokens         int64 `json:"total_tokens"`
+	PromptTokensDetails *struct {
+		CachedTokens int64 `json:"cached_tokens"`
+	} `json:"prompt_tokens_details,omitempty"`
+}
+
+func newOpenAIUsage(u Usage) *openAIUsage {
+	out := &openAIUsage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens, TotalTokens: u.Total()}
+	if u.CachedPromptTokens > 0 {
+		out.PromptTokensDetails = &struct {
+			CachedTokens int64 `json:"cached_tokens"`
+		}{u.CachedPromptTokens}
+	}
+	return out
+}
+
+// openAIFinishReason maps an Anthropic stop_reason (or Converse stopReason) onto OpenAI's finish_reason values.
+func openAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal", "guardrail_intervened", "content_filtered":
+		return "content_filter"
+	}
+	return "stop"
+}
+
+// chunkBuilder produces the OpenAI chat completion chunks that provider stream translators emit.
+// Usage goes out as a final `choices: []` chunk, the shape `stream_options.include_usage` gives.
+type chunkBuilder struct {
+	id      string
+	model   string
+	created int64
+	// tools maps provider content block indexes to OpenAI tool_calls indexes.
+	tools map[int]int
+}
+
+// newChunkBuilder reports chunks under the model name the client asked for.
+func newChunkBuilder(model string) *chunkBuilder {
+	return &chunkBuilder{id: "chatcmpl-" + models.NewID(), model: model, created: time.Now().Unix(), tools: map[int]int{}}
+}
+
+// anthropicChunker turns Anthropic Messages stream events into OpenAI chat completion chunks.
+type anthropicChunker struct {
+	*chunkBuilder
+	usage anthropicUsage
+}
+
+func newAnthropicChunker(model string) *anthropicChunker {
+	return &anthropicChunker{chunkBuilder: newChunkBuilder(model)}
+}
+
+type anthropicStreamEvent struct {
+	Type    string `json:"type"`
+	Index   int    `json:"index"`
+	Message struct {
+		ID    string         `json:"id"`
+		Usage anthropicUsage `json:"usage"`
+	} `json:"message"`
+	ContentBlock struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"content_block"`
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+	Error json.RawMessage `json:"error"`
+}
+
+// Event translates one Anthropic event into zero or more OpenAI chunk payloads.
+func (c *anthropicChunker) Event(data []byte) ([][]byte, error) {
+	var ev anthropicStreamEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return nil, err
+	}
+
+	switch ev.Type {
+	case "message_start":
+		if ev.Message.ID != "" {
+			c.id = ev.Message.ID
+		}
+		c.usage = ev.Message.Usage
+		return c.chunk(map[string]interface{}{"role": "assistant", "content": ""}, nil)
+	case "content_block_start":
+		if ev.ContentBlock.Type != "tool_use" {
+			return nil, nil
+		}
+		return c.toolStart(ev.Index, ev.ContentBlock.ID, ev.ContentBlock.Name)
+	case "content_block_delta":
+		switch ev.Delta.Type {
+		case "text_delta":
+			return c.chunk(map[string]interface{}{"content": ev.Delta.Text}, nil)
+		case "input_json_delta":
+			return c.toolDelta(ev.Index, ev.Delta.PartialJSON)
+		}
+	case "message_delta":
+		if ev.Usage != nil {
+			c.usage.OutputTokens = ev.Usage.OutputTokens
+		}
+		if ev.Delta.StopReason != "" {
+			reason := openAIFinishReason(ev.Delta.StopReason)
+			return c.chunk(map[string]interface{}{}, &reason)
+		}
+	case "message_stop":
+		return c.usageChunk(c.usage.toUsage())
+	case "error":
+		out, err := json.Marshal(map[string]json.RawMessage{"error": ev.Error})
+		return [][]byte{out}, err
+	}
+	return nil, nil
+}
+
+func (c *chunkBuilder) chunk(delta map[string]interface{}, finishReason *string) ([][]byte, error) {
+	return c.choiceChunk(0, delta, finishReason)
+}
+
+// choiceChunk is chunk for providers that stream several candidates at once.
+func (c *chunkBuilder) choiceChunk(index int, delta map[string]interface{}, finishReason *string) ([][]byte, error) {
+	out, err := json.Marshal(openAIChunk{
+		ID:      c.id,
+		Object:  "chat.completion.chunk",
+		Created: c.created,
+		Model:   c.model,
+		Choices: []openAIChunkChoice{{Index: index, Delta: delta, FinishReason: finishReason}},
+	})
+	return [][]byte{out}, err
+}
+
+// toolStart opens an OpenAI tool call for the provider's content block at index.
+func (c *chunkBuilder) toolStart(index int, id, name string) ([][]byte, error) {
+	n := len(c.tools)
+	c.tools[index] = n
+	return c.chunk(map[string]interface{}{"tool_calls": []interface{}{map[string]interface{}{
+		"index":    n,
+		"id":       id,
+		"type":     "function",
+		"function": map[string]interface{}{"name": name, "arguments": ""},
+	}}}, nil)
+}
+
+// toolDelta appends a fragment of JSON arguments to the tool call opened for index.
+func (c *chunkBuilder) toolDelta(index int, arguments string) ([][]byte, error) {
+	return c.chunk(map[string]interface{}{"tool_calls": []interface{}{map[string]interface{}{
+		"index":    c.tools[index],
+		"function": map[string]interface{}{"arguments": arguments},
+	}}}, nil)
+}
+
+// usageChunk is the trailing `choices: []` chunk carrying usage.
+func (c *chunkBuilder) usageChunk(u Usage) ([][]byte, error) {
+	out, err := json.Marshal(openAIChunk{
+		ID: c.id, Object: "chat.completion.chunk", Created: c.created, Model: c.model,
+		Choices: []openAIChunkChoice{}, Usage: newOpenAIUsage(u),
+	})
+	return [][]byte{out}, err
+}
+
+// translateAnthropicStream reads a Messages API event stream and writes it out as OpenAI
+// server-sent events, ending with [DONE].
+func translateAnthropicStream(upstream io.Reader, w io.Writer, chunker *anthropicChunker) error {
+	reader := newSSEReader(upstream)
+	for {
+		frame, err := reader.Next()
+		if data := eventData(frame); len(data) > 0 {
+			out, jerr := chunker.Event(data)
+			if jerr != nil {
+				return jerr
+			}
+			for _, o := range out {
+				if werr := writeEvent(w, o); werr != nil {
+					return werr
+				}
+			}
+		}
+		if err == io.EOF {
+			return writeEvent(w, []byte("[DONE]"))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/awsauth"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// APIModeConverse selects Bedrock's model-agnostic Converse API for a ProviderModel instead of
+// Claude's InvokeModel body, so Llama, Mistral, Titan and other Bedrock models can be served.
+const APIModeConverse = "converse"
+
+const (
+	bedrockAnthropicVersion = "bedrock-2023-05-31"
+	// bedrockSigningService is the SigV4 service name for both bedrock and bedrock-runtime.
+	bedrockSigningService = "bedrock"
+)
+
+// AWSAdapter targets AWS Bedrock: Claude models via the InvokeModel API, or any chat model via
+// the Converse API when the ProviderModel's APIMode is APIModeConverse.
+type AWSAdapter struct {
+	// Roles caches credentials for connections that assume an IAM role; a process-wide cache
+	// is used when nil.
+	Roles *awsauth.RoleCache
+}
+
+var defaultRoleCache = awsauth.NewRoleCache(http.DefaultClient)
+
+func (a *AWSAdapter) RewriteRequest(r *UpstreamRequest) error {
+	if r.Body == nil {
+		r.Body = map[string]interface{}{}
+	}
+
+	if isEmbeddingsPath(r.Path) {
+		return translateBedrockEmbeddings(r)
+	}
+
+	// OpenAI chat completions are translated to the Anthropic Messages body Claude on Bedrock
+	// expects, and the answer is translated back in TransformResponse.
+	if r.Path == "v1/chat/completions" || r.Path == "chat/completions" {
+		opts, _ := r.Body["stream_options"].(map[string]interface{})
+		includeUsage, _ := opts["include_usage"].(bool)
+
+		body, err := openAIToAnthropic(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body = body
+		r.OpenAIResponse = true
+
+		if r.Model.APIMode == APIModeConverse {
+			r.Body = anthropicToConverse(body)
+			r.Path = "model/" + r.Model.RemoteModel + "/converse"
+			if r.Stream {
+				r.Path += "-stream"
+				r.StripUsageChunk = !includeUsage
+			}
+			return nil
+		}
+
+		if r.Stream {
+			// Bedrock streams over its own endpoint rather than a body flag, in a binary framing
+			// OpenAI clients cannot read; TransformResponse converts it to chat completion chunks.
+			r.Path = "model/" + r.Model.RemoteModel + "/invoke-with-response-stream"
+			r.StripUsageChunk = !includeUsage
+		} else {
+			r.Path = "model/" + r.Model.RemoteModel + "/invoke"
+		}
+	}
+
+	// Native Converse calls are already in the shape Bedrock expects.
+	if strings.HasSuffix(r.Path, "/converse") || strings.HasSuffix(r.Path, "/converse-stream") {
+		return nil
+	}
+
+	// Claude on Bedrock does NOT want 'model' in the JSON body
+	r.DeleteField("model")
+
+	// Ensure max_tokens is present (Claude required)
+	if _, ok := r.Body["max_tokens"]; !ok {
+		r.SetField("max_tokens", defaultAnthropicMaxTokens)
+	}
+
+	// Some versions of Bedrock Claude expect anthropic_version in body
+	r.SetField("anthropic_version", bedrockAnthropicVersion)
+	return nil
+}
+
+// SetAuth SigV4-signs the final request when the connection has IAM credentials and otherwise
+// sends APIKey as a Bedrock API key.
+func (a *AWSAdapter) SetAuth(req *http.Request, conn *models.Connection) error {
+	req.Header.Set("anthropic-version", bedrockAnthropicVersion)
+	// Signing headers a client's AWS SDK may have sent must not end up in our signature.
+	for _, h := range []string{"X-Amz-Date", "X-Amz-Security-Token", "X-Amz-Content-Sha256"} {
+		req.Header.Del(h)
+	}
+	if conn.AWSAccessKeyID == "" {
+		req.Header.Set("Authorization", "Bearer "+conn.APIKey)
+		return nil
+	}
+
+	region := conn.AWSRegion
+	if region == "" {
+		region = regionFromHost(req.URL.Hostname())
+	}
+	if region == "" {
+		return fmt.Errorf("aws connection %s has no region", conn.Name)
+	}
+
+	creds := awsauth.Credentials{
+		AccessKeyID:     conn.AWSAccessKeyID,
+		SecretAccessKey: conn.AWSSecretAccessKey,
+		SessionToken:    conn.AWSSessionToken,
+	}
+	if conn.AWSRoleARN != "" {
+		assumed, err := a.roles().Get(req.Context(), creds, region, conn.AWSRoleARN)
+		if err != nil {
+			return err
+		}
+		creds = assumed
+	}
+	return awsauth.Sign(req, creds, region, bedrockSigningService, time.Now())
+}
+
+// MaxEmbeddingInputs returns how many texts one call to a Titan or Cohere embedding model takes.
+func (a *AWSAdapter) MaxEmbeddingInputs(conn *models.Connection, pm *models.ProviderModel) int {
+	switch model := remoteModelName(pm, pm.Name); {
+	case isTitanEmbedModel(model):
+		return 1
+	case isCohereEmbedModel(model):
+		return maxCohereEmbeddingInputs
+	}
+	return 0
+}
+
+func (a *AWSAdapter) roles() *awsauth.RoleCache {
+	if a.Roles == nil {
+		return defaultRoleCache
+	}
+	return a.Roles
+}
+
+// regionFromHost extracts the region from hosts such as bedrock-runtime.us-east-1.amazonaws.com.
+func regionFromHost(host string) string {
+	parts := strings.Split(host, ".")
+	if len(parts) >= 4 && strings.HasSuffix(host, ".amazonaws.com") {
+		return parts[1]
+	}
+	return ""
+}
+
+func (a *AWSAdapter) TransformResponse(resp *http.Response, r *UpstreamRequest) error {
+	if !r.OpenAIResponse {
+		return nil
+	}
+	if r.EncodingFormat != "" {
+		return translateJSONResponse(resp, func(body []byte) ([]byte, error) {
+			return bedrockEmbeddingsToOpenAI(body, r, resp.Header.Get(bedrockInputTokensHeader))
+		})
+	}
+	converse := r.Model.APIMode == APIModeConverse
+	if r.Stream && resp.StatusCode == http.StatusOK && isAWSEventStream(resp) {
+		handle := invokeStreamEvents(newAnthropicChunker(r.Alias))
+		if converse {
+			handle = converseStreamEvents(r.Alias)
+		}
+		replaceWithEventStream(resp, func(upstream io.Reader, w io.Writer) error {
+			return translateBedrockStream(upstream, w, handle)
+		})
+		return nil
+	}
+	return translateJSONResponse(resp, func(body []byte) ([]byte, error) {
+		if converse {
+			return converseToOpenAI(body, r.Alias)
+		}
+		return anthropicToOpenAI(body, r.Alias)
+	})
+}
+
+// ParseUsage reads the Anthropic-style `usage.input_tokens/output_tokens` block, Converse's
+// `usage.inputTokens/outputTokens`, or OpenAI-style usage from responses translated for OpenAI
+// clients.
+func (a *AWSAdapter) ParseUsage(body []byte) (Usage, bool) {
+	if u, ok := parseOpenAIUsage(body); ok && u.Total() > 0 {
+		return u, true
+	}
+	if u, ok := parseConverseUsage(body); ok && u.Total() > 0 {
+		return u, true
+	}
+	return parseAnthropicUsage(body)
+}
+
+type anthropicUsage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+}
+
+// parseAnthropicUsage reads usage from an Anthropic Messages response or stream event. Anthropic
+// reports cache reads and writes separately from input_tokens, so they are folded back in.
+func parseAnthropicUsage(body []byte) (Usage, bool) {
+	var payload struct {
+		Usage   *anthropicUsage `json:"usage"`
+		Message struct {
+			Usage *anthropicUsage `json:"usage"`
+		} `json:"message"` // message_start stream events
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Usage{}, false
+	}
+	switch {
+	case payload.Usage != nil:
+		return payload.Usage.toUsage(), true
+	case payload.Message.Usage != nil:
+		return payload.Message.Usage.toUsage(), true
+	}
+	return Usage{}, false
+}
+
+func (u anthropicUsage) toUsage() Usage {
+	return Usage{
+		PromptTokens:       u.InputTokens + u.CacheReadInputTokens + u.CacheCreationInputTokens,
+		CompletionTokens:   u.OutputTokens,
+		CachedPromptTokens: u.CacheReadInputTokens,
+	}
+}
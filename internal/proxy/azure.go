@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/azureauth"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+const (
+	defaultAzureAPIVersion = "2024-05-01-preview"
+	// streamOptionsAPIVersion is the first dated api-version that accepts `stream_options`.
+	streamOptionsAPIVersion = "2024-05-01"
+)
+
+// azureDeploymentOperations are the OpenAI paths Azure OpenAI serves under
+// /openai/deployments/{deployment}/.
+var azureDeploymentOperations = map[string]bool{
+	"chat/completions":     true,
+	"completions":          true,
+	"embeddings":           true,
+	"images/generations":   true,
+	"audio/transcriptions": true,
+	"audio/translations":   true,
+	"audio/speech":         true,
+}
+
+// AzureAdapter targets Azure AI Foundry / Azure OpenAI. Models with a DeploymentName use classic
+// Azure OpenAI deployment routing; the others go to the Foundry model inference API. Responses
+// share the OpenAI shape.
+type AzureAdapter struct {
+	OpenAIAdapter
+	// Tokens caches Entra ID tokens for connections with a service principal; a process-wide
+	// cache is used when nil.
+	Tokens *azureauth.TokenCache
+}
+
+var defaultEntraTokenCache = azureauth.NewTokenCache(http.DefaultClient)
+
+func (a *AzureAdapter) RewriteRequest(r *UpstreamRequest) error {
+	op := strings.TrimPrefix(r.Path, "v1/")
+	switch {
+	case r.Model != nil && r.Model.DeploymentName != "" && azureDeploymentOperations[op]:
+		// The deployment selects the model, so the endpoint may be given with or without /openai.
+		r.Path = "deployments/" + url.PathEscape(r.Model.DeploymentName) + "/" + op
+		if !strings.HasSuffix(r.BaseURL, "/openai") {
+			r.Path = "openai/" + r.Path
+		}
+	case r.Path == "v1/chat/completions":
+		// Map OpenAI-style path to Azure Foundry path if it matches
+		r.Path = "models/chat/completions"
+	case r.Path == "v1/embeddings":
+		r.Path = "models/embeddings"
+	}
+
+	// If api-version isn't in endpoint or query, add the connection's or the default
+	version := azureAPIVersion(r)
+	if version == "" {
+		version = r.Connection.AzureAPIVersion
+		if version == "" {
+			version = defaultAzureAPIVersion
+		}
+		if r.RawQuery == "" {
+			r.RawQuery = "api-version=" + version
+		} else {
+			r.RawQuery += "&api-version=" + version
+		}
+	}
+
+	// Older api-versions reject stream_options, so their streams go unbilled.
+	if !supportsStreamOptions(version) {
+		return nil
+	}
+	return a.OpenAIAdapter.RewriteRequest(r)
+}
+
+// azureAPIVersion returns the api-version the client or the endpoint already chose, if any.
+func azureAPIVersion(r *UpstreamRequest) string {
+	if q, err := url.ParseQuery(r.RawQuery); err == nil && q.Get("api-version") != "" {
+		return q.Get("api-version")
+	}
+	if u, err := url.Parse(r.BaseURL); err == nil {
+		return u.Query().Get("api-version")
+	}
+	return ""
+}
+
+// supportsStreamOptions reports whether an api-version accepts `stream_options`. Undated
+// versions such as "v1" or "preview" track the latest API and do.
+func supportsStreamOptions(version string) bool {
+	if len(version) < len(streamOptionsAPIVersion) || version[0] < '0' || version[0] > '9' {
+		return true
+	}
+	return version[:len(streamOptionsAPIVersion)] >= streamOptionsAPIVersion
+}
+
+// SetAuth sends an Entra ID token when the connection has a service principal and otherwise
+// sends APIKey.
+func (a *AzureAdapter) SetAuth(req *http.Request, conn *models.Connection) error {
+	if conn.AzureClientID != "" {
+		token, err := a.tokens().Token(req.Context(), azureauth.ClientCredentials{
+			TenantID:     conn.AzureTenantID,
+			ClientID:     conn.AzureClientID,
+			ClientSecret: conn.AzureClientSecret,
+			Authority:    conn.AzureAuthorityURL,
+		})
+		if err != nil {
+			return err
+		}
+		req.Header.Del("api-key")
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+
+	req.Header.Set("api-key", conn.APIKey)
+	req.Header.Set("Authorization", "Bearer "+conn.APIKey)
+	return nil
+}
+
+func (a *AzureAdapter) tokens() *azureauth.TokenCache {
+	if a.Tokens == nil {
+		return defaultEntraTokenCache
+	}
+	return a.Tokens
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/eventstream"
+)
+
+// isAWSEventStream reports whether Bedrock answered with its binary event-stream framing.
+func isAWSEventStream(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/vnd.amazon.eventstream"
+}
+
+// bedrockEventHandler turns the payload of one Bedrock stream event into the OpenAI chunks to
+// emit for it.
+type bedrockEventHandler func(eventType string, payload []byte) ([][]byte, error)
+
+// invokeStreamEvents handles invoke-with-response-stream, where each `chunk` event wraps a
+// base64-encoded Anthropic stream event.
+func invokeStreamEvents(chunker *anthropicChunker) bedrockEventHandler {
+	return func(eventType string, payload []byte) ([][]byte, error) {
+		if eventType != "chunk" {
+			return nil, nil
+		}
+		var chunk struct {
+			Bytes string `json:"bytes"`
+		}
+		if err := json.Unmarshal(payload, &chunk); err != nil {
+			return nil, err
+		}
+		data, err := base64.StdEncoding.DecodeString(chunk.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return chunker.Event(data)
+	}
+}
+
+// translateBedrockStream decodes a Bedrock event-stream body and writes it out as OpenAI
+// server-sent events, ending with [DONE].
+func translateBedrockStream(upstream io.Reader, w io.Writer, handle bedrockEventHandler) error {
+	dec := eventstream.NewDecoder(upstream)
+	for {
+		msg, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			return writeEvent(w, []byte("[DONE]"))
+		}
+		if err != nil {
+			return err
+		}
+
+		switch msg.Header(":message-type") {
+		case "exception", "error":
+			// Bedrock reports mid-stream failures (throttling, validation) as exception messages.
+			errType := msg.Header(":exception-type")
+			if errType == "" {
+				errType = msg.Header(":error-code")
+			}
+			var body struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(msg.Payload, &body)
+			if body.Message == "" {
+				body.Message = msg.Header(":error-message")
+			}
+			out, _ := json.Marshal(map[string]interface{}{"error": map[string]string{"type": errType, "message": body.Message}})
+			return writeEvent(w, out)
+		case "event":
+			out, err := handle(msg.Header(":event-type"), msg.Payload)
+			if err != nil {
+				return err
+			}
+			for _, o := range out {
+				if err := writeEvent(w, o); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"mime"
+	"reflect"
+	"strings"
+)
+
+// isJSONMediaType reports whether contentType names JSON (application/json or a +json type).
+func isJSONMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// decodeJSONBody decodes a request body for adapters to rewrite. Numbers stay json.Number so
+// values such as large integer seeds survive re-encoding exactly.
+func decodeJSONBody(raw []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var body map[string]interface{}
+	if err := dec.Decode(&body); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("unexpected data after JSON object")
+	}
+	return body, nil
+}
+
+// encodeBody returns the bytes to send upstream for raw, the body the client sent. Unless an
+// adapter translated the body by assigning a new Body, the client's bytes are kept, since
+// re-encoding reorders keys and reformats values: only the fields changed through SetField and
+// DeleteField are patched into them.
+func (r *UpstreamRequest) encodeBody(raw []byte) ([]byte, error) {
+	if reflect.ValueOf(r.Body).UnsafePointer() != reflect.ValueOf(r.clientBody).UnsafePointer() {
+		return json.Marshal(r.Body)
+	}
+	out := raw
+	for _, key := range r.edited {
+		var ok bool
+		if value, exists := r.Body[key]; exists {
+			out, ok = setJSONField(out, key, value)
+		} else {
+			out, ok = deleteJSONField(out, key)
+		}
+		if !ok {
+			return json.Marshal(r.Body)
+		}
+	}
+	return out, nil
+}
+
+// jsonMember locates one top-level member of a JSON object: its key starts at keyStart and its
+// value spans valueStart to valueEnd.
+type jsonMember struct {
+	key                            string
+	keyStart, valueStart, valueEnd int
+}
+
+// scanJSONObject returns the top-level members of a JSON object and the offset just past its
+// opening brace.
+func scanJSONObject(raw []byte) ([]jsonMember, int, bool) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, 0, false
+	}
+	open := int(dec.InputOffset())
+	prev := open
+	var members []jsonMember
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, 0, false
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, 0, false
+		}
+		name, _ := tok.(string)
+		end := int(dec.InputOffset())
+		// Only whitespace and a comma separate the previous value from the quoted key.
+		keyStart := prev + bytes.IndexByte(raw[prev:], '"')
+		members = append(members, jsonMember{key: name, keyStart: keyStart, valueStart: end - len(v), valueEnd: end})
+		prev = end
+	}
+	return members, open, true
+}
+
+// splice replaces raw[start:end] with insert.
+func splice(raw []byte, start, end int, insert []byte) []byte {
+	out := make([]byte, 0, len(raw)-(end-start)+len(insert))
+	out = append(out, raw[:start]...)
+	out = append(out, insert...)
+	return append(out, raw[end:]...)
+}
+
+// replaceJSONField replaces the value of a top-level key in a JSON object in place, leaving the
+// rest of the document byte for byte as it was.
+func replaceJSONField(raw []byte, key string, value interface{}) ([]byte, bool) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+	members, _, ok := scanJSONObject(raw)
+	if !ok {
+		return nil, false
+	}
+	for _, m := range members {
+		if m.key == key {
+			return splice(raw, m.valueStart, m.valueEnd, encoded), true
+		}
+	}
+	return nil, false
+}
+
+// setJSONField is replaceJSONField, appending the key after the last member when it is missing.
+func setJSONField(raw []byte, key string, value interface{}) ([]byte, bool) {
+	if out, ok := replaceJSONField(raw, key, value); ok {
+		return out, true
+	}
+	members, open, ok := scanJSONObject(raw)
+	if !ok {
+		return nil, false
+	}
+	member, err := json.Marshal(map[string]interface{}{key: value})
+	if err != nil {
+		return nil, false
+	}
+	member = member[1 : len(member)-1]
+	if len(members) == 0 {
+		return splice(raw, open, open, member), true
+	}
+	end := members[len(members)-1].valueEnd
+	return splice(raw, end, end, append([]byte(","), member...)), true
+}
+
+// deleteJSONField removes a top-level key and its separator from a JSON object, leaving the
+// rest of the document byte for byte as it was. A missing key is not an error.
+func deleteJSONField(raw []byte, key string) ([]byte, bool) {
+	members, _, ok := scanJSONObject(raw)
+	if !ok {
+		return nil, false
+	}
+	for i, m := range members {
+		if m.key != key {
+			continue
+		}
+		switch {
+		case i > 0:
+			return splice(raw, members[i-1].valueEnd, m.valueEnd, nil), true
+		case len(members) > 1:
+			return splice(raw, m.keyStart, members[1].keyStart, nil), true
+		default:
+			return splice(raw, m.keyStart, m.valueEnd, nil), true
+		}
+	}
+	return raw, true
+}
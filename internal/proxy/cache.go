@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/cache"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/router"
+)
+
+const (
+	// cacheHeader tells clients whether a response came from the response cache (HIT) or from
+	// the provider (MISS). Sent as a request header with the value "bypass", it turns the cache
+	// off for that request.
+	cacheHeader = "X-LLM-Proxy-Cache"
+	// maxCachedBody bounds the responses kept in the cache.
+	maxCachedBody = maxBufferedBody
+)
+
+// cachePolicy is how the response cache treats one request.
+type cachePolicy struct {
+	ttl    time.Duration
+	lookup bool // Serve a stored response if there is one
+	store  bool // Store the provider's response
+}
+
+// cachePolicyFor returns how the cache treats a request: only deterministic JSON requests from
+// keys with a cache TTL use it. `Cache-Control: no-cache` skips the lookup but refreshes the
+// entry, `no-store` leaves the cache as it is, and `X-LLM-Proxy-Cache: bypass` skips it entirely.
+func cachePolicyFor(c *gin.Context, vk *models.VirtualKey, form *multipartBody, body map[string]interface{}) cachePolicy {
+	if vk.CacheTTLSeconds <= 0 || form != nil || body == nil || !isDeterministic(c.Request.URL.Path, body) {
+		return cachePolicy{}
+	}
+	if strings.EqualFold(c.GetHeader(cacheHeader), "bypass") {
+		return cachePolicy{}
+	}
+	p := cachePolicy{ttl: time.Duration(vk.CacheTTLSeconds) * time.Second, lookup: true, store: true}
+	for _, directive := range strings.Split(c.GetHeader("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache":
+			p.lookup = false
+		case "no-store":
+			p.store = false
+		}
+	}
+	return p
+}
+
+// isDeterministic reports whether a request asks for a reproducible answer: embeddings, or
+// sampling at temperature 0, given as `temperature` or Gemini's `generationConfig.temperature`.
+func isDeterministic(path string, body map[string]interface{}) bool {
+	if isEmbeddingsRequest(path) {
+		return true
+	}
+	if t, ok := body["temperature"].(float64); ok {
+		return t == 0
+	}
+	config, _ := body["generationConfig"].(map[string]interface{})
+	t, ok := config["temperature"].(float64)
+	return ok && t == 0
+}
+
+// requestCacheKey is the cache key of vk's request to an alias served by pool. Whichever
+// deployment of the pool, or fallback, answers, the response is stored under the same key, so
+// the next lookup finds it whatever the router picks then.
+func requestCacheKey(c *gin.Context, vk *models.VirtualKey, pool []router.Deployment, body map[string]interface{}) string {
+	ids := make([]string, len(pool))
+	for i, d := range pool {
+		ids[i] = d.Model.ID
+	}
+	sort.Strings(ids)
+	path := c.Request.URL.Path
+	if c.Request.URL.RawQuery != "" {
+		path += "?" + c.Request.URL.RawQuery
+	}
+	return cache.Key(vk.ID, strings.Join(ids, ","), path, body)
+}
+
+// replayCached writes a cached response. Streams were stored as the frames the client received
+// and are replayed as an event stream in one go.
+func replayCached(c *gin.Context, e *cache.Entry) {
+	header := c.Writer.Header()
+	header.Set("Content-Type", e.ContentType)
+	header.Set(cacheHeader, "HIT")
+	header.Set(costHeader, formatCost(0))
+	if strings.HasPrefix(e.ContentType, "text/event-stream") {
+		header.Set("Cache-Control", "no-cache")
+	}
+	c.Writer.WriteHeader(http.StatusOK)
+	c.Writer.Write(e.Body)
+}
+
+// cacheWriter keeps a copy of what is written to the client so the response can be cached. It
+// gives up once the response outgrows maxCachedBody.
+type cacheWriter struct {
+	gin.ResponseWriter
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	w.keep(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheWriter) WriteString(s string) (int, error) {
+	w.keep([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *cacheWriter) keep(b []byte) {
+	if w.overflow {
+		return
+	}
+	if w.buf.Len()+len(b) > maxCachedBody {
+		w.overflow = true
+		w.buf = bytes.Buffer{}
+		return
+	}
+	w.buf.Write(b)
+}
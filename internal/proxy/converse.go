@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// anthropicToConverse maps an Anthropic Messages body (as built by openAIToAnthropic) onto the
+// Bedrock Converse request shape, which every Bedrock chat model accepts.
+func anthropicToConverse(body map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+
+	var messages []interface{}
+	rawMessages, _ := body["messages"].([]map[string]interface{})
+	for _, msg := range rawMessages {
+		blocks, _ := msg["content"].([]interface{})
+		var content []interface{}
+		for _, b := range blocks {
+			if block := converseBlock(b.(map[string]interface{})); block != nil {
+				content = append(content, block)
+			}
+		}
+		messages = append(messages, map[string]interface{}{"role": msg["role"], "content": content})
+	}
+	out["messages"] = messages
+
+	if system, _ := body["system"].(string); system != "" {
+		out["system"] = []interface{}{map[string]interface{}{"text": system}}
+	}
+
+	inference := map[string]interface{}{"maxTokens": body["max_tokens"]}
+	for from, to := range map[string]string{"temperature": "temperature", "top_p": "topP", "stop_sequences": "stopSequences"} {
+		if v, ok := body[from]; ok {
+			inference[to] = v
+		}
+	}
+	out["inferenceConfig"] = inference
+	if topK, ok := body["top_k"]; ok {
+		// Not part of inferenceConfig; models that support it read it from here.
+		out["additionalModelRequestFields"] = map[string]interface{}{"top_k": topK}
+	}
+
+	// Converse has no "none" choice, so tools the model must not call are left out altogether.
+	choice, _ := body["tool_choice"].(map[string]interface{})
+	if tools, _ := body["tools"].([]interface{}); len(tools) > 0 && choice["type"] != "none" {
+		var specs []interface{}
+		for _, t := range tools {
+			tool := t.(map[string]interface{})
+			spec := map[string]interface{}{"name": tool["name"], "inputSchema": map[string]interface{}{"json": tool["input_schema"]}}
+			if desc, ok := tool["description"]; ok {
+				spec["description"] = desc
+			}
+			specs = append(specs, map[string]interface{}{"toolSpec": spec})
+		}
+		toolConfig := map[string]interface{}{"tools": specs}
+		switch choice["type"] {
+		case "any":
+			toolConfig["toolChoice"] = map[string]interface{}{"any": map[string]interface{}{}}
+		case "tool":
+			toolConfig["toolChoice"] = map[string]interface{}{"tool": map[string]interface{}{"name": choice["name"]}}
+		case "auto":
+			toolConfig["toolChoice"] = map[string]interface{}{"auto": map[string]interface{}{}}
+		}
+		out["toolConfig"] = toolConfig
+	}
+	return out
+}
+
+func converseBlock(block map[string]interface{}) map[string]interface{} {
+	switch block["type"] {
+	case "text":
+		return map[string]interface{}{"text": block["text"]}
+	case "image":
+		source, _ := block["source"].(map[string]interface{})
+		mediaType, _ := source["media_type"].(string)
+		return map[string]interface{}{"image": map[string]interface{}{
+			"format": strings.TrimPrefix(mediaType, "image/"),
+			"source": map[string]interface{}{"bytes": source["data"]},
+		}}
+	case "tool_use":
+		return map[string]interface{}{"toolUse": map[string]interface{}{
+			"toolUseId": block["id"],
+			"name":      block["name"],
+			"input":     block["input"],
+		}}
+	case "tool_result":
+		return map[string]interface{}{"toolResult": map[string]interface{}{
+			"toolUseId": block["tool_use_id"],
+			"content":   []interface{}{map[string]interface{}{"text": block["content"]}},
+		}}
+	}
+	return nil
+}
+
+type converseUsage struct {
+	InputTokens           int64 `json:"inputTokens"`
+	OutputTokens          int64 `json:"outputTokens"`
+	CacheReadInputTokens  int64 `json:"cacheReadInputTokens"`
+	CacheWriteInputTokens int64 `json:"cacheWriteInputTokens"`
+}
+
+func (u converseUsage) toUsage() Usage {
+	return Usage{
+		PromptTokens:       u.InputTokens + u.CacheReadInputTokens + u.CacheWriteInputTokens,
+		CompletionTokens:   u.OutputTokens,
+		CachedPromptTokens: u.CacheReadInputTokens,
+	}
+}
+
+// parseConverseUsage reads usage from a Converse response or a converse-stream metadata event.
+func parseConverseUsage(body []byte) (Usage, bool) {
+	var payload struct {
+		Usage *converseUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Usage == nil {
+		return Usage{}, false
+	}
+	return payload.Usage.toUsage(), true
+}
+
+type converseContent struct {
+	Text    *string `json:"text"`
+	ToolUse *struct {
+		ToolUseID string          `json:"toolUseId"`
+		Name      string          `json:"name"`
+		Input     json.RawMessage `json:"input"`
+	} `json:"toolUse"`
+}
+
+// converseToOpenAI converts a Converse response into an OpenAI chat completion.
+func converseToOpenAI(body []byte, model string) ([]byte, error) {
+	var resp struct {
+		Output struct {
+			Message struct {
+				Content []converseContent `json:"content"`
+			} `json:"message"`
+		} `json:"output"`
+		StopReason string        `json:"stopReason"`
+		Usage      converseUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	var text []string
+	var toolCalls []interface{}
+	for _, c := range resp.Output.Message.Content {
+		switch {
+		case c.Text != nil:
+			text = append(text, *c.Text)
+		case c.ToolUse != nil:
+			args := string(c.ToolUse.Input)
+			if args == "" {
+				args = "{}"
+			}
+			toolCalls = append(toolCalls, map[string]interface{}{
+				"id":       c.ToolUse.ToolUseID,
+				"type":     "function",
+				"function": map[string]interface{}{"name": c.ToolUse.Name, "arguments": args},
+			})
+		}
+	}
+	message := map[string]interface{}{"role": "assistant", "content": nil}
+	if len(text) > 0 {
+		message["content"] = strings.Join(text, "")
+	}
+	if len(toolCalls) > 0 {
+		message["tool_calls"] = toolCalls
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"id":      "chatcmpl-" + models.NewID(),
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []interface{}{map[string]interface{}{
+			"index":         0,
+			"message":       message,
+			"finish_reason": openAIFinishReason(resp.StopReason),
+		}},
+		"usage": newOpenAIUsage(resp.Usage.toUsage()),
+	})
+}
+
+// converseStreamEvents translates converse-stream events into OpenAI chunks. Unlike
+// invoke-with-response-stream, each event's payload is the event itself.
+func converseStreamEvents(model string) bedrockEventHandler {
+	c := newChunkBuilder(model)
+	return func(eventType string, payload []byte) ([][]byte, error) {
+		var ev struct {
+			ContentBlockIndex int `json:"contentBlockIndex"`
+			Start             struct {
+				ToolUse *struct {
+					ToolUseID string `json:"toolUseId"`
+					Name      string `json:"name"`
+				} `json:"toolUse"`
+			} `json:"start"`
+			Delta struct {
+				Text    *string `json:"text"`
+				ToolUse *struct {
+					Input string `json:"input"`
+				} `json:"toolUse"`
+			} `json:"delta"`
+			StopReason string         `json:"stopReason"`
+			Usage      *converseUsage `json:"usage"`
+		}
+		if err := json.Unmarshal(payload, &ev); err != nil {
+			return nil, err
+		}
+
+		switch eventType {
+		case "messageStart":
+			return c.chunk(map[string]interface{}{"role": "assistant", "content": ""}, nil)
+		case "contentBlockStart":
+			if ev.Start.ToolUse != nil {
+				return c.toolStart(ev.ContentBlockIndex, ev.Start.ToolUse.ToolUseID, ev.Start.ToolUse.Name)
+			}
+		case "contentBlockDelta":
+			switch {
+			case ev.Delta.Text != nil:
+				return c.chunk(map[string]interface{}{"content": *ev.Delta.Text}, nil)
+			case ev.Delta.ToolUse != nil:
+				return c.toolDelta(ev.ContentBlockIndex, ev.Delta.ToolUse.Input)
+			}
+		case "messageStop":
+			reason := openAIFinishReason(ev.StopReason)
+			return c.chunk(map[string]interface{}{}, &reason)
+		case "metadata":
+			if ev.Usage != nil {
+				return c.usageChunk(ev.Usage.toUsage())
+			}
+		}
+		return nil, nil
+	}
+}
@@ -0,0 +1,30 @@
+package proxy
+
+import (
+	"strconv"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// costHeader carries the USD cost of a call. Streamed responses send it as an HTTP trailer
+// because usage is only known once the stream has finished.
+const costHeader = "X-LLM-Proxy-Cost"
+
+// budgetWarningHeader is set once a key has spent past its soft-warning threshold.
+const budgetWarningHeader = "X-LLM-Proxy-Budget-Warning"
+
+// computeCost prices usage with the model's per-million-token rates.
+func computeCost(pm *models.ProviderModel, u Usage) float64 {
+	cachedPrice := pm.CachedInputPrice
+	if cachedPrice == 0 {
+		cachedPrice = pm.InputPrice
+	}
+	cached := min(u.CachedPromptTokens, u.PromptTokens)
+	return (float64(u.PromptTokens-cached)*pm.InputPrice +
+		float64(cached)*cachedPrice +
+		float64(u.CompletionTokens)*pm.OutputPrice) / 1_000_000
+}
+
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', 6, 64)
+}
@@ -0,0 +1,490 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/breaker"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/router"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/tokencount"
+)
+
+const (
+	// maxOpenAIEmbeddingInputs is the input limit of OpenAI's embeddings endpoint.
+	maxOpenAIEmbeddingInputs = 2048
+	// maxConcurrentEmbeddingBatches bounds how many batches of one request are in flight at once.
+	maxConcurrentEmbeddingBatches = 4
+	// maxEmbeddingBatchBody bounds one batch response held in memory for merging.
+	maxEmbeddingBatchBody = 64 << 20
+)
+
+// embeddingResponse is OpenAI's embeddings response. Vectors stay raw, so merged batches keep
+// whichever encoding the provider used.
+type embeddingResponse struct {
+	Object string          `json:"object"`
+	Data   []embeddingData `json:"data"`
+	Model  string          `json:"model"`
+	Usage  embeddingUsage  `json:"usage"`
+}
+
+type embeddingData struct {
+	Object    string          `json:"object"`
+	Index     int             `json:"index"`
+	Embedding json.RawMessage `json:"embedding"`
+}
+
+type embeddingUsage struct {
+	PromptTokens int64 `json:"prompt_tokens"`
+	TotalTokens  int64 `json:"total_tokens"`
+}
+
+func (a *OpenAIAdapter) MaxEmbeddingInputs(conn *models.Connection, pm *models.ProviderModel) int {
+	return maxOpenAIEmbeddingInputs
+}
+
+// isEmbeddingsRequest reports whether path is an OpenAI-style embeddings call.
+func isEmbeddingsRequest(path string) bool {
+	return strings.HasSuffix(path, "/embeddings")
+}
+
+// isEmbeddingsPath reports whether an upstream path is the OpenAI embeddings route.
+func isEmbeddingsPath(path string) bool {
+	return path == "v1/embeddings" || path == "embeddings"
+}
+
+// embeddingInputs returns the inputs of an embeddings body. A string or a single token array is
+// one input; any other array lists several.
+func embeddingInputs(input interface{}) []interface{} {
+	switch v := input.(type) {
+	case string:
+		return []interface{}{v}
+	case []interface{}:
+		if len(v) > 0 && isJSONNumber(v[0]) {
+			return []interface{}{v}
+		}
+		return v
+	}
+	return nil
+}
+
+func isJSONNumber(v interface{}) bool {
+	switch v.(type) {
+	case json.Number, float64:
+		return true
+	}
+	return false
+}
+
+// embeddingTexts returns the inputs of an embeddings body for providers that only embed text.
+func embeddingTexts(body map[string]interface{}) ([]string, error) {
+	inputs := embeddingInputs(body["input"])
+	if len(inputs) == 0 {
+		return nil, errors.New("embeddings request has no input")
+	}
+	texts := make([]string, len(inputs))
+	for i, in := range inputs {
+		text, ok := in.(string)
+		if !ok {
+			return nil, fmt.Errorf("input[%d]: only text inputs can be embedded by this provider", i)
+		}
+		texts[i] = text
+	}
+	return texts, nil
+}
+
+// embeddingFormat returns the encoding_format of an embeddings body, "float" by default.
+func embeddingFormat(body map[string]interface{}) string {
+	if format, _ := body["encoding_format"].(string); format == "base64" {
+		return format
+	}
+	return "float"
+}
+
+// newEmbeddingResponse builds an OpenAI embeddings response from float vectors, base64-encoding
+// them as little-endian float32 like OpenAI does when format is "base64".
+func newEmbeddingResponse(alias string, vectors [][]float64, format string, promptTokens int64) ([]byte, error) {
+	out := embeddingResponse{
+		Object: "list",
+		Data:   make([]embeddingData, len(vectors)),
+		Model:  alias,
+		Usage:  embeddingUsage{PromptTokens: promptTokens, TotalTokens: promptTokens},
+	}
+	for i, vec := range vectors {
+		var encoded interface{} = vec
+		if format == "base64" {
+			buf := make([]byte, 4*len(vec))
+			for j, f := range vec {
+				binary.LittleEndian.PutUint32(buf[4*j:], math.Float32bits(float32(f)))
+			}
+			encoded = base64.StdEncoding.EncodeToString(buf)
+		}
+		raw, err := json.Marshal(encoded)
+		if err != nil {
+			return nil, err
+		}
+		out.Data[i] = embeddingData{Object: "embedding", Index: i, Embedding: raw}
+	}
+	return json.Marshal(out)
+}
+
+// estimateEmbeddingTokens counts the tokens of texts for providers that do not report usage.
+func estimateEmbeddingTokens(model string, texts []string) int64 {
+	counter := tokencount.ForModel(model)
+	var n int64
+	for _, text := range texts {
+		n += int64(counter.Count(text))
+	}
+	return n
+}
+
+// sendEmbeddings sends an embeddings request to one deployment, split into as many calls as the
+// provider's input limit requires. A few batches run at once; their vectors are merged back in
+// input order into one response, which stands in for a single call. If any batch fails, its
+// response is returned instead so the request is retried or failed over as a whole; the batches
+// that did succeed are billed all the same, as the provider charged for them.
+func (p *Proxy) sendEmbeddings(c *gin.Context, body []byte, alias string, vk *models.VirtualKey, dep router.Deployment) (*attempt, *attemptError) {
+	batches := p.embeddingBatches(c, body, dep.Model)
+	if len(batches) < 2 {
+		return p.send(c, body, nil, alias, vk, dep)
+	}
+
+	attempts := make([]*attempt, len(batches))
+	errs := make([]*attemptError, len(batches))
+	sem := make(chan struct{}, maxConcurrentEmbeddingBatches)
+	br := p.router.Breaker(dep.Model.ConnectionID)
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		if br.State() != breaker.Closed {
+			// A recovering connection lets a single probe through, and concurrent batches would
+			// fail beside it and sink the whole request; wait for it to close instead.
+			wg.Wait()
+			attempts[i], errs[i] = p.send(c, batch, nil, alias, vk, dep)
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			attempts[i], errs[i] = p.send(c, batch, nil, alias, vk, dep)
+			<-sem
+		}()
+	}
+	wg.Wait()
+
+	// Find the first batch that failed, in input order. Every successful batch was paid for
+	// upstream, so its usage is read even when another batch fails and its vectors are dropped.
+	var failed *attempt
+	var failErr *attemptError
+	bodies := make([][]byte, len(attempts))
+	usages := make([]Usage, len(attempts))
+	for i, a := range attempts {
+		switch {
+		case errs[i] != nil:
+			if failed == nil && failErr == nil {
+				failErr = errs[i]
+			}
+		case a.resp.StatusCode >= http.StatusMultipleChoices:
+			if failed == nil && failErr == nil {
+				failed = a
+			}
+		default:
+			var err error
+			if bodies[i], usages[i], err = readEmbeddingBatch(a, i); err != nil && failed == nil && failErr == nil {
+				failErr = &attemptError{status: http.StatusBadGateway, msg: "Failed to process LLM provider response", err: err}
+			}
+		}
+	}
+
+	if failed != nil || failErr != nil {
+		var billed int64
+		for i, a := range attempts {
+			switch {
+			case a == nil || a == failed:
+			case a.resp.StatusCode >= http.StatusMultipleChoices:
+				p.discard(a)
+			default:
+				p.billDiscardedBatch(a, usages[i], vk)
+				billed += usages[i].Total()
+			}
+		}
+		if failed != nil {
+			failed.discardedTokens = billed
+			return failed, nil
+		}
+		failErr.discardedTokens = billed
+		return nil, failErr
+	}
+
+	var total Usage
+	for _, u := range usages {
+		total.PromptTokens += u.PromptTokens
+		total.CompletionTokens += u.CompletionTokens
+		total.CachedPromptTokens += u.CachedPromptTokens
+	}
+	merged, err := mergeEmbeddingBatches(bodies, alias, total)
+	if err != nil {
+		for i, a := range attempts {
+			p.billDiscardedBatch(a, usages[i], vk)
+		}
+		return nil, &attemptError{status: http.StatusBadGateway, msg: "Failed to process LLM provider response", err: err, discardedTokens: total.Total()}
+	}
+	first := attempts[0]
+	for _, a := range attempts[1:] {
+		a.done(a.ttfb)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Length", strconv.Itoa(len(merged)))
+	header.Set(costHeader, formatCost(computeCost(first.ureq.Model, total)))
+	return &attempt{
+		ureq:    first.ureq,
+		adapter: first.adapter,
+		resp: &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(merged)),
+			ContentLength: int64(len(merged)),
+		},
+		record:      first.record,
+		start:       first.start,
+		ttfb:        first.ttfb,
+		done:        first.done,
+		transformed: true,
+		usage:       &total,
+	}, nil
+}
+
+// embeddingBatches splits an embeddings body into the bodies of the calls pm's provider needs,
+// or returns nil when one call will do. Only `input` differs between the batches.
+func (p *Proxy) embeddingBatches(c *gin.Context, body []byte, pm *models.ProviderModel) [][]byte {
+	conn, err := p.db.GetConnection(c.Request.Context(), pm.ConnectionID)
+	if err != nil {
+		return nil
+	}
+	batcher, ok := LookupAdapter(conn.Provider).(EmbeddingBatcher)
+	if !ok {
+		return nil
+	}
+	limit := batcher.MaxEmbeddingInputs(conn, pm)
+	obj, err := decodeJSONBody(body)
+	if err != nil {
+		return nil
+	}
+	inputs := embeddingInputs(obj["input"])
+	if limit <= 0 || len(inputs) <= limit {
+		return nil
+	}
+
+	var batches [][]byte
+	for start := 0; start < len(inputs); start += limit {
+		batch, ok := replaceJSONField(body, "input", inputs[start:min(start+limit, len(inputs))])
+		if !ok {
+			return nil
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// readEmbeddingBatch translates a successful batch response for the client and returns its
+// body and the usage the provider reported in it.
+func readEmbeddingBatch(a *attempt, i int) ([]byte, Usage, error) {
+	defer a.resp.Body.Close()
+	if err := a.adapter.TransformResponse(a.resp, a.ureq); err != nil {
+		return nil, Usage{}, err
+	}
+	body, err := io.ReadAll(io.LimitReader(a.resp.Body, maxEmbeddingBatchBody+1))
+	if err != nil {
+		return nil, Usage{}, err
+	}
+	if len(body) > maxEmbeddingBatchBody {
+		return nil, Usage{}, fmt.Errorf("embeddings batch %d response exceeds %d bytes", i, maxEmbeddingBatchBody)
+	}
+	u, _ := a.adapter.ParseUsage(body)
+	return body, u, nil
+}
+
+// billDiscardedBatch records a successful batch whose vectors were dropped because another
+// batch failed. The provider still charged for it, so its usage goes to the ledger and budget.
+func (p *Proxy) billDiscardedBatch(a *attempt, u Usage, vk *models.VirtualKey) {
+	a.done(a.ttfb)
+	record := a.record
+	record.StatusCode = a.resp.StatusCode
+	record.LatencyMs = time.Since(a.start).Milliseconds()
+	record.PromptTokens = u.PromptTokens
+	record.CompletionTokens = u.CompletionTokens
+	record.CachedTokens = u.CachedPromptTokens
+	record.CostUSD = computeCost(a.ureq.Model, u)
+	p.usage.Record(record)
+	p.budgets.Add(vk, record.CostUSD)
+}
+
+// mergeEmbeddingBatches joins the vectors of the translated batch responses, renumbered in
+// input order, under their combined usage.
+func mergeEmbeddingBatches(bodies [][]byte, alias string, total Usage) ([]byte, error) {
+	out := embeddingResponse{
+		Object: "list",
+		Model:  alias,
+		Usage:  embeddingUsage{PromptTokens: total.PromptTokens, TotalTokens: total.Total()},
+	}
+	for i, body := range bodies {
+		var batch embeddingResponse
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, fmt.Errorf("embeddings batch %d: %v", i, err)
+		}
+		offset := len(out.Data)
+		for _, d := range batch.Data {
+			d.Index += offset
+			out.Data = append(out.Data, d)
+		}
+	}
+	return json.Marshal(out)
+}
+
+// geminiEmbeddingsToOpenAI converts a batchEmbedContents or Vertex predict response into an
+// OpenAI embeddings response. Vertex counts the tokens of each input; the Gemini API does not
+// report usage, so its inputs are counted with the token estimator.
+func geminiEmbeddingsToOpenAI(body []byte, r *UpstreamRequest) ([]byte, error) {
+	var resp struct {
+		Embeddings []struct {
+			Values []float64 `json:"values"`
+		} `json:"embeddings"`
+		Predictions []struct {
+			Embeddings struct {
+				Values     []float64 `json:"values"`
+				Statistics struct {
+					TokenCount float64 `json:"token_count"`
+				} `json:"statistics"`
+			} `json:"embeddings"`
+		} `json:"predictions"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	var vectors [][]float64
+	var tokens int64
+	if resp.Predictions != nil {
+		for _, p := range resp.Predictions {
+			vectors = append(vectors, p.Embeddings.Values)
+			tokens += int64(p.Embeddings.Statistics.TokenCount)
+		}
+	} else {
+		for _, e := range resp.Embeddings {
+			vectors = append(vectors, e.Values)
+		}
+		var texts []string
+		requests, _ := r.Body["requests"].([]interface{})
+		for _, req := range requests {
+			content, _ := req.(map[string]interface{})["content"].(map[string]interface{})
+			parts, _ := content["parts"].([]interface{})
+			for _, part := range parts {
+				text, _ := part.(map[string]interface{})["text"].(string)
+				texts = append(texts, text)
+			}
+		}
+		tokens = estimateEmbeddingTokens(remoteModelName(r.Model, r.Alias), texts)
+	}
+	return newEmbeddingResponse(r.Alias, vectors, r.EncodingFormat, tokens)
+}
+
+// Bedrock embedding models take one of two bodies: Titan embeds a single inputText per call,
+// Cohere up to 96 texts.
+const maxCohereEmbeddingInputs = 96
+
+func isTitanEmbedModel(model string) bool {
+	return strings.Contains(model, "titan-embed")
+}
+
+func isCohereEmbedModel(model string) bool {
+	return strings.Contains(model, "cohere.embed")
+}
+
+// bedrockInputTokensHeader is set by InvokeModel to the number of input tokens of the call.
+const bedrockInputTokensHeader = "X-Amzn-Bedrock-Input-Token-Count"
+
+// translateBedrockEmbeddings turns an OpenAI embeddings request into an InvokeModel call for a
+// Titan or Cohere embedding model. A non-standard `input_type` field is passed on to Cohere,
+// which otherwise embeds the texts as documents.
+func translateBedrockEmbeddings(r *UpstreamRequest) error {
+	texts, err := embeddingTexts(r.Body)
+	if err != nil {
+		return err
+	}
+	model := remoteModelName(r.Model, r.Alias)
+	body := map[string]interface{}{}
+	switch {
+	case isTitanEmbedModel(model):
+		if len(texts) != 1 {
+			return fmt.Errorf("%s embeds one input per call, got %d", model, len(texts))
+		}
+		body["inputText"] = texts[0]
+		if dimensions, ok := r.Body["dimensions"]; ok {
+			body["dimensions"] = dimensions
+		}
+	case isCohereEmbedModel(model):
+		body["texts"] = texts
+		body["input_type"] = "search_document"
+		if inputType, ok := r.Body["input_type"].(string); ok {
+			body["input_type"] = inputType
+		}
+		if dimensions, ok := r.Body["dimensions"]; ok {
+			body["output_dimension"] = dimensions
+		}
+	default:
+		return fmt.Errorf("embeddings on bedrock are supported for Titan and Cohere models, not %s", model)
+	}
+	r.EncodingFormat = embeddingFormat(r.Body)
+	r.OpenAIResponse = true
+	r.Body = body
+	r.Path = "model/" + model + "/invoke"
+	return nil
+}
+
+// bedrockEmbeddingsToOpenAI converts a Titan or Cohere response into an OpenAI embeddings
+// response. inputTokens is the count Bedrock reported in bedrockInputTokensHeader, if any.
+func bedrockEmbeddingsToOpenAI(body []byte, r *UpstreamRequest, inputTokens string) ([]byte, error) {
+	var resp struct {
+		Embedding           []float64       `json:"embedding"` // Titan
+		InputTextTokenCount int64           `json:"inputTextTokenCount"`
+		Embeddings          json.RawMessage `json:"embeddings"` // Cohere: vectors, or vectors by type
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+
+	var vectors [][]float64
+	switch {
+	case resp.Embedding != nil:
+		vectors = [][]float64{resp.Embedding}
+	case len(resp.Embeddings) > 0:
+		if err := json.Unmarshal(resp.Embeddings, &vectors); err != nil {
+			var byType struct {
+				Float [][]float64 `json:"float"`
+			}
+			if err := json.Unmarshal(resp.Embeddings, &byType); err != nil {
+				return nil, fmt.Errorf("unexpected embeddings in bedrock response: %v", err)
+			}
+			vectors = byType.Float
+		}
+	}
+
+	tokens := resp.InputTextTokenCount
+	if n, err := strconv.ParseInt(inputTokens, 10, 64); err == nil {
+		tokens = n
+	}
+	return newEmbeddingResponse(r.Alias, vectors, r.EncodingFormat, tokens)
+}
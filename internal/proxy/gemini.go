@@ -0,0 +1,421 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// openAIToGemini converts an OpenAI chat completion request body into a Gemini
+// generateContent request.
+func openAIToGemini(body map[string]interface{}) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+
+	var system []interface{}
+	var contents []map[string]interface{}
+	// Function responses must name the function; OpenAI only gives the call ID.
+	callNames := map[string]interface{}{}
+	appendContent := func(role string, parts []interface{}) {
+		if len(parts) == 0 {
+			return
+		}
+		if n := len(contents); n > 0 && contents[n-1]["role"] == role {
+			contents[n-1]["parts"] = append(contents[n-1]["parts"].([]interface{}), parts...)
+			return
+		}
+		contents = append(contents, map[string]interface{}{"role": role, "parts": parts})
+	}
+
+	rawMessages, _ := body["messages"].([]interface{})
+	for i, raw := range rawMessages {
+		msg, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("messages[%d] is not an object", i)
+		}
+		role, _ := msg["role"].(string)
+		switch role {
+		case "system", "developer":
+			system = append(system, map[string]interface{}{"text": textContent(msg["content"])})
+		case "user", "assistant":
+			parts, err := geminiParts(msg["content"])
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			geminiRole := "user"
+			if role == "assistant" {
+				geminiRole = "model"
+				calls, _ := msg["tool_calls"].([]interface{})
+				for _, c := range calls {
+					call, _ := c.(map[string]interface{})
+					fn, _ := call["function"].(map[string]interface{})
+					var args interface{} = map[string]interface{}{}
+					if s, _ := fn["arguments"].(string); s != "" {
+						if err := json.Unmarshal([]byte(s), &args); err != nil {
+							return nil, fmt.Errorf("messages[%d]: tool call arguments are not valid JSON", i)
+						}
+					}
+					if id, _ := call["id"].(string); id != "" {
+						callNames[id] = fn["name"]
+					}
+					parts = append(parts, map[string]interface{}{"functionCall": map[string]interface{}{"name": fn["name"], "args": args}})
+				}
+			}
+			appendContent(geminiRole, parts)
+		case "tool":
+			id, _ := msg["tool_call_id"].(string)
+			text := textContent(msg["content"])
+			// Gemini wants an object; JSON object results are passed through, anything else wrapped.
+			var response interface{}
+			if err := json.Unmarshal([]byte(text), &response); err != nil {
+				response = nil
+			}
+			if _, isObject := response.(map[string]interface{}); !isObject {
+				response = map[string]interface{}{"content": text}
+			}
+			appendContent("user", []interface{}{map[string]interface{}{
+				"functionResponse": map[string]interface{}{"name": callNames[id], "response": response},
+			}})
+		default:
+			return nil, fmt.Errorf("messages[%d]: unsupported role %q", i, role)
+		}
+	}
+	out["contents"] = contents
+	if len(system) > 0 {
+		out["systemInstruction"] = map[string]interface{}{"parts": system}
+	}
+
+	config := map[string]interface{}{}
+	if v, ok := body["max_completion_tokens"]; ok {
+		config["maxOutputTokens"] = v
+	} else if v, ok := body["max_tokens"]; ok {
+		config["maxOutputTokens"] = v
+	}
+	for from, to := range map[string]string{
+		"temperature": "temperature", "top_p": "topP", "top_k": "topK", "n": "candidateCount", "seed": "seed",
+		"presence_penalty": "presencePenalty", "frequency_penalty": "frequencyPenalty",
+	} {
+		if v, ok := body[from]; ok {
+			config[to] = v
+		}
+	}
+	switch stop := body["stop"].(type) {
+	case string:
+		config["stopSequences"] = []interface{}{stop}
+	case []interface{}:
+		config["stopSequences"] = stop
+	}
+	if format, _ := body["response_format"].(map[string]interface{}); format != nil {
+		switch format["type"] {
+		case "json_object":
+			config["responseMimeType"] = "application/json"
+		case "json_schema":
+			config["responseMimeType"] = "application/json"
+			if js, _ := format["json_schema"].(map[string]interface{}); js != nil && js["schema"] != nil {
+				config["responseJsonSchema"] = js["schema"]
+			}
+		}
+	}
+	if len(config) > 0 {
+		out["generationConfig"] = config
+	}
+
+	if rawTools, _ := body["tools"].([]interface{}); len(rawTools) > 0 {
+		var decls []interface{}
+		for _, t := range rawTools {
+			tool, _ := t.(map[string]interface{})
+			fn, _ := tool["function"].(map[string]interface{})
+			if fn == nil {
+				continue
+			}
+			decl := map[string]interface{}{"name": fn["name"]}
+			if desc, ok := fn["description"]; ok {
+				decl["description"] = desc
+			}
+			if params, ok := fn["parameters"]; ok {
+				decl["parameters"] = geminiSchema(params)
+			}
+			decls = append(decls, decl)
+		}
+		out["tools"] = []interface{}{map[string]interface{}{"functionDeclarations": decls}}
+
+		calling := map[string]interface{}{"mode": "AUTO"}
+		switch tc := body["tool_choice"].(type) {
+		case string:
+			switch tc {
+			case "none":
+				calling["mode"] = "NONE"
+			case "required":
+				calling["mode"] = "ANY"
+			}
+		case map[string]interface{}:
+			if fn, _ := tc["function"].(map[string]interface{}); fn != nil {
+				calling = map[string]interface{}{"mode": "ANY", "allowedFunctionNames": []interface{}{fn["name"]}}
+			}
+		}
+		out["toolConfig"] = map[string]interface{}{"functionCallingConfig": calling}
+	}
+	return out, nil
+}
+
+// geminiSchema drops the JSON Schema keywords Gemini's OpenAPI-subset schemas reject.
+func geminiSchema(schema interface{}) interface{} {
+	switch s := schema.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(s))
+		for k, v := range s {
+			if k == "$schema" || k == "additionalProperties" || k == "strict" {
+				continue
+			}
+			out[k] = geminiSchema(v)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(s))
+		for i, v := range s {
+			out[i] = geminiSchema(v)
+		}
+		return out
+	}
+	return schema
+}
+
+// geminiParts converts OpenAI message content into Gemini parts.
+func geminiParts(content interface{}) ([]interface{}, error) {
+	switch c := content.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if c == "" {
+			return nil, nil
+		}
+		return []interface{}{map[string]interface{}{"text": c}}, nil
+	case []interface{}:
+		var parts []interface{}
+		for _, p := range c {
+			part, _ := p.(map[string]interface{})
+			switch part["type"] {
+			case "text":
+				parts = append(parts, map[string]interface{}{"text": part["text"]})
+			case "image_url":
+				var url string
+				switch iu := part["image_url"].(type) {
+				case string:
+					url = iu
+				case map[string]interface{}:
+					url, _ = iu["url"].(string)
+				}
+				if mediaType, data, ok := parseDataURL(url); ok {
+					parts = append(parts, map[string]interface{}{"inlineData": map[string]interface{}{"mimeType": mediaType, "data": data}})
+					continue
+				}
+				// Remote files (gs:// on Vertex, https elsewhere) are referenced, which needs a MIME type.
+				mediaType := mime.TypeByExtension(path.Ext(url))
+				if mediaType == "" {
+					return nil, fmt.Errorf("cannot tell the image type of %s; use a base64 data: URL", url)
+				}
+				parts = append(parts, map[string]interface{}{"fileData": map[string]interface{}{"mimeType": mediaType, "fileUri": url}})
+			}
+		}
+		return parts, nil
+	}
+	return nil, fmt.Errorf("unsupported content type %T", content)
+}
+
+type geminiCandidate struct {
+	Index   int `json:"index"`
+	Content struct {
+		Parts []struct {
+			Text         *string `json:"text"`
+			Thought      bool    `json:"thought"`
+			FunctionCall *struct {
+				ID   string          `json:"id"`
+				Name string          `json:"name"`
+				Args json.RawMessage `json:"args"`
+			} `json:"functionCall"`
+		} `json:"parts"`
+	} `json:"content"`
+	FinishReason string `json:"finishReason"`
+}
+
+type geminiResponse struct {
+	ResponseID    string            `json:"responseId"`
+	Candidates    []geminiCandidate `json:"candidates"`
+	UsageMetadata *struct {
+		PromptTokenCount        int64 `json:"promptTokenCount"`
+		CandidatesTokenCount    int64 `json:"candidatesTokenCount"`
+		ThoughtsTokenCount      int64 `json:"thoughtsTokenCount"`
+		CachedContentTokenCount int64 `json:"cachedContentTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+func (r geminiResponse) usage() Usage {
+	m := r.UsageMetadata
+	if m == nil {
+		return Usage{}
+	}
+	return Usage{
+		PromptTokens:       m.PromptTokenCount,
+		CompletionTokens:   m.CandidatesTokenCount + m.ThoughtsTokenCount,
+		CachedPromptTokens: m.CachedContentTokenCount,
+	}
+}
+
+// geminiFinishReason maps a Gemini finishReason onto OpenAI's finish_reason.
+func geminiFinishReason(reason string, calledTools bool) string {
+	switch reason {
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "content_filter"
+	}
+	if calledTools {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+// split separates a candidate's visible text from its function calls; thought summaries are
+// dropped. Calls without an ID get one derived from their position.
+func (c geminiCandidate) split(callOffset int) (text string, calls []interface{}) {
+	var b strings.Builder
+	for _, p := range c.Content.Parts {
+		switch {
+		case p.FunctionCall != nil:
+			id := p.FunctionCall.ID
+			if id == "" {
+				id = fmt.Sprintf("call_%d", callOffset+len(calls))
+			}
+			args := string(p.FunctionCall.Args)
+			if args == "" {
+				args = "{}"
+			}
+			calls = append(calls, map[string]interface{}{
+				"id":       id,
+				"type":     "function",
+				"function": map[string]interface{}{"name": p.FunctionCall.Name, "arguments": args},
+			})
+		case p.Text != nil && !p.Thought:
+			b.WriteString(*p.Text)
+		}
+	}
+	return b.String(), calls
+}
+
+// geminiToOpenAI converts a generateContent response into an OpenAI chat completion.
+func geminiToOpenAI(body []byte, model string) ([]byte, error) {
+	var resp geminiResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	choices := []interface{}{}
+	for _, c := range resp.Candidates {
+		text, calls := c.split(0)
+		message := map[string]interface{}{"role": "assistant", "content": nil}
+		if text != "" {
+			message["content"] = text
+		}
+		if len(calls) > 0 {
+			message["tool_calls"] = calls
+		}
+		choices = append(choices, map[string]interface{}{
+			"index":         c.Index,
+			"message":       message,
+			"finish_reason": geminiFinishReason(c.FinishReason, len(calls) > 0),
+		})
+	}
+	id := resp.ResponseID
+	if id == "" {
+		id = "chatcmpl-" + models.NewID()
+	}
+	return json.Marshal(map[string]interface{}{
+		"id":      id,
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": choices,
+		"usage":   newOpenAIUsage(resp.usage()),
+	})
+}
+
+// translateGeminiStream turns a streamGenerateContent?alt=sse body into OpenAI chunks. Gemini
+// sends whole candidate deltas per event, so each event maps onto one chunk per candidate, and
+// the running usage totals are emitted once at the end.
+func translateGeminiStream(upstream io.Reader, w io.Writer, model string) error {
+	c := newChunkBuilder(model)
+	started := map[int]bool{}
+	toolCalls := map[int]int{}
+	var usage Usage
+
+	emit := func(chunks [][]byte, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			if err := writeEvent(w, chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	reader := newSSEReader(upstream)
+	for {
+		frame, err := reader.Next()
+		if data := eventData(frame); len(data) > 0 {
+			var resp geminiResponse
+			if jerr := json.Unmarshal(data, &resp); jerr != nil {
+				return jerr
+			}
+			if resp.UsageMetadata != nil {
+				usage = resp.usage()
+			}
+			for _, cand := range resp.Candidates {
+				if !started[cand.Index] {
+					started[cand.Index] = true
+					if err := emit(c.choiceChunk(cand.Index, map[string]interface{}{"role": "assistant", "content": ""}, nil)); err != nil {
+						return err
+					}
+				}
+				text, calls := cand.split(toolCalls[cand.Index])
+				delta := map[string]interface{}{}
+				if text != "" {
+					delta["content"] = text
+				}
+				if len(calls) > 0 {
+					for i, call := range calls {
+						call.(map[string]interface{})["index"] = toolCalls[cand.Index] + i
+					}
+					toolCalls[cand.Index] += len(calls)
+					delta["tool_calls"] = calls
+				}
+				var finish *string
+				if cand.FinishReason != "" {
+					reason := geminiFinishReason(cand.FinishReason, toolCalls[cand.Index] > 0)
+					finish = &reason
+				}
+				if len(delta) > 0 || finish != nil {
+					if err := emit(c.choiceChunk(cand.Index, delta, finish)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := emit(c.usageChunk(usage)); err != nil {
+		return err
+	}
+	return writeEvent(w, []byte("[DONE]"))
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/gcpauth"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// GoogleAdapter handles Gemini on AI Studio and Vertex AI, both native and through the
+// OpenAI-compatible endpoint. OpenAI chat requests sent to a connection without the
+// compatibility layer are translated to generateContent and back.
+type GoogleAdapter struct {
+	// Tokens caches access tokens minted for service-account connections; a process-wide cache
+	// is used when nil.
+	Tokens *gcpauth.TokenCache
+}
+
+var defaultTokenCache = gcpauth.NewTokenCache(http.DefaultClient)
+
+func (a *GoogleAdapter) RewriteRequest(r *UpstreamRequest) error {
+	// Convert Vertex-style path to AI Studio-style if the endpoint is AI Studio.
+	isVertex := strings.Contains(r.BaseURL, "aiplatform.googleapis.com")
+	if !isVertex {
+		r.Path = strings.Replace(r.Path, "publishers/google/", "", 1)
+	}
+
+	if !strings.HasSuffix(r.BaseURL, "/openai") {
+		switch {
+		case r.Path == "v1/chat/completions" || r.Path == "chat/completions":
+			if err := a.translateChatRequest(r, isVertex); err != nil {
+				return err
+			}
+		case isEmbeddingsPath(r.Path):
+			if err := a.translateEmbeddingsRequest(r, isVertex); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Google AI Studio OpenAI-compatible endpoint doesn't want the /v1/ prefix
+	if strings.HasSuffix(r.BaseURL, "/openai") && strings.HasPrefix(r.Path, "v1/") {
+		r.Path = strings.TrimPrefix(r.Path, "v1/")
+	}
+
+	// Strip client's 'key' param and inject our own; service-account connections authenticate
+	// with a Bearer token in SetAuth instead.
+	var params []string
+	for _, p := range strings.Split(r.RawQuery, "&") {
+		if !strings.HasPrefix(p, "key=") && p != "" {
+			params = append(params, p)
+		}
+	}
+	if r.Connection.GCPServiceAccountJSON == "" {
+		params = append(params, "key="+r.Connection.APIKey)
+	}
+	r.RawQuery = strings.Join(params, "&")
+	return nil
+}
+
+// SetAuth sends a minted OAuth token when the connection has a service account and otherwise
+// sends APIKey.
+func (a *GoogleAdapter) SetAuth(req *http.Request, conn *models.Connection) error {
+	if conn.GCPServiceAccountJSON != "" {
+		token, err := a.tokens().Token(req.Context(), conn.GCPServiceAccountJSON, conn.GCPTokenURL)
+		if err != nil {
+			return err
+		}
+		req.Header.Del("x-goog-api-key")
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+
+	req.Header.Set("x-goog-api-key", conn.APIKey)
+	// Only use Bearer auth if it's an OAuth token (starts with ya29).
+	// API Keys (like Vertex API keys starting with AQ.) should not use Bearer.
+	if strings.HasPrefix(conn.APIKey, "ya29.") {
+		req.Header.Set("Authorization", "Bearer "+conn.APIKey)
+	}
+	return nil
+}
+
+func (a *GoogleAdapter) tokens() *gcpauth.TokenCache {
+	if a.Tokens == nil {
+		return defaultTokenCache
+	}
+	return a.Tokens
+}
+
+// translateChatRequest turns an OpenAI chat completion into a native generateContent call.
+// Vertex endpoints must carry the project and location, e.g.
+// https://us-central1-aiplatform.googleapis.com/v1/projects/my-project/locations/us-central1.
+func (a *GoogleAdapter) translateChatRequest(r *UpstreamRequest, isVertex bool) error {
+	opts, _ := r.Body["stream_options"].(map[string]interface{})
+	includeUsage, _ := opts["include_usage"].(bool)
+
+	body, err := openAIToGemini(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = body
+	r.OpenAIResponse = true
+
+	method := ":generateContent"
+	if r.Stream {
+		method = ":streamGenerateContent"
+		r.RawQuery = strings.TrimPrefix(r.RawQuery+"&alt=sse", "&")
+		r.StripUsageChunk = !includeUsage
+	}
+	path, err := geminiModelPath(r, isVertex, method)
+	if err != nil {
+		return err
+	}
+	r.Path = path
+	return nil
+}
+
+// translateEmbeddingsRequest turns an OpenAI embeddings request into batchEmbedContents, or into
+// predict on Vertex, whose embedding models are served through the prediction API.
+func (a *GoogleAdapter) translateEmbeddingsRequest(r *UpstreamRequest, isVertex bool) error {
+	texts, err := embeddingTexts(r.Body)
+	if err != nil {
+		return err
+	}
+	dimensions, hasDimensions := r.Body["dimensions"]
+	r.EncodingFormat = embeddingFormat(r.Body)
+	r.OpenAIResponse = true
+
+	model := remoteModelName(r.Model, r.Alias)
+	body := map[string]interface{}{}
+	method := ":batchEmbedContents"
+	if isVertex {
+		method = ":predict"
+		instances := make([]interface{}, len(texts))
+		for i, text := range texts {
+			instances[i] = map[string]interface{}{"content": text}
+		}
+		body["instances"] = instances
+		if hasDimensions {
+			body["parameters"] = map[string]interface{}{"outputDimensionality": dimensions}
+		}
+	} else {
+		requests := make([]interface{}, len(texts))
+		for i, text := range texts {
+			req := map[string]interface{}{
+				"model":   "models/" + model,
+				"content": map[string]interface{}{"parts": []interface{}{map[string]interface{}{"text": text}}},
+			}
+			if hasDimensions {
+				req["outputDimensionality"] = dimensions
+			}
+			requests[i] = req
+		}
+		body["requests"] = requests
+	}
+	r.Body = body
+
+	path, err := geminiModelPath(r, isVertex, method)
+	if err != nil {
+		return err
+	}
+	r.Path = path
+	return nil
+}
+
+// geminiModelPath returns the path of a model method such as ":generateContent" on the
+// connection's endpoint.
+func geminiModelPath(r *UpstreamRequest, isVertex bool, method string) (string, error) {
+	model := remoteModelName(r.Model, r.Alias)
+	switch {
+	case isVertex:
+		if !strings.Contains(r.BaseURL, "/projects/") {
+			return "", fmt.Errorf("vertex connection endpoint must include /v1/projects/{project}/locations/{location} to serve %s", strings.TrimPrefix(method, ":"))
+		}
+		return "publishers/google/models/" + model + method, nil
+	case strings.HasSuffix(r.BaseURL, "/v1beta") || strings.HasSuffix(r.BaseURL, "/v1"):
+		return "models/" + model + method, nil
+	default:
+		return "v1beta/models/" + model + method, nil
+	}
+}
+
+// MaxEmbeddingInputs returns Gemini's batchEmbedContents limit, or the instance limit of Vertex
+// predict, where Gemini embedding models take a single input.
+func (a *GoogleAdapter) MaxEmbeddingInputs(conn *models.Connection, pm *models.ProviderModel) int {
+	if !strings.Contains(conn.Endpoint, "aiplatform.googleapis.com") {
+		return 100
+	}
+	if strings.HasPrefix(remoteModelName(pm, pm.Name), "gemini-embedding") {
+		return 1
+	}
+	return 250
+}
+
+func (a *GoogleAdapter) TransformResponse(resp *http.Response, r *UpstreamRequest) error {
+	if !r.OpenAIResponse {
+		return nil
+	}
+	if r.EncodingFormat != "" {
+		return translateJSONResponse(resp, func(body []byte) ([]byte, error) {
+			return geminiEmbeddingsToOpenAI(body, r)
+		})
+	}
+	if r.Stream && resp.StatusCode == http.StatusOK && isEventStream(resp) {
+		replaceWithEventStream(resp, func(upstream io.Reader, w io.Writer) error {
+			return translateGeminiStream(upstream, w, r.Alias)
+		})
+		return nil
+	}
+	return translateJSONResponse(resp, func(body []byte) ([]byte, error) {
+		return geminiToOpenAI(body, r.Alias)
+	})
+}
+
+// ParseUsage understands native `usageMetadata` as well as the `usage` block returned by the
+// OpenAI-compatible endpoint.
+func (a *GoogleAdapter) ParseUsage(body []byte) (Usage, bool) {
+	var payload struct {
+		UsageMetadata *struct {
+			PromptTokenCount        int64 `json:"promptTokenCount"`
+			CandidatesTokenCount    int64 `json:"candidatesTokenCount"`
+			ThoughtsTokenCount      int64 `json:"thoughtsTokenCount"`
+			CachedContentTokenCount int64 `json:"cachedContentTokenCount"`
+		} `json:"usageMetadata"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return Usage{}, false
+	}
+	if m := payload.UsageMetadata; m != nil {
+		return Usage{
+			PromptTokens:       m.PromptTokenCount,
+			CompletionTokens:   m.CandidatesTokenCount + m.ThoughtsTokenCount,
+			CachedPromptTokens: m.CachedContentTokenCount,
+		}, true
+	}
+	return parseOpenAIUsage(body)
+}
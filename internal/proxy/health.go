@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/breaker"
+)
+
+// UpstreamHealth is one connection's entry in the /health/upstreams report.
+type UpstreamHealth struct {
+	ConnectionID string `json:"connection_id"`
+	Name         string `json:"name"`
+	Provider     string `json:"provider"`
+	breaker.Snapshot
+}
+
+// HandleUpstreamHealth reports the circuit breaker state and recent error rate of every
+// connection. When MASTER_KEY is set the caller must present it, since the report names
+// every upstream.
+func (p *Proxy) HandleUpstreamHealth(c *gin.Context) {
+	if masterKey := os.Getenv("MASTER_KEY"); masterKey != "" &&
+		strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ") != masterKey {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Master key required"})
+		return
+	}
+
+	conns, err := p.db.ListConnections(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list connections"})
+		return
+	}
+
+	snapshots := p.router.Health()
+	upstreams := make([]UpstreamHealth, 0, len(conns))
+	for _, conn := range conns {
+		snap, ok := snapshots[conn.ID]
+		if !ok {
+			snap = breaker.Snapshot{State: breaker.Closed.String()}
+		}
+		upstreams = append(upstreams, UpstreamHealth{
+			ConnectionID: conn.ID,
+			Name:         conn.Name,
+			Provider:     conn.Provider,
+			Snapshot:     snap,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"upstreams": upstreams})
+}
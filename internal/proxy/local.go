@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// localClient talks to self-hosted backends on the local network. Backends are dialed directly
+// rather than through HTTP_PROXY, and far more idle connections are kept per host than
+// http.DefaultTransport allows, since a few GPU servers carry all the concurrent streams and LAN
+// round trips are too cheap to be worth compressing. There is no response timeout because a
+// backend may have to load a model before it answers.
+var localClient = &http.Client{Transport: &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	MaxIdleConns:        256,
+	MaxIdleConnsPerHost: 64,
+	IdleConnTimeout:     5 * time.Minute,
+	DisableCompression:  true,
+}}
+
+// localAdapter is shared by self-hosted OpenAI-compatible servers: they are reached through
+// localClient and only need a key when one sits behind an authenticating reverse proxy.
+type localAdapter struct {
+	OpenAIAdapter
+}
+
+func (a *localAdapter) RewriteRequest(r *UpstreamRequest) error {
+	// Endpoints may be configured with or without the /v1 suffix.
+	if strings.HasSuffix(r.BaseURL, "/v1") {
+		r.Path = strings.TrimPrefix(r.Path, "v1/")
+	}
+	return a.OpenAIAdapter.RewriteRequest(r)
+}
+
+func (a *localAdapter) SetAuth(req *http.Request, conn *models.Connection) error {
+	if conn.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+conn.APIKey)
+	}
+	return nil
+}
+
+func (a *localAdapter) HTTPClient() *http.Client {
+	return localClient
+}
+
+func (a *localAdapter) selfHosted() {}
+
+// ListModels returns the IDs reported by the OpenAI-compatible /v1/models endpoint.
+func (a *localAdapter) ListModels(ctx context.Context, conn *models.Connection) ([]string, error) {
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	u := strings.TrimSuffix(conn.Endpoint, "/")
+	if !strings.HasSuffix(u, "/v1") {
+		u += "/v1"
+	}
+	if err := a.getJSON(ctx, conn, u+"/models", &list); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(list.Data))
+	for _, m := range list.Data {
+		ids = append(ids, m.ID)
+	}
+	return ids, nil
+}
+
+func (a *localAdapter) getJSON(ctx context.Context, conn *models.Connection, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if err := a.SetAuth(req, conn); err != nil {
+		return err
+	}
+	resp, err := localClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBufferedBody))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return json.Unmarshal(body, v)
+}
+
+// VLLMAdapter targets a vLLM OpenAI-compatible server.
+type VLLMAdapter struct {
+	localAdapter
+}
+
+// LlamaCppAdapter targets the llama.cpp server (llama-server).
+type LlamaCppAdapter struct {
+	localAdapter
+}
+
+// ParseUsage falls back to the `timings` block llama.cpp attaches to responses and final stream
+// chunks, since builds without stream usage support ignore `stream_options`.
+func (a *LlamaCppAdapter) ParseUsage(body []byte) (Usage, bool) {
+	if u, ok := parseOpenAIUsage(body); ok && u.Total() > 0 {
+		return u, true
+	}
+	var payload struct {
+		Timings *struct {
+			PromptN    int64 `json:"prompt_n"`
+			PredictedN int64 `json:"predicted_n"`
+		} `json:"timings"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Timings == nil {
+		return Usage{}, false
+	}
+	return Usage{PromptTokens: payload.Timings.PromptN, CompletionTokens: payload.Timings.PredictedN}, true
+}
+
+// AllowsAnonymous reports whether connections of provider may be added without credentials,
+// which holds for the self-hosted backends.
+func AllowsAnonymous(provider string) bool {
+	_, ok := LookupAdapter(provider).(interface{ selfHosted() })
+	return ok
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// ModelInfo is one entry of the OpenAI model list.
+type ModelInfo struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// GeminiModelInfo is one entry of the Gemini model list.
+type GeminiModelInfo struct {
+	Name                       string   `json:"name"`
+	DisplayName                string   `json:"displayName"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+}
+
+func (m ModelInfo) gemini() GeminiModelInfo {
+	return GeminiModelInfo{
+		Name:                       "models/" + m.ID,
+		DisplayName:                m.ID,
+		SupportedGenerationMethods: []string{"generateContent", "streamGenerateContent", "countTokens"},
+	}
+}
+
+// HandleListModels answers GET /v1/models with the aliases the caller's key may use: its
+// assignments, or every registered model for the master key. Under /v1beta, or when the key came
+// in x-goog-api-key, the list is in Gemini's format.
+func (p *Proxy) HandleListModels(c *gin.Context) {
+	vk, isMaster, ok := p.authenticate(c)
+	if !ok {
+		return
+	}
+	list, err := p.visibleModels(c.Request.Context(), vk, isMaster)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list models", "details": err.Error()})
+		return
+	}
+
+	if wantsGeminiModels(c) {
+		out := make([]GeminiModelInfo, 0, len(list))
+		for _, m := range list {
+			out = append(out, m.gemini())
+		}
+		c.JSON(http.StatusOK, gin.H{"models": out})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": list})
+}
+
+// HandleGetModel answers GET /v1/models/{alias} for an alias the caller's key may use. Aliases
+// may contain slashes, as Hugging Face model names do.
+func (p *Proxy) HandleGetModel(c *gin.Context) {
+	vk, isMaster, ok := p.authenticate(c)
+	if !ok {
+		return
+	}
+	alias := strings.TrimPrefix(c.Param("model"), "/")
+	list, err := p.visibleModels(c.Request.Context(), vk, isMaster)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list models", "details": err.Error()})
+		return
+	}
+
+	for _, m := range list {
+		if m.ID != alias {
+			continue
+		}
+		if wantsGeminiModels(c) {
+			c.JSON(http.StatusOK, m.gemini())
+		} else {
+			c.JSON(http.StatusOK, m)
+		}
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "Model not found: " + alias})
+}
+
+func wantsGeminiModels(c *gin.Context) bool {
+	return strings.HasPrefix(c.Request.URL.Path, "/v1beta/") || c.GetHeader("x-goog-api-key") != ""
+}
+
+// visibleModels returns the aliases vk can call, sorted by name. An alias shared by a pool is
+// listed once, dated by its oldest entry and owned by that entry's provider.
+func (p *Proxy) visibleModels(ctx context.Context, vk *models.VirtualKey, isMaster bool) ([]ModelInfo, error) {
+	pms, err := p.db.ListProviderModels(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	conns, err := p.db.ListConnections(ctx)
+	if err != nil {
+		return nil, err
+	}
+	providers := make(map[string]string, len(conns))
+	for _, conn := range conns {
+		providers[conn.ID] = conn.Provider
+	}
+
+	byAlias := map[string]ModelInfo{}
+	add := func(alias string, pm *models.ProviderModel, created int64) {
+		if existing, ok := byAlias[alias]; ok && existing.Created <= created {
+			return
+		}
+		byAlias[alias] = ModelInfo{ID: alias, Object: "model", Created: created, OwnedBy: providers[pm.ConnectionID]}
+	}
+
+	if isMaster {
+		for i := range pms {
+			add(pms[i].Name, &pms[i], pms[i].CreatedAt.Unix())
+		}
+	} else {
+		byID := make(map[string]*models.ProviderModel, len(pms))
+		for i := range pms {
+			byID[pms[i].ID] = &pms[i]
+		}
+		vkas, err := p.db.ListVirtualKeyAssignments(ctx, vk.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, vka := range vkas {
+			// Assignments to deleted models cannot be served, so they are not advertised.
+			if pm, ok := byID[vka.ProviderModelID]; ok {
+				add(vka.ModelAlias, pm, vka.CreatedAt.Unix())
+			}
+		}
+	}
+
+	list := make([]ModelInfo, 0, len(byAlias))
+	for _, m := range byAlias {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+const (
+	// maxMultipartBody bounds a spooled upload; OpenAI accepts files of up to 512 MB.
+	maxMultipartBody = 512 << 20
+	// maxFormField bounds the text fields kept in memory for routing and estimation.
+	maxFormField = 64 << 10
+)
+
+var errMultipartTooLarge = errors.New("multipart body exceeds the upload limit")
+
+// isMultipart reports whether contentType is multipart/form-data.
+func isMultipart(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// multipartBody is a multipart/form-data request (audio transcription, file upload) spooled to a
+// temporary file, so uploads are never held in memory yet can be replayed for retries and
+// failover. Its text fields are kept for routing.
+type multipartBody struct {
+	file     *os.File
+	size     int64
+	boundary string
+	fields   map[string]string
+	parts    []formPart
+}
+
+// formPart is the header and raw body size of one part of a spooled form.
+type formPart struct {
+	header   textproto.MIMEHeader
+	name     string
+	fileName string
+	size     int64
+}
+
+// spoolMultipart copies r to a temporary file and reads the form's text fields from it.
+func spoolMultipart(r io.Reader, contentType string) (*multipartBody, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		return nil, fmt.Errorf("invalid multipart content type %q", contentType)
+	}
+	file, err := os.CreateTemp("", "llm-proxy-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	m := &multipartBody{file: file, boundary: params["boundary"], fields: map[string]string{}}
+
+	m.size, err = io.Copy(file, io.LimitReader(r, maxMultipartBody+1))
+	if err == nil && m.size > maxMultipartBody {
+		err = errMultipartTooLarge
+	}
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	// Parts are read raw, as NextPart would decode quoted-printable ones.
+	mr := multipart.NewReader(io.NewSectionReader(file, 0, m.size), m.boundary)
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("invalid multipart body: %v", err)
+		}
+		fp := formPart{header: part.Header, name: part.FormName(), fileName: part.FileName()}
+		if fp.fileName == "" && fp.name != "" {
+			value, _ := io.ReadAll(io.LimitReader(part, maxFormField))
+			m.fields[fp.name] = string(value)
+			fp.size = int64(len(value))
+		}
+		rest, err := io.Copy(io.Discard, part)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("invalid multipart body: %v", err)
+		}
+		fp.size += rest
+		m.parts = append(m.parts, fp)
+	}
+	return m, nil
+}
+
+// fieldMap returns the text fields in the shape of a decoded JSON body.
+func (m *multipartBody) fieldMap() map[string]interface{} {
+	out := make(map[string]interface{}, len(m.fields))
+	for k, v := range m.fields {
+		out[k] = v
+	}
+	return out
+}
+
+// open returns the form to send upstream and its length. Text fields whose value in fields
+// differs from the client's (typically `model`) are rewritten; every other part is streamed from
+// the spool file unchanged, under the original boundary.
+func (m *multipartBody) open(fields map[string]interface{}) (io.ReadCloser, int64) {
+	changed := map[string]string{}
+	for name, original := range m.fields {
+		if v, ok := fields[name].(string); ok && v != original {
+			changed[name] = v
+		}
+	}
+	if len(changed) == 0 {
+		return io.NopCloser(io.NewSectionReader(m.file, 0, m.size)), m.size
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(m.rewrite(pw, changed))
+	}()
+	return pr, m.rewrittenSize(changed)
+}
+
+// rewrittenSize is the length of the form rewrite produces, worked out from the part headers
+// and sizes recorded while spooling rather than by reading the upload again.
+func (m *multipartBody) rewrittenSize(changed map[string]string) int64 {
+	var n byteCounter
+	mw := multipart.NewWriter(&n)
+	mw.SetBoundary(m.boundary)
+	for _, p := range m.parts {
+		mw.CreatePart(p.header)
+		if v, ok := changed[p.name]; ok && p.fileName == "" {
+			n += byteCounter(len(v))
+		} else {
+			n += byteCounter(p.size)
+		}
+	}
+	mw.Close()
+	return int64(n)
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	*c += byteCounter(len(b))
+	return len(b), nil
+}
+
+func (m *multipartBody) rewrite(w io.Writer, changed map[string]string) error {
+	mr := multipart.NewReader(io.NewSectionReader(m.file, 0, m.size), m.boundary)
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(m.boundary); err != nil {
+		return err
+	}
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			return mw.Close()
+		}
+		if err != nil {
+			return err
+		}
+		out, err := mw.CreatePart(textproto.MIMEHeader(part.Header))
+		if err != nil {
+			return err
+		}
+		if v, ok := changed[part.FormName()]; ok && part.FileName() == "" {
+			_, err = io.Copy(out, strings.NewReader(v))
+		} else {
+			_, err = io.Copy(out, part)
+		}
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Close removes the spool file.
+func (m *multipartBody) Close() error {
+	m.file.Close()
+	return os.Remove(m.file.Name())
+}
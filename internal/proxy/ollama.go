@@ -0,0 +1,379 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// APIModeNative selects Ollama's own /api/chat for a ProviderModel instead of its
+// OpenAI-compatible endpoint.
+const APIModeNative = "native"
+
+// OllamaAdapter targets an Ollama server. OpenAI chat completions go to Ollama's
+// OpenAI-compatible /v1 endpoint, or are translated to /api/chat and back when the
+// ProviderModel's APIMode is APIModeNative. Native /api calls pass through unchanged.
+type OllamaAdapter struct {
+	localAdapter
+}
+
+func (a *OllamaAdapter) RewriteRequest(r *UpstreamRequest) error {
+	isChat := r.Path == "v1/chat/completions" || r.Path == "chat/completions"
+	if !isChat || r.Model.APIMode != APIModeNative {
+		if strings.HasPrefix(r.Path, "api/") {
+			// Native routes live beside /v1, not under it.
+			r.BaseURL = strings.TrimSuffix(r.BaseURL, "/v1")
+			return nil
+		}
+		return a.localAdapter.RewriteRequest(r)
+	}
+
+	opts, _ := r.Body["stream_options"].(map[string]interface{})
+	includeUsage, _ := opts["include_usage"].(bool)
+
+	body, err := openAIToOllama(r.Body)
+	if err != nil {
+		return err
+	}
+	body["model"] = remoteModelName(r.Model, r.Alias)
+	// Ollama streams unless told otherwise.
+	body["stream"] = r.Stream
+	r.StripUsageChunk = r.Stream && !includeUsage
+	r.Body = body
+	r.OpenAIResponse = true
+	r.BaseURL = strings.TrimSuffix(r.BaseURL, "/v1")
+	r.Path = "api/chat"
+	return nil
+}
+
+func (a *OllamaAdapter) TransformResponse(resp *http.Response, r *UpstreamRequest) error {
+	if !r.OpenAIResponse {
+		return nil
+	}
+	if r.Stream && resp.StatusCode == http.StatusOK && isNDJSONStream(resp) {
+		replaceWithEventStream(resp, func(upstream io.Reader, w io.Writer) error {
+			return translateOllamaStream(upstream, w, r.Alias)
+		})
+		return nil
+	}
+	return translateJSONResponse(resp, func(body []byte) ([]byte, error) {
+		return ollamaToOpenAI(body, r.Alias)
+	})
+}
+
+// ParseUsage reads `prompt_eval_count`/`eval_count` from native responses and the final line of
+// native streams, or OpenAI-style usage from the compatible endpoint and translated responses.
+func (a *OllamaAdapter) ParseUsage(body []byte) (Usage, bool) {
+	if u, ok := parseOpenAIUsage(body); ok && u.Total() > 0 {
+		return u, true
+	}
+	var resp ollamaChatResponse
+	if err := json.Unmarshal(body, &resp); err != nil || !resp.Done {
+		return Usage{}, false
+	}
+	return resp.usage(), true
+}
+
+// ListModels returns the models pulled on the server, as listed by /api/tags.
+func (a *OllamaAdapter) ListModels(ctx context.Context, conn *models.Connection) ([]string, error) {
+	var tags struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(conn.Endpoint, "/"), "/v1")
+	if err := a.getJSON(ctx, conn, base+"/api/tags", &tags); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(tags.Models))
+	for _, m := range tags.Models {
+		names = append(names, m.Name)
+	}
+	return names, nil
+}
+
+// openAIToOllama converts an OpenAI chat completion request body into an Ollama /api/chat
+// request. The model and stream fields are left for the caller to set.
+func openAIToOllama(body map[string]interface{}) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+
+	var messages []interface{}
+	// Tool results should name the function; OpenAI only gives the call ID.
+	callNames := map[string]interface{}{}
+	rawMessages, _ := body["messages"].([]interface{})
+	for i, raw := range rawMessages {
+		msg, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("messages[%d] is not an object", i)
+		}
+		role, _ := msg["role"].(string)
+		converted := map[string]interface{}{"role": role, "content": textContent(msg["content"])}
+		switch role {
+		case "system", "developer":
+			converted["role"] = "system"
+		case "user", "assistant":
+			images, err := ollamaImages(msg["content"])
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d]: %v", i, err)
+			}
+			if len(images) > 0 {
+				converted["images"] = images
+			}
+			calls, _ := msg["tool_calls"].([]interface{})
+			var toolCalls []interface{}
+			for _, c := range calls {
+				call, _ := c.(map[string]interface{})
+				fn, _ := call["function"].(map[string]interface{})
+				var args interface{} = map[string]interface{}{}
+				if s, _ := fn["arguments"].(string); s != "" {
+					if err := json.Unmarshal([]byte(s), &args); err != nil {
+						return nil, fmt.Errorf("messages[%d]: tool call arguments are not valid JSON", i)
+					}
+				}
+				if id, _ := call["id"].(string); id != "" {
+					callNames[id] = fn["name"]
+				}
+				toolCalls = append(toolCalls, map[string]interface{}{"function": map[string]interface{}{"name": fn["name"], "arguments": args}})
+			}
+			if len(toolCalls) > 0 {
+				converted["tool_calls"] = toolCalls
+			}
+		case "tool":
+			id, _ := msg["tool_call_id"].(string)
+			if name, ok := callNames[id]; ok {
+				converted["tool_name"] = name
+			}
+		default:
+			return nil, fmt.Errorf("messages[%d]: unsupported role %q", i, role)
+		}
+		messages = append(messages, converted)
+	}
+	out["messages"] = messages
+
+	// Ollama accepts tools in the OpenAI shape.
+	if tools, ok := body["tools"]; ok {
+		out["tools"] = tools
+	}
+
+	options := map[string]interface{}{}
+	if v, ok := body["max_completion_tokens"]; ok {
+		options["num_predict"] = v
+	} else if v, ok := body["max_tokens"]; ok {
+		options["num_predict"] = v
+	}
+	for _, key := range []string{"temperature", "top_p", "top_k", "seed", "presence_penalty", "frequency_penalty"} {
+		if v, ok := body[key]; ok {
+			options[key] = v
+		}
+	}
+	switch stop := body["stop"].(type) {
+	case string:
+		options["stop"] = []interface{}{stop}
+	case []interface{}:
+		options["stop"] = stop
+	}
+	if len(options) > 0 {
+		out["options"] = options
+	}
+
+	if format, _ := body["response_format"].(map[string]interface{}); format != nil {
+		switch format["type"] {
+		case "json_object":
+			out["format"] = "json"
+		case "json_schema":
+			out["format"] = "json"
+			if js, _ := format["json_schema"].(map[string]interface{}); js != nil && js["schema"] != nil {
+				out["format"] = js["schema"]
+			}
+		}
+	}
+	return out, nil
+}
+
+// ollamaImages collects the base64 images of OpenAI message content.
+func ollamaImages(content interface{}) ([]interface{}, error) {
+	parts, _ := content.([]interface{})
+	var images []interface{}
+	for _, p := range parts {
+		part, _ := p.(map[string]interface{})
+		if part["type"] != "image_url" {
+			continue
+		}
+		var url string
+		switch iu := part["image_url"].(type) {
+		case string:
+			url = iu
+		case map[string]interface{}:
+			url, _ = iu["url"].(string)
+		}
+		_, data, ok := parseDataURL(url)
+		if !ok {
+			return nil, fmt.Errorf("images must be given as base64 data: URLs")
+		}
+		images = append(images, data)
+	}
+	return images, nil
+}
+
+// ollamaChatResponse is an /api/chat response or one line of its stream.
+type ollamaChatResponse struct {
+	Message struct {
+		Content   string `json:"content"`
+		ToolCalls []struct {
+			Function struct {
+				Name      string          `json:"name"`
+				Arguments json.RawMessage `json:"arguments"`
+			} `json:"function"`
+		} `json:"tool_calls"`
+	} `json:"message"`
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason"`
+	PromptEvalCount int64  `json:"prompt_eval_count"`
+	EvalCount       int64  `json:"eval_count"`
+	Error           string `json:"error"`
+}
+
+func (r ollamaChatResponse) usage() Usage {
+	return Usage{PromptTokens: r.PromptEvalCount, CompletionTokens: r.EvalCount}
+}
+
+// toolCalls returns the message's tool calls in OpenAI form, numbering IDs from offset since
+// Ollama does not assign any.
+func (r ollamaChatResponse) toolCalls(offset int) []interface{} {
+	var calls []interface{}
+	for _, c := range r.Message.ToolCalls {
+		args := string(c.Function.Arguments)
+		if args == "" || args == "null" {
+			args = "{}"
+		}
+		calls = append(calls, map[string]interface{}{
+			"id":       fmt.Sprintf("call_%d", offset+len(calls)),
+			"type":     "function",
+			"function": map[string]interface{}{"name": c.Function.Name, "arguments": args},
+		})
+	}
+	return calls
+}
+
+// ollamaFinishReason maps Ollama's done_reason onto OpenAI's finish_reason values.
+func ollamaFinishReason(doneReason string, hasToolCalls bool) string {
+	switch {
+	case hasToolCalls:
+		return "tool_calls"
+	case doneReason == "length":
+		return "length"
+	}
+	return "stop"
+}
+
+// ollamaToOpenAI converts an /api/chat response into an OpenAI chat completion reported under
+// the model name the client used.
+func ollamaToOpenAI(body []byte, model string) ([]byte, error) {
+	var resp ollamaChatResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	calls := resp.toolCalls(0)
+	message := map[string]interface{}{"role": "assistant", "content": nil}
+	if resp.Message.Content != "" {
+		message["content"] = resp.Message.Content
+	}
+	if len(calls) > 0 {
+		message["tool_calls"] = calls
+	}
+	return json.Marshal(map[string]interface{}{
+		"id":      "chatcmpl-" + models.NewID(),
+		"object":  "chat.completion",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []interface{}{map[string]interface{}{
+			"index":         0,
+			"message":       message,
+			"finish_reason": ollamaFinishReason(resp.DoneReason, len(calls) > 0),
+		}},
+		"usage": newOpenAIUsage(resp.usage()),
+	})
+}
+
+// isNDJSONStream reports whether the upstream answered with newline-delimited JSON, the
+// streaming format of Ollama's native API.
+func isNDJSONStream(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-ndjson"
+}
+
+// translateOllamaStream reads an /api/chat NDJSON stream and writes it out as OpenAI
+// server-sent events, ending with [DONE].
+func translateOllamaStream(upstream io.Reader, w io.Writer, model string) error {
+	c := newChunkBuilder(model)
+	emit := func(chunks [][]byte, err error) error {
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			if err := writeEvent(w, chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := emit(c.chunk(map[string]interface{}{"role": "assistant", "content": ""}, nil)); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(upstream, 64*1024)
+	toolCalls := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			var resp ollamaChatResponse
+			if jerr := json.Unmarshal(line, &resp); jerr != nil {
+				return jerr
+			}
+			if resp.Error != "" {
+				out, _ := json.Marshal(map[string]interface{}{"error": map[string]string{"type": "upstream_error", "message": resp.Error}})
+				return writeEvent(w, out)
+			}
+			delta := map[string]interface{}{}
+			if resp.Message.Content != "" {
+				delta["content"] = resp.Message.Content
+			}
+			if calls := resp.toolCalls(toolCalls); len(calls) > 0 {
+				for i, call := range calls {
+					call.(map[string]interface{})["index"] = toolCalls + i
+				}
+				toolCalls += len(calls)
+				delta["tool_calls"] = calls
+			}
+			if len(delta) > 0 {
+				if err := emit(c.chunk(delta, nil)); err != nil {
+					return err
+				}
+			}
+			if resp.Done {
+				reason := ollamaFinishReason(resp.DoneReason, toolCalls > 0)
+				if err := emit(c.chunk(map[string]interface{}{}, &reason)); err != nil {
+					return err
+				}
+				if err := emit(c.usageChunk(resp.usage())); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return writeEvent(w, []byte("[DONE]"))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+// OpenAIAdapter forwards requests unchanged with a Bearer key. It is also the default for
+// unknown providers.
+type OpenAIAdapter struct{}
+
+func (a *OpenAIAdapter) RewriteRequest(r *UpstreamRequest) error {
+	// Streamed chat completions only report usage when asked to, so ask on the client's behalf.
+	if r.Stream && strings.HasSuffix(r.Path, "chat/completions") {
+		opts, _ := r.Body["stream_options"].(map[string]interface{})
+		if opts == nil {
+			opts = map[string]interface{}{}
+		}
+		if include, _ := opts["include_usage"].(bool); !include {
+			opts["include_usage"] = true
+			r.SetField("stream_options", opts)
+			r.StripUsageChunk = true
+		}
+	}
+	return nil
+}
+
+func (a *OpenAIAdapter) SetAuth(req *http.Request, conn *models.Connection) error {
+	req.Header.Set("Authorization", "Bearer "+conn.APIKey)
+	return nil
+}
+
+func (a *OpenAIAdapter) TransformResponse(resp *http.Response, r *UpstreamRequest) error {
+	return nil
+}
+
+func (a *OpenAIAdapter) ParseUsage(body []byte) (Usage, bool) {
+	return parseOpenAIUsage(body)
+}
+
+// parseOpenAIUsage reads the `usage` block of an OpenAI response or stream chunk.
+func parseOpenAIUsage(body []byte) (Usage, bool) {
+	var payload struct {
+		Usage *struct {
+			PromptTokens        int64 `json:"prompt_tokens"`
+			CompletionTokens    int64 `json:"completion_tokens"`
+			PromptTokensDetails struct {
+				CachedTokens int64 `json:"cached_tokens"`
+			} `json:"prompt_tokens_details"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Usage == nil {
+		return Usage{}, false
+	}
+	u := payload.Usage
+	return Usage{PromptTokens: u.PromptTokens, CompletionTokens: u.CompletionTokens, CachedPromptTokens: u.PromptTokensDetails.CachedTokens}, true
+}
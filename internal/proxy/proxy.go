@@ -2,69 +2,115 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/budget"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/cache"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/ratelimit"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/router"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/tokencount"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/usage"
 )
 
 type Proxy struct {
 	db               db.DB
 	ratelimitManager *ratelimit.Manager
+	usage            *usage.Recorder
+	budgets          *budget.Tracker
+	router           *router.Router
+	retry            RetryPolicy
+	cache            cache.Store
 }
 
 func NewProxy(database db.DB) *Proxy {
+	recorder := usage.NewRecorder(database, usage.DefaultBatchSize, usage.DefaultFlushInterval)
 	return &Proxy{
 		db:               database,
 		ratelimitManager: ratelimit.NewManager(),
+		usage:            recorder,
+		budgets:          budget.NewTracker(database, recorder),
+		router:           router.New(),
+		retry:            RetryPolicyFromEnv(),
+		cache:            cache.FromEnv(database),
 	}
 }
 
+// Close flushes usage records that are still queued. Call it once the server stops serving.
+func (p *Proxy) Close() {
+	p.usage.Close()
+}
+
 func (p *Proxy) HandleProxy(c *gin.Context) {
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid authorization header"})
+	vk, isMaster, ok := p.authenticate(c)
+	if !ok {
 		return
 	}
-	rawKey := strings.TrimPrefix(authHeader, "Bearer ")
 
-	// Check for Master Key (if configured in environment)
-	masterKey := os.Getenv("MASTER_KEY")
-	isMaster := masterKey != "" && rawKey == masterKey
-
-	var vk *models.VirtualKey
-	var err error
+	// Spend budget (per key, across all models)
+	status, err := p.budgets.Check(c.Request.Context(), vk)
+	if err != nil {
+		// Without its spend the budget cannot be enforced, so the request is refused.
+		log.Printf("failed to load budget for key %s: %v", vk.ID, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to load budget", "details": err.Error()})
+		return
+	}
+	if status.Exceeded() {
+		c.JSON(http.StatusPaymentRequired, gin.H{
+			"error":     "Budget exceeded",
+			"budget":    status.Amount,
+			"spent":     status.Spent,
+			"period":    status.Period,
+			"resets_at": status.End,
+		})
+		return
+	}
+	if status.Warn() {
+		c.Writer.Header().Set(budgetWarningHeader, status.String())
+	}
 
-	if isMaster {
-		// Create a synthetic Virtual Key for master access
-		vk = &models.VirtualKey{
-			ID:   "master-id",
-			Name: "Master Key",
-			Key:  rawKey,
+	// Read body to identify requested model alias. Uploads are spooled to disk instead and routed
+	// by their `model` form field.
+	var body []byte
+	var form *multipartBody
+	var bodyObj map[string]interface{}
+	if isMultipart(c.GetHeader("Content-Type")) {
+		form, err = spoolMultipart(c.Request.Body, c.GetHeader("Content-Type"))
+		switch {
+		case errors.Is(err, errMultipartTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return
+		case err != nil:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body", "details": err.Error()})
+			return
 		}
+		defer form.Close()
+		bodyObj = form.fieldMap()
 	} else {
-		vk, err = p.db.GetVirtualKey(c.Request.Context(), rawKey)
+		body, err = io.ReadAll(c.Request.Body)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid virtual key"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
 			return
 		}
+		// Bodies of other types are forwarded as they are; JSON must parse so it is never sent
+		// upstream mangled.
+		if ct := c.GetHeader("Content-Type"); len(body) > 0 && (ct == "" || isJSONMediaType(ct)) {
+			if err := json.Unmarshal(body, &bodyObj); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Request body must be a JSON object", "details": err.Error()})
+				return
+			}
+		}
 	}
-
-	// Read body to identify requested model alias
-	body, err := io.ReadAll(c.Request.Body)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
-		return
-	}
-
-	var bodyObj map[string]interface{}
-	json.Unmarshal(body, &bodyObj)
 	modelAlias, _ := bodyObj["model"].(string)
 
 	// Fallback: Try to extract model from URL if not in body (common in Gemini/Bedrock SDKs)
@@ -88,36 +134,52 @@ func (p *Proxy) HandleProxy(c *gin.Context) {
 		return
 	}
 
-	var pm *models.ProviderModel
-	var vka *models.VirtualKeyAssignment
+	// Resolve the alias to its pool of deployments
+	var pool []router.Deployment
+	var strategy string
 
 	if isMaster {
-		// Master key bypasses assignments. Try to find model directly by name/alias.
-		pm, err = p.db.GetProviderModelByName(c.Request.Context(), modelAlias)
-		if err != nil {
+		// Master key bypasses assignments. Every model registered under the name joins the pool.
+		pms, err := p.db.ListProviderModelsByName(c.Request.Context(), modelAlias)
+		if err != nil || len(pms) == 0 {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Model not found: " + modelAlias})
 			return
 		}
+		for i := range pms {
+			pool = append(pool, router.Deployment{Model: &pms[i]})
+		}
 	} else {
-		// Get assignment for this virtual key and model alias
-		vka, err = p.db.GetVirtualKeyAssignment(c.Request.Context(), vk.ID, modelAlias)
-		if err != nil {
+		// Get assignments for this virtual key and model alias
+		vkas, err := p.db.ListVirtualKeyAssignmentsByAlias(c.Request.Context(), vk.ID, modelAlias)
+		if err != nil || len(vkas) == 0 {
 			c.JSON(http.StatusForbidden, gin.H{"error": "Virtual key not authorized for model: " + modelAlias})
 			return
 		}
 
-		// Get the actual provider model
-		pm, err = p.db.GetProviderModel(c.Request.Context(), vka.ProviderModelID)
-		if err != nil {
+		// Get the actual provider models
+		for i := range vkas {
+			pm, err := p.db.GetProviderModel(c.Request.Context(), vkas[i].ProviderModelID)
+			if err != nil {
+				log.Printf("assignment %s points to missing model %s: %v", vkas[i].ID, vkas[i].ProviderModelID, err)
+				continue
+			}
+			pool = append(pool, router.Deployment{Model: pm, Assignment: &vkas[i], Weight: vkas[i].Weight})
+			if strategy == "" {
+				strategy = vkas[i].Strategy
+			}
+		}
+		if len(pool) == 0 {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Target model not found"})
 			return
 		}
 	}
 
-	// Get credentials
-	conn, err := p.db.GetConnection(c.Request.Context(), pm.ConnectionID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Provider connection not found"})
+	// Limits are shared by the whole pool and come from its oldest assignment.
+	vka := pool[0].Assignment
+	// The router's pick comes first, the rest of the pool and then configured fallbacks follow.
+	candidates := p.withFallbacks(c.Request.Context(), p.router.Order(vk.ID+":"+modelAlias, strategy, pool))
+	if len(candidates) == 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "No healthy upstream for model: " + modelAlias})
 		return
 	}
 
@@ -135,139 +197,497 @@ func (p *Proxy) HandleProxy(c *gin.Context) {
 		return
 	}
 
-	if !limiter.AllowTokens(1) {
-		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Token limit exceeded"})
-		return
+	// Deterministic requests may be answered from the response cache, which costs no tokens.
+	policy := cachePolicyFor(c, vk, form, bodyObj)
+	var cacheKey string
+	if policy.lookup || policy.store {
+		cacheKey = requestCacheKey(c, vk, pool, bodyObj)
+	}
+	if policy.lookup {
+		start := time.Now()
+		entry, err := p.cache.Get(c.Request.Context(), cacheKey)
+		if err != nil {
+			log.Printf("response cache lookup failed: %v", err)
+		}
+		if entry != nil {
+			replayCached(c, entry)
+			p.usage.Record(models.UsageRecord{
+				VirtualKeyID:    vk.ID,
+				ModelAlias:      modelAlias,
+				ProviderModelID: candidates[0].Model.ID,
+				ConnectionID:    candidates[0].Model.ConnectionID,
+				StatusCode:      http.StatusOK,
+				LatencyMs:       time.Since(start).Milliseconds(),
+			})
+			return
+		}
 	}
 
-	// Prepare target path and check for model replacement in URL
-	targetURLStr := strings.TrimSuffix(conn.Endpoint, "/")
-	targetPath := strings.TrimPrefix(c.Request.URL.Path, "/")
+	// Reserve the estimated prompt plus max output up front so one oversized request cannot
+	// overrun the budget; the reservation is reconciled with the reported usage afterwards.
+	estimate := tokencount.EstimateRequest(remoteModelName(candidates[0].Model, modelAlias), bodyObj)
+	reservation, ok := limiter.ReserveTokens(estimate)
+	if !ok {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Token limit exceeded", "estimated_tokens": estimate})
+		return
+	}
+	// Refund everything if the request fails before a response is relayed, bar the tokens of
+	// embeddings batches that were billed although their request failed.
+	var discarded int64
+	defer func() { reservation.Settle(discarded) }()
+
+	// Retry each deployment with backoff, then fail over to the next candidate. Nothing has been
+	// written to the client yet, so every attempt can still be thrown away; once relaying starts
+	// below, the request is committed to that attempt.
+	ctx := c.Request.Context()
+	var final *attempt
+	var lastErr *attemptError
+candidates:
+	for i, dep := range candidates {
+		if i > 0 {
+			log.Printf("failing over %s to model %s", modelAlias, dep.Model.ID)
+		}
+		for try := 0; ; try++ {
+			var a *attempt
+			var err *attemptError
+			if form == nil && isEmbeddingsRequest(c.Request.URL.Path) {
+				a, err = p.sendEmbeddings(c, body, modelAlias, vk, dep)
+			} else {
+				a, err = p.send(c, body, form, modelAlias, vk, dep)
+			}
+			if err != nil {
+				discarded += err.discardedTokens
+				lastErr = err
+				if !err.retryable {
+					continue candidates
+				}
+			} else {
+				discarded += a.discardedTokens
+				if final != nil {
+					p.discard(final)
+				}
+				final = a
+				if !isRetryableStatus(a.resp.StatusCode) {
+					break candidates
+				}
+			}
+			if ctx.Err() != nil {
+				break candidates
+			}
+			if try >= p.retry.MaxRetries {
+				continue candidates
+			}
+			var resp *http.Response
+			if a != nil {
+				resp = a.resp
+			}
+			delay, ok := p.retry.backoff(try, resp)
+			if !ok {
+				continue candidates
+			}
+			if !sleep(ctx, delay) {
+				break candidates
+			}
+		}
+	}
 
-	if pm.RemoteModel != "" && pm.RemoteModel != modelAlias {
-		// 1. Rewrite in body ONLY if it existed (OpenAI style)
-		if _, exists := bodyObj["model"]; exists {
-			bodyObj["model"] = pm.RemoteModel
+	if ctx.Err() != nil {
+		// The client is gone; there is nobody left to answer.
+		if final != nil {
+			p.discard(final)
 		}
+		return
+	}
+	if final == nil {
+		c.JSON(lastErr.status, gin.H{"error": lastErr.msg, "details": lastErr.Error()})
+		return
+	}
+	defer final.resp.Body.Close()
+	defer final.done(final.ttfb)
+	resp, ureq, adapter := final.resp, final.ureq, final.adapter
+
+	// Merged embeddings batches were already translated as they were merged.
+	if !final.transformed {
+		if err := adapter.TransformResponse(resp, ureq); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to process LLM provider response", "details": err.Error()})
+			return
+		}
+	}
 
-		// 2. Rewrite in URL path (Native Gemini/Vertex style)
-		targetPath = strings.Replace(targetPath, modelAlias, pm.RemoteModel, 1)
+	for k, v := range resp.Header {
+		c.Writer.Header()[k] = v
 	}
 
-	// Build raw query. We merge existing endpoint query with request query.
-	rawQuery := c.Request.URL.RawQuery
+	var capture *cacheWriter
+	if policy.lookup || policy.store {
+		c.Writer.Header().Set(cacheHeader, "MISS")
+		if policy.store && resp.StatusCode == http.StatusOK {
+			capture = &cacheWriter{ResponseWriter: c.Writer}
+			c.Writer = capture
+		}
+	}
 
-	// Provider-specific routing logic
-	switch conn.Provider {
-	case "aws":
-		// AWS Bedrock (Claude) often expects /model/MODEL_ID/invoke or similar
-		if targetPath == "v1/chat/completions" || targetPath == "chat/completions" {
-			targetPath = "model/" + pm.RemoteModel + "/invoke"
+	used, ok, relayErr := p.relayResponse(c, resp, adapter, ureq)
+	if final.usage != nil {
+		used, ok = *final.usage, true
+	}
+	// Only responses that reached the client in full are cached.
+	if capture != nil && relayErr == nil && !capture.overflow && ctx.Err() == nil {
+		entry := &cache.Entry{ContentType: c.Writer.Header().Get("Content-Type"), Body: capture.buf.Bytes()}
+		if err := p.cache.Set(ctx, cacheKey, entry, policy.ttl); err != nil {
+			log.Printf("failed to cache response: %v", err)
 		}
+	}
+	switch {
+	case ok:
+		reservation.Settle(used.Total() + discarded)
+	case resp.StatusCode < http.StatusBadRequest:
+		// Successful but no usage reported: the estimate is the best figure we have.
+		reservation.Settle(estimate + discarded)
+	}
 
-		// Claude on Bedrock does NOT want 'model' in the JSON body
-		delete(bodyObj, "model")
+	record := final.record
+	record.StatusCode = resp.StatusCode
+	record.LatencyMs = time.Since(final.start).Milliseconds()
+	record.PromptTokens = used.PromptTokens
+	record.CompletionTokens = used.CompletionTokens
+	record.CachedTokens = used.CachedPromptTokens
+	record.CostUSD = computeCost(ureq.Model, used)
+	p.usage.Record(record)
+	p.budgets.Add(vk, record.CostUSD)
+}
 
-		// Ensure max_tokens is present (Claude required)
-		if _, ok := bodyObj["max_tokens"]; !ok {
-			bodyObj["max_tokens"] = 4096
+// authenticate resolves the caller's virtual key, answering 401 itself when there is none. The
+// master key yields a synthetic key that bypasses assignments.
+func (p *Proxy) authenticate(c *gin.Context) (vk *models.VirtualKey, isMaster bool, ok bool) {
+	authHeader := c.GetHeader("Authorization")
+	rawKey, ok := strings.CutPrefix(authHeader, "Bearer ")
+	if !ok || rawKey == "" {
+		// Anthropic SDKs send their key as x-api-key, Gemini SDKs as x-goog-api-key.
+		rawKey = c.GetHeader("x-api-key")
+		if rawKey == "" {
+			rawKey = c.GetHeader("x-goog-api-key")
 		}
+	}
+	if rawKey == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid authorization header"})
+		return nil, false, false
+	}
 
-		// Some versions of Bedrock Claude expect anthropic_version in body
-		bodyObj["anthropic_version"] = "bedrock-2023-05-31"
-	case "azure":
-		// Map OpenAI-style path to Azure Foundry path if it matches
-		if targetPath == "v1/chat/completions" {
-			targetPath = "models/chat/completions"
-		}
-		// If api-version isn't in endpoint or query, add default
-		if !strings.Contains(targetURLStr, "api-version=") && !strings.Contains(rawQuery, "api-version=") {
-			if rawQuery == "" {
-				rawQuery = "api-version=2024-05-01-preview"
-			} else {
-				rawQuery += "&api-version=2024-05-01-preview"
+	// Check for Master Key (if configured in environment)
+	masterKey := os.Getenv("MASTER_KEY")
+	if masterKey != "" && rawKey == masterKey {
+		// Create a synthetic Virtual Key for master access
+		return &models.VirtualKey{
+			ID:   "master-id",
+			Name: "Master Key",
+			Key:  rawKey,
+		}, true, true
+	}
+
+	vk, err := p.db.GetVirtualKey(c.Request.Context(), rawKey)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid virtual key"})
+		return nil, false, false
+	}
+	return vk, false, true
+}
+
+// maxFallbackDepth bounds how many FallbackModelID links are followed from one deployment.
+const maxFallbackDepth = 4
+
+// withFallbacks appends the fallback chain of every deployment to the ordered pool, skipping
+// models that are already candidates.
+func (p *Proxy) withFallbacks(ctx context.Context, ordered []router.Deployment) []router.Deployment {
+	seen := make(map[string]bool, len(ordered))
+	for _, d := range ordered {
+		seen[d.Model.ID] = true
+	}
+	candidates := ordered
+	for _, d := range ordered {
+		id := d.Model.FallbackModelID
+		for depth := 0; id != "" && depth < maxFallbackDepth; depth++ {
+			if seen[id] {
+				break
 			}
+			seen[id] = true
+			pm, err := p.db.GetProviderModel(ctx, id)
+			if err != nil {
+				log.Printf("fallback model %s of %s not found: %v", id, d.Model.ID, err)
+				break
+			}
+			if fb := (router.Deployment{Model: pm}); p.router.Available(fb) {
+				candidates = append(candidates, fb)
+			}
+			id = pm.FallbackModelID
 		}
-	case "google":
-		// Handle path mapping:
-		// Convert Vertex-style path to AI Studio-style if the endpoint is AI Studio.
-		isVertex := strings.Contains(targetURLStr, "aiplatform.googleapis.com")
-		if !isVertex {
-			targetPath = strings.Replace(targetPath, "publishers/google/", "", 1)
-		}
+	}
+	return candidates
+}
 
-		// Google AI Studio OpenAI-compatible endpoint doesn't want the /v1/ prefix
-		if strings.HasSuffix(targetURLStr, "/openai") && strings.HasPrefix(targetPath, "v1/") {
-			targetPath = strings.TrimPrefix(targetPath, "v1/")
-		}
+// attempt is one upstream call made on behalf of a client request.
+type attempt struct {
+	ureq    *UpstreamRequest
+	adapter ProviderAdapter
+	resp    *http.Response
+	record  models.UsageRecord
+	start   time.Time
+	ttfb    time.Duration
+	done    func(time.Duration)
+
+	// transformed is set when resp is already in the client's protocol, and usage when the proxy
+	// assembled resp itself and knows its usage, as for merged embeddings batches.
+	transformed bool
+	usage       *Usage
+	// discardedTokens were used by sibling embeddings batches that were billed and thrown away.
+	discardedTokens int64
+}
 
-		// Strip client's 'key' param and inject our own
-		params := strings.Split(rawQuery, "&")
-		var newParams []string
-		for _, p := range params {
-			if !strings.HasPrefix(p, "key=") && p != "" {
-				newParams = append(newParams, p)
-			}
+// attemptError explains why a deployment could not be called. Transport failures are retryable;
+// configuration problems such as a missing connection move straight on to the next candidate.
+type attemptError struct {
+	status    int
+	msg       string
+	err       error
+	retryable bool
+	// discardedTokens were used by sibling embeddings batches that were billed and thrown away.
+	discardedTokens int64
+}
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+func (e *attemptError) Error() string {
+	return e.err.Error()
+}
+
+// send forwards the client's request to one deployment. The body is decoded afresh for every
+// attempt, so rewrites made for one provider never leak into the request sent to another.
+// Multipart requests come as form instead of body; adapters see their text fields as Body.
+func (p *Proxy) send(c *gin.Context, body []byte, form *multipartBody, alias string, vk *models.VirtualKey, dep router.Deployment) (*attempt, *attemptError) {
+	pm := dep.Model
+
+	// Get credentials
+	conn, err := p.db.GetConnection(c.Request.Context(), pm.ConnectionID)
+	if err != nil {
+		return nil, &attemptError{status: http.StatusInternalServerError, msg: "Provider connection not found", err: err}
+	}
+
+	// Adapters edit a fresh copy of the body on every attempt.
+	var bodyObj map[string]interface{}
+	if form != nil {
+		bodyObj = form.fieldMap()
+	} else if len(body) > 0 {
+		bodyObj, _ = decodeJSONBody(body)
+	}
+
+	// Prepare target path and check for model replacement in URL
+	ureq := &UpstreamRequest{
+		Connection: conn,
+		Model:      pm,
+		Alias:      alias,
+		BaseURL:    strings.TrimSuffix(conn.Endpoint, "/"),
+		Path:       strings.TrimPrefix(c.Request.URL.Path, "/"),
+		RawQuery:   c.Request.URL.RawQuery,
+		Body:       bodyObj,
+		Stream:     isStreamingRequest(c.Request.URL.Path, bodyObj),
+		clientBody: bodyObj,
+	}
+
+	if pm.RemoteModel != "" && pm.RemoteModel != alias {
+		// 1. Rewrite in body ONLY if it existed (OpenAI style)
+		if _, exists := ureq.Body["model"]; exists {
+			ureq.SetField("model", pm.RemoteModel)
 		}
-		newParams = append(newParams, "key="+conn.APIKey)
-		rawQuery = strings.Join(newParams, "&")
+
+		// 2. Rewrite in URL path (Native Gemini/Vertex style)
+		ureq.Path = strings.Replace(ureq.Path, alias, pm.RemoteModel, 1)
 	}
 
-	body, _ = json.Marshal(bodyObj)
+	// Provider-specific routing logic
+	adapter := LookupAdapter(conn.Provider)
+	if err := adapter.RewriteRequest(ureq); err != nil {
+		return nil, &attemptError{status: http.StatusBadRequest, msg: err.Error(), err: err}
+	}
 
-	// Final URL Construction
-	finalURL := targetURLStr + "/" + targetPath
-	if rawQuery != "" {
-		if strings.Contains(finalURL, "?") {
-			finalURL += "&" + rawQuery
-		} else {
-			finalURL += "?" + rawQuery
+	// openBody can be called repeatedly, e.g. by SigV4 signing through req.GetBody.
+	var openBody func() (io.ReadCloser, int64)
+	if form != nil {
+		openBody = func() (io.ReadCloser, int64) { return form.open(ureq.Body) }
+	} else {
+		encoded, err := ureq.encodeBody(body)
+		if err != nil {
+			return nil, &attemptError{status: http.StatusInternalServerError, msg: "Failed to encode request", err: err}
+		}
+		openBody = func() (io.ReadCloser, int64) {
+			return io.NopCloser(bytes.NewReader(encoded)), int64(len(encoded))
 		}
 	}
+	upstreamBody, contentLength := openBody()
 
-	req, err := http.NewRequest(c.Request.Method, finalURL, bytes.NewReader(body))
+	// Bind the upstream call to the client's context so a disconnect cancels it.
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, ureq.URL(), upstreamBody)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
-		return
+		upstreamBody.Close()
+		return nil, &attemptError{status: http.StatusInternalServerError, msg: "Failed to create request", err: err}
+	}
+	req.ContentLength = contentLength
+	req.GetBody = func() (io.ReadCloser, error) {
+		b, _ := openBody()
+		return b, nil
 	}
 
 	for k, v := range c.Request.Header {
 		lowerK := strings.ToLower(k)
-		if lowerK == "authorization" || lowerK == "host" || lowerK == "api-key" {
+		// Accept-Encoding is left to the transport so compressed streams are decoded before relaying.
+		if lowerK == "authorization" || lowerK == "host" || lowerK == "api-key" || lowerK == "x-api-key" || lowerK == "x-goog-api-key" || lowerK == "accept-encoding" || lowerK == "x-llm-proxy-cache" {
 			continue
 		}
 		req.Header[k] = v
 	}
 
-	switch conn.Provider {
-	case "azure":
-		req.Header.Set("api-key", conn.APIKey)
-		req.Header.Set("Authorization", "Bearer "+conn.APIKey)
-	case "google":
-		req.Header.Set("x-goog-api-key", conn.APIKey)
-		// Only use Bearer auth if it's an OAuth token (starts with ya29).
-		// API Keys (like Vertex API keys starting with AQ.) should not use Bearer.
-		if strings.HasPrefix(conn.APIKey, "ya29.") {
-			req.Header.Set("Authorization", "Bearer "+conn.APIKey)
-		}
-	case "aws":
-		req.Header.Set("anthropic-version", "bedrock-2023-05-31")
-		req.Header.Set("Authorization", "Bearer "+conn.APIKey)
-	default:
-		req.Header.Set("Authorization", "Bearer "+conn.APIKey)
+	if err := adapter.SetAuth(req, conn); err != nil {
+		req.Body.Close()
+		return nil, &attemptError{status: http.StatusInternalServerError, msg: "Failed to authenticate with LLM provider", err: err}
+	}
+
+	// The breaker may have opened since the pool was ordered, e.g. during our own retries.
+	br := p.router.Breaker(conn.ID)
+	if !br.Allow() {
+		req.Body.Close()
+		return nil, &attemptError{status: http.StatusServiceUnavailable, msg: "Upstream connection is unavailable", err: errCircuitOpen}
+	}
+
+	a := &attempt{
+		ureq:    ureq,
+		adapter: adapter,
+		record: models.UsageRecord{
+			VirtualKeyID:    vk.ID,
+			ModelAlias:      alias,
+			ProviderModelID: pm.ID,
+			ConnectionID:    conn.ID,
+		},
+		start: time.Now(),
+		done:  p.router.Begin(dep),
 	}
 
-	client := &http.Client{}
+	client := http.DefaultClient
+	if cp, ok := adapter.(HTTPClientProvider); ok {
+		client = cp.HTTPClient()
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to call LLM provider", "details": err.Error()})
-		return
+		a.done(0)
+		if c.Request.Context().Err() != nil {
+			// The client went away; that says nothing about the upstream.
+			br.Release()
+		} else {
+			br.Record(false)
+		}
+		a.record.StatusCode = http.StatusBadGateway
+		a.record.LatencyMs = time.Since(a.start).Milliseconds()
+		p.usage.Record(a.record)
+		return nil, &attemptError{status: http.StatusBadGateway, msg: "Failed to call LLM provider", err: err, retryable: true}
 	}
-	defer resp.Body.Close()
+	a.resp = resp
+	br.Record(resp.StatusCode < http.StatusInternalServerError)
+	// Latency for routing is time to first byte, so long streams do not count against a deployment.
+	a.ttfb = time.Since(a.start)
+	return a, nil
+}
 
-	for k, v := range resp.Header {
-		c.Writer.Header()[k] = v
+// discard records an attempt whose response will not be relayed and releases its connection.
+func (p *Proxy) discard(a *attempt) {
+	a.done(a.ttfb)
+	io.Copy(io.Discard, io.LimitReader(a.resp.Body, maxBufferedBody))
+	a.resp.Body.Close()
+	a.record.StatusCode = a.resp.StatusCode
+	a.record.LatencyMs = time.Since(a.start).Milliseconds()
+	p.usage.Record(a.record)
+}
+
+// remoteModelName is the provider-side model name, used to pick a token estimate.
+func remoteModelName(pm *models.ProviderModel, alias string) string {
+	if pm.RemoteModel != "" {
+		return pm.RemoteModel
+	}
+	return alias
+}
+
+// relayResponse writes the upstream response to the client and returns the token usage the
+// provider reported in it, if any, and why the response could not be relayed in full.
+func (p *Proxy) relayResponse(c *gin.Context, resp *http.Response, adapter ProviderAdapter, ureq *UpstreamRequest) (Usage, bool, error) {
+	if isEventStream(resp) {
+		c.Writer.Header().Set("Trailer", costHeader)
+		var total Usage
+		var found bool
+		err := relayEventStream(c, resp, func(data []byte) bool {
+			if u, ok := adapter.ParseUsage(data); ok {
+				total, found = total.merge(u), true
+				if ureq.StripUsageChunk && isUsageOnlyChunk(data) {
+					return false
+				}
+			}
+			return true
+		})
+		if err != nil {
+			log.Printf("stream to client aborted: %v", err)
+		}
+		if found {
+			c.Writer.Header().Set(costHeader, formatCost(computeCost(ureq.Model, total)))
+		}
+		return total, found, err
+	}
+
+	if isNDJSONStream(resp) {
+		c.Writer.Header().Set("Trailer", costHeader)
+		var total Usage
+		var found bool
+		err := relayLines(c, resp, func(line []byte) {
+			if u, ok := adapter.ParseUsage(line); ok {
+				total, found = total.merge(u), true
+			}
+		})
+		if err != nil {
+			log.Printf("stream to client aborted: %v", err)
+		}
+		if found {
+			c.Writer.Header().Set(costHeader, formatCost(computeCost(ureq.Model, total)))
+		}
+		return total, found, err
+	}
+
+	if !isJSONResponse(resp) {
+		c.Writer.WriteHeader(resp.StatusCode)
+		_, err := io.Copy(c.Writer, resp.Body)
+		return Usage{}, false, err
+	}
+
+	// JSON bodies are buffered so the cost header can be sent ahead of them.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBufferedBody+1))
+	if err != nil || len(body) > maxBufferedBody {
+		c.Writer.WriteHeader(resp.StatusCode)
+		c.Writer.Write(body)
+		if _, copyErr := io.Copy(c.Writer, resp.Body); err == nil {
+			err = copyErr
+		}
+		return Usage{}, false, err
+	}
+	u, ok := adapter.ParseUsage(body)
+	if ok {
+		c.Writer.Header().Set(costHeader, formatCost(computeCost(ureq.Model, u)))
 	}
 	c.Writer.WriteHeader(resp.StatusCode)
-	io.Copy(c.Writer, resp.Body)
+	_, err = c.Writer.Write(body)
+	return u, ok, err
+}
+
+// isStreamingRequest reports whether the client asked for a streamed response, either with the
+// OpenAI/Anthropic `stream` flag or through a provider's streaming route.
+func isStreamingRequest(path string, body map[string]interface{}) bool {
+	if stream, _ := body["stream"].(bool); stream {
+		return true
+	}
+	return strings.Contains(path, ":streamGenerateContent") ||
+		strings.HasSuffix(path, "/invoke-with-response-stream") ||
+		strings.HasSuffix(path, "/converse-stream")
 }
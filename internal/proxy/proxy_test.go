@@ -0,0 +1,1174 @@
+package proxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/eventstream"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/proxy"
+)
+
+const testMasterKey = "test-master-key"
+
+type testEnv struct {
+	srv      *httptest.Server
+	proxy    *proxy.Proxy
+	database db.DB
+	conn     *models.Connection
+	model    *models.ProviderModel
+}
+
+// newTestProxy wires a proxy in front of upstream using a throwaway sqlite database and
+// a single master-key-reachable model.
+func newTestProxy(t *testing.T, providerName string, upstream *httptest.Server, modelName, remoteModel string) *testEnv {
+	t.Helper()
+	t.Setenv("MASTER_KEY", testMasterKey)
+	gin.SetMode(gin.TestMode)
+
+	database, err := db.InitDB("sqlite", "file:"+t.Name()+"?mode=memory&cache=shared")
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	conn := &models.Connection{ID: models.NewID(), Name: providerName, Provider: providerName, Endpoint: upstream.URL, APIKey: "upstream-key"}
+	require.NoError(t, database.SaveConnection(ctx, conn))
+	pm := &models.ProviderModel{ID: models.NewID(), ConnectionID: conn.ID, Name: modelName, RemoteModel: remoteModel}
+	require.NoError(t, database.SaveProviderModel(ctx, pm))
+
+	p := proxy.NewProxy(database)
+	r := gin.New()
+	r.GET("/health/upstreams", p.HandleUpstreamHealth)
+	r.GET("/v1/models", p.HandleListModels)
+	r.GET("/v1/models/*model", p.HandleGetModel)
+	r.GET("/v1beta/models", p.HandleListModels)
+	r.GET("/v1beta/models/*model", p.HandleGetModel)
+	r.NoRoute(p.HandleProxy)
+	srv := httptest.NewServer(r)
+	t.Cleanup(func() {
+		srv.Close()
+		p.Close()
+	})
+	return &testEnv{srv: srv, proxy: p, database: database, conn: conn, model: pm}
+}
+
+// addVirtualKey creates a virtual key assigned to the environment's model under its own name.
+func (e *testEnv) addVirtualKey(t *testing.T, key string, tps float64, tokens int64) *models.VirtualKey {
+	t.Helper()
+	ctx := context.Background()
+	vk := &models.VirtualKey{ID: models.NewID(), Name: key, Key: key}
+	require.NoError(t, e.database.SaveVirtualKey(ctx, vk))
+	require.NoError(t, e.database.SaveVirtualKeyAssignment(ctx, &models.VirtualKeyAssignment{
+		ID:              models.NewID(),
+		VirtualKeyID:    vk.ID,
+		ProviderModelID: e.model.ID,
+		ModelAlias:      e.model.Name,
+		RateLimitTPS:    tps,
+		RateLimitTokens: tokens,
+	}))
+	return vk
+}
+
+func postJSON(t *testing.T, ctx context.Context, url, body string) *http.Response {
+	t.Helper()
+	return postJSONWithKey(t, ctx, url, testMasterKey, body)
+}
+
+func postJSONWithKey(t *testing.T, ctx context.Context, url, key, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestHandleProxy_StreamsFramesAsTheyArrive(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "data: {\"n\":1}\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "openai", upstream, "gpt-4o", "gpt-4o")
+	resp := postJSON(t, context.Background(), env.srv.URL+"/v1/chat/completions", `{"model":"gpt-4o","stream":true}`)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// The first frame must arrive while the upstream is still holding the stream open.
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: {\"n\":1}\n", line)
+
+	close(release)
+	rest, err := reader.ReadString(']')
+	require.NoError(t, err)
+	assert.Contains(t, rest, "data: [DONE]")
+}
+
+func TestHandleProxy_ClientDisconnectCancelsUpstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "google", upstream, "gemini-flash", "gemini-1.5-flash")
+	ctx, cancel := context.WithCancel(context.Background())
+	resp := postJSON(t, ctx, env.srv.URL+"/v1beta/models/gemini-flash:streamGenerateContent?alt=sse", `{}`)
+	_, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	cancel()
+	resp.Body.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled after the client disconnected")
+	}
+}
+
+func TestHandleProxy_ChargesReportedUsage(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[],"usage":{"prompt_tokens":400,"completion_tokens":100}}`)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "openai", upstream, "gpt-4o", "gpt-4o")
+	env.addVirtualKey(t, "sk-usage", 100, 300)
+	ctx := context.Background()
+
+	resp := postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-usage", `{"model":"gpt-4o"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// 500 real tokens against a 300 token budget leaves the bucket in debt.
+	resp = postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-usage", `{"model":"gpt-4o"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// Only the call that reached the provider lands in the ledger.
+	env.proxy.Close()
+	summary, err := env.database.AggregateUsage(ctx, models.UsageFilter{ByModel: true})
+	require.NoError(t, err)
+	require.Len(t, summary, 1)
+	assert.Equal(t, env.model.ID, summary[0].ProviderModelID)
+	assert.Equal(t, int64(1), summary[0].Requests)
+	assert.Equal(t, int64(400), summary[0].PromptTokens)
+	assert.Equal(t, int64(100), summary[0].CompletionTokens)
+}
+
+func TestHandleProxy_ChargesStreamUsageWithoutLeakingIt(t *testing.T) {
+	for _, provider := range []string{"openai", "azure"} {
+		t.Run(provider, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				assert.Contains(t, string(body), `"include_usage":true`)
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n")
+				fmt.Fprint(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":250,\"completion_tokens\":250}}\n\n")
+				fmt.Fprint(w, "data: [DONE]\n\n")
+			}))
+			defer upstream.Close()
+
+			env := newTestProxy(t, provider, upstream, "gpt-4o", "gpt-4o")
+			env.addVirtualKey(t, "sk-stream", 100, 300)
+			ctx := context.Background()
+
+			resp := postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-stream", `{"model":"gpt-4o","stream":true}`)
+			out, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			assert.Contains(t, string(out), `"content":"hi"`)
+			assert.NotContains(t, string(out), "usage")
+			assert.Contains(t, string(out), "[DONE]")
+
+			resp = postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-stream", `{"model":"gpt-4o","stream":true}`)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandleProxy_ReservesWholeBucketForOversizedRequests(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[],"usage":{"prompt_tokens":10,"completion_tokens":10}}`)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "openai", upstream, "gpt-4o", "gpt-4o")
+	env.addVirtualKey(t, "sk-estimate", 100, 1000)
+	const body = `{"model":"gpt-4o","max_tokens":5000,"messages":[{"role":"user","content":"hi"}]}`
+
+	// max_tokens alone exceeds the per-minute limit, so the request takes the whole bucket.
+	resp := postJSONWithKey(t, context.Background(), env.srv.URL+"/v1/chat/completions", "sk-estimate", body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Only the 20 tokens it used are charged, but the next one needs a full bucket again.
+	resp = postJSONWithKey(t, context.Background(), env.srv.URL+"/v1/chat/completions", "sk-estimate", body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, 1, calls, "a request the bucket cannot cover must not reach the provider")
+}
+
+func TestHandleProxy_ReportsCost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		usage := `{"prompt_tokens":1000,"completion_tokens":200,"prompt_tokens_details":{"cached_tokens":400}}`
+		if strings.Contains(string(body), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "data: {\"choices\":[],\"usage\":%s}\n\ndata: [DONE]\n\n", usage)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"choices":[],"usage":%s}`, usage)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "openai", upstream, "gpt-4o", "gpt-4o")
+	env.model.InputPrice = 2.5
+	env.model.CachedInputPrice = 1.25
+	env.model.OutputPrice = 10
+	require.NoError(t, env.database.SaveProviderModel(context.Background(), env.model))
+
+	// 600 * 2.5 + 400 * 1.25 + 200 * 10 = 4000 USD per million tokens
+	resp := postJSON(t, context.Background(), env.srv.URL+"/v1/chat/completions", `{"model":"gpt-4o"}`)
+	resp.Body.Close()
+	assert.Equal(t, "0.004000", resp.Header.Get("X-LLM-Proxy-Cost"))
+
+	resp = postJSON(t, context.Background(), env.srv.URL+"/v1/chat/completions", `{"model":"gpt-4o","stream":true}`)
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "0.004000", resp.Trailer.Get("X-LLM-Proxy-Cost"))
+}
+
+func TestHandleProxy_EnforcesBudget(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[],"usage":{"prompt_tokens":1000,"completion_tokens":1000}}`)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "openai", upstream, "gpt-4o", "gpt-4o")
+	env.model.InputPrice = 1
+	env.model.OutputPrice = 2
+	require.NoError(t, env.database.SaveProviderModel(context.Background(), env.model))
+
+	vk := env.addVirtualKey(t, "sk-budget", 100, 0)
+	vk.Key = "sk-budget"
+	vk.BudgetAmount = 0.004
+	vk.BudgetPeriod = "daily"
+	vk.BudgetWarnPercent = 50
+	require.NoError(t, env.database.SaveVirtualKey(context.Background(), vk))
+	ctx := context.Background()
+
+	// Each call costs $0.003: the first passes, the second passes with a warning, the third is cut off.
+	resp := postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-budget", `{"model":"gpt-4o"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("X-LLM-Proxy-Budget-Warning"))
+
+	resp = postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-budget", `{"model":"gpt-4o"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("X-LLM-Proxy-Budget-Warning"), "75.0% of daily budget used")
+
+	resp = postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-budget", `{"model":"gpt-4o"}`)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPaymentRequired, resp.StatusCode)
+	assert.Contains(t, string(body), "Budget exceeded")
+}
+
+// addDeployment registers another connection and model that can join an alias pool.
+func (e *testEnv) addDeployment(t *testing.T, providerName string, upstream *httptest.Server, modelName, remoteModel string) *models.ProviderModel {
+	t.Helper()
+	ctx := context.Background()
+	conn := &models.Connection{ID: models.NewID(), Name: upstream.URL, Provider: providerName, Endpoint: upstream.URL, APIKey: "upstream-key"}
+	require.NoError(t, e.database.SaveConnection(ctx, conn))
+	pm := &models.ProviderModel{ID: models.NewID(), ConnectionID: conn.ID, Name: modelName, RemoteModel: remoteModel}
+	require.NoError(t, e.database.SaveProviderModel(ctx, pm))
+	return pm
+}
+
+func TestHandleProxy_BalancesAliasPool(t *testing.T) {
+	hits := map[string]int{}
+	upstreamFor := func(region string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[region]++
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{}`)
+		}))
+	}
+	east, west := upstreamFor("east"), upstreamFor("west")
+	defer east.Close()
+	defer west.Close()
+
+	env := newTestProxy(t, "azure", east, "gpt-4o-east", "gpt-4o")
+	westModel := env.addDeployment(t, "azure", west, "gpt-4o-west", "gpt-4o")
+
+	ctx := context.Background()
+	vk := &models.VirtualKey{ID: models.NewID(), Name: "pool", Key: "sk-pool"}
+	require.NoError(t, env.database.SaveVirtualKey(ctx, vk))
+	for i, pm := range []*models.ProviderModel{env.model, westModel} {
+		require.NoError(t, env.database.SaveVirtualKeyAssignment(ctx, &models.VirtualKeyAssignment{
+			ID:              models.NewID(),
+			VirtualKeyID:    vk.ID,
+			ProviderModelID: pm.ID,
+			ModelAlias:      "gpt-4o",
+			RateLimitTPS:    100,
+			Weight:          i + 1,
+			Strategy:        "round-robin",
+			CreatedAt:       time.Now().Add(time.Duration(i) * time.Second),
+		}))
+	}
+
+	for i := 0; i < 6; i++ {
+		resp := postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-pool", `{"model":"gpt-4o"}`)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	assert.Equal(t, map[string]int{"east": 2, "west": 4}, hits)
+}
+
+func TestHandleProxy_RetriesThenFailsOver(t *testing.T) {
+	t.Setenv("PROXY_MAX_RETRIES", "2")
+	t.Setenv("PROXY_RETRY_BASE_DELAY", "1ms")
+
+	var azureHits int
+	azure := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		azureHits++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer azure.Close()
+	var fallbackModel string
+	openai := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		fallbackModel, _ = body["model"].(string)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"usage":{"prompt_tokens":1,"completion_tokens":1}}`)
+	}))
+	defer openai.Close()
+
+	env := newTestProxy(t, "azure", azure, "gpt-4o", "gpt-4o")
+	fallback := env.addDeployment(t, "openai", openai, "gpt-4o-backup", "gpt-4o-mini")
+	env.model.FallbackModelID = fallback.ID
+	require.NoError(t, env.database.SaveProviderModel(context.Background(), env.model))
+
+	resp := postJSON(t, context.Background(), env.srv.URL+"/v1/chat/completions", `{"model":"gpt-4o"}`)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 3, azureHits, "one attempt plus two retries")
+	assert.Equal(t, "gpt-4o-mini", fallbackModel)
+}
+
+func TestHandleProxy_FailsOverWhenRetryAfterIsTooLong(t *testing.T) {
+	t.Setenv("PROXY_RETRY_MAX_DELAY", "1s")
+
+	var primaryHits, secondaryHits int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits++
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryHits++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{}`)
+	}))
+	defer secondary.Close()
+
+	env := newTestProxy(t, "openai", primary, "gpt-4o", "gpt-4o")
+	fallback := env.addDeployment(t, "openai", secondary, "gpt-4o-secondary", "gpt-4o")
+	env.model.FallbackModelID = fallback.ID
+	require.NoError(t, env.database.SaveProviderModel(context.Background(), env.model))
+
+	start := time.Now()
+	resp := postJSON(t, context.Background(), env.srv.URL+"/v1/chat/completions", `{"model":"gpt-4o"}`)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, primaryHits)
+	assert.Equal(t, 1, secondaryHits)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestHandleProxy_RelaysLastErrorWhenEveryAttemptFails(t *testing.T) {
+	t.Setenv("PROXY_MAX_RETRIES", "1")
+	t.Setenv("PROXY_RETRY_BASE_DELAY", "1ms")
+
+	var hits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, `{"error":"attempt %d"}`, hits)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "openai", upstream, "gpt-4o", "gpt-4o")
+	resp := postJSON(t, context.Background(), env.srv.URL+"/v1/chat/completions", `{"model":"gpt-4o"}`)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"error":"attempt 2"}`, string(body))
+}
+
+func TestHandleProxy_CircuitBreakerStopsTraffic(t *testing.T) {
+	t.Setenv("PROXY_MAX_RETRIES", "0")
+
+	var hits int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "azure", upstream, "gpt-4o", "gpt-4o")
+	for i := 0; i < 5; i++ {
+		resp := postJSON(t, context.Background(), env.srv.URL+"/v1/chat/completions", `{"model":"gpt-4o"}`)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	}
+
+	// Five failures in a row open the breaker: the dead upstream is no longer called.
+	resp := postJSON(t, context.Background(), env.srv.URL+"/v1/chat/completions", `{"model":"gpt-4o"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, 5, hits)
+
+	req, _ := http.NewRequest(http.MethodGet, env.srv.URL+"/health/upstreams", nil)
+	req.Header.Set("Authorization", "Bearer "+testMasterKey)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var report struct {
+		Upstreams []proxy.UpstreamHealth `json:"upstreams"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	require.Len(t, report.Upstreams, 1)
+	assert.Equal(t, env.conn.ID, report.Upstreams[0].ConnectionID)
+	assert.Equal(t, "open", report.Upstreams[0].State)
+	assert.Equal(t, 1.0, report.Upstreams[0].ErrorRate)
+}
+
+// bedrockChunk frames one Anthropic stream event the way invoke-with-response-stream does.
+func bedrockChunk(t *testing.T, w io.Writer, event string) {
+	t.Helper()
+	payload, _ := json.Marshal(map[string]string{"bytes": base64.StdEncoding.EncodeToString([]byte(event))})
+	require.NoError(t, eventstream.Encode(w, map[string]string{
+		":event-type":   "chunk",
+		":message-type": "event",
+		":content-type": "application/json",
+	}, payload))
+}
+
+func TestHandleProxy_SignsBedrockRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id":"msg_1","content":[{"type":"text","text":"ok"}],"stop_reason":"end_turn","usage":{"input_tokens":3,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "aws", upstream, "claude", "anthropic.claude-3-haiku-20240307-v1:0")
+	env.conn.AWSAccessKeyID = "AKIDEXAMPLE"
+	env.conn.AWSSecretAccessKey = "secret"
+	env.conn.AWSRegion = "us-east-1"
+	require.NoError(t, env.database.SaveConnection(context.Background(), env.conn))
+
+	resp := postJSON(t, context.Background(), env.srv.URL+"/v1/chat/completions", `{"model":"claude","messages":[{"role":"user","content":"hi"}]}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestHandleProxy_TranslatesBedrockStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/model/anthropic.claude-3-haiku/invoke-with-response-stream", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		assert.NotContains(t, string(body), `"stream"`)
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		bedrockChunk(t, w, `{"type":"message_start","message":{"id":"msg_1","usage":{"input_tokens":250,"output_tokens":1}}}`)
+		bedrockChunk(t, w, `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`)
+		bedrockChunk(t, w, `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`)
+		bedrockChunk(t, w, `{"type":"content_block_stop","index":0}`)
+		bedrockChunk(t, w, `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":250}}`)
+		bedrockChunk(t, w, `{"type":"message_stop"}`)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "aws", upstream, "claude-haiku", "anthropic.claude-3-haiku")
+	env.addVirtualKey(t, "sk-bedrock", 100, 300)
+	ctx := context.Background()
+
+	resp := postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-bedrock", `{"model":"claude-haiku","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	out, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	var chunks []map[string]interface{}
+	for _, frame := range strings.Split(strings.TrimSpace(string(out)), "\n\n") {
+		data := strings.TrimPrefix(frame, "data: ")
+		if data == "[DONE]" {
+			continue
+		}
+		var chunk map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk), data)
+		chunks = append(chunks, chunk)
+	}
+	require.Len(t, chunks, 3)
+	assert.Equal(t, "chat.completion.chunk", chunks[0]["object"])
+	assert.Equal(t, "claude-haiku", chunks[0]["model"])
+	assert.Equal(t, "Hello", chunks[1]["choices"].([]interface{})[0].(map[string]interface{})["delta"].(map[string]interface{})["content"])
+	assert.Equal(t, "stop", chunks[2]["choices"].([]interface{})[0].(map[string]interface{})["finish_reason"])
+	assert.NotContains(t, string(out), "usage", "usage chunk was not requested by the client")
+	assert.True(t, strings.HasSuffix(string(out), "data: [DONE]\n\n"))
+
+	// The 500 tokens reported in the stream were charged against the 300-token budget.
+	resp = postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-bedrock", `{"model":"claude-haiku","stream":true}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestHandleProxy_TranslatesConverseStream(t *testing.T) {
+	event := func(w io.Writer, eventType, payload string) {
+		require.NoError(t, eventstream.Encode(w, map[string]string{":event-type": eventType, ":message-type": "event"}, []byte(payload)))
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/model/mistral.large/converse-stream", r.URL.Path)
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		event(w, "messageStart", `{"role":"assistant"}`)
+		event(w, "contentBlockDelta", `{"contentBlockIndex":0,"delta":{"text":"Checking"}}`)
+		event(w, "contentBlockStart", `{"contentBlockIndex":1,"start":{"toolUse":{"toolUseId":"t1","name":"weather"}}}`)
+		event(w, "contentBlockDelta", `{"contentBlockIndex":1,"delta":{"toolUse":{"input":"{\"city\":"}}}`)
+		event(w, "contentBlockDelta", `{"contentBlockIndex":1,"delta":{"toolUse":{"input":"\"Paris\"}"}}}`)
+		event(w, "messageStop", `{"stopReason":"tool_use"}`)
+		event(w, "metadata", `{"usage":{"inputTokens":12,"outputTokens":7,"totalTokens":19},"metrics":{"latencyMs":100}}`)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "aws", upstream, "mistral", "mistral.large")
+	env.model.APIMode = proxy.APIModeConverse
+	require.NoError(t, env.database.SaveProviderModel(context.Background(), env.model))
+
+	resp := postJSON(t, context.Background(), env.srv.URL+"/v1/chat/completions",
+		`{"model":"mistral","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"weather?"}]}`)
+	out, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+
+	body := string(out)
+	assert.Contains(t, body, `"content":"Checking"`)
+	assert.Contains(t, body, `"id":"t1"`)
+	assert.Contains(t, body, `"arguments":"{\"city\":"`)
+	assert.Contains(t, body, `"finish_reason":"tool_calls"`)
+	assert.Contains(t, body, `"usage":{"prompt_tokens":12,"completion_tokens":7,"total_tokens":19}`)
+	assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+}
+
+func TestHandleProxy_TranslatesGemini(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1beta/models/gemini-2.0-flash:generateContent":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"candidates":[{"index":0,"content":{"role":"model","parts":[{"text":"Bonjour"}]},"finishReason":"STOP"}],
+				"usageMetadata":{"promptTokenCount":6,"candidatesTokenCount":2,"totalTokenCount":8}}`)
+		case "/v1beta/models/gemini-2.0-flash:streamGenerateContent":
+			assert.Equal(t, "sse", r.URL.Query().Get("alt"))
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "data: {\"candidates\":[{\"index\":0,\"content\":{\"parts\":[{\"text\":\"Bon\"}]}}],\"usageMetadata\":{\"promptTokenCount\":6}}\r\n\r\n")
+			fmt.Fprint(w, "data: {\"candidates\":[{\"index\":0,\"content\":{\"parts\":[{\"functionCall\":{\"name\":\"greet\",\"args\":{\"lang\":\"fr\"}}}]},\"finishReason\":\"STOP\"}],\"usageMetadata\":{\"promptTokenCount\":6,\"candidatesTokenCount\":4}}\r\n\r\n")
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "google", upstream, "gemini", "gemini-2.0-flash")
+	ctx := context.Background()
+
+	resp := postJSON(t, ctx, env.srv.URL+"/v1/chat/completions", `{"model":"gemini","messages":[{"role":"user","content":"Say hi in French"}]}`)
+	out, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var completion map[string]interface{}
+	require.NoError(t, json.Unmarshal(out, &completion))
+	assert.Equal(t, "chat.completion", completion["object"])
+	choice := completion["choices"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "Bonjour", choice["message"].(map[string]interface{})["content"])
+	assert.Equal(t, "stop", choice["finish_reason"])
+	assert.Equal(t, float64(8), completion["usage"].(map[string]interface{})["total_tokens"])
+
+	resp = postJSON(t, ctx, env.srv.URL+"/v1/chat/completions",
+		`{"model":"gemini","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	out, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	body := string(out)
+	assert.Contains(t, body, `"content":"Bon"`)
+	assert.Contains(t, body, `"tool_calls":[{"function":{"arguments":"{\"lang\":\"fr\"}","name":"greet"},"id":"call_0","index":0,"type":"function"}]`)
+	assert.Contains(t, body, `"finish_reason":"tool_calls"`)
+	assert.Contains(t, body, `"usage":{"prompt_tokens":6,"completion_tokens":4,"total_tokens":10}`)
+	assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+}
+
+func TestHandleProxy_Anthropic(t *testing.T) {
+	messageStream := "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"usage\":{\"input_tokens\":9,\"output_tokens\":1}}}\n\n" +
+		"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"Hello\"}}\n\n" +
+		"event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":3}}\n\n" +
+		"event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/messages", r.URL.Path)
+		assert.Equal(t, "upstream-key", r.Header.Get("x-api-key"))
+		assert.Equal(t, "2023-06-01", r.Header.Get("anthropic-version"))
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "claude-sonnet-4-20250514", body["model"])
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, messageStream)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "anthropic", upstream, "claude", "claude-sonnet-4-20250514")
+	ctx := context.Background()
+
+	// Anthropic SDKs authenticate with x-api-key and get the native stream back.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, env.srv.URL+"/v1/messages",
+		strings.NewReader(`{"model":"claude","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	require.NoError(t, err)
+	req.Header.Set("x-api-key", testMasterKey)
+	req.Header.Set("anthropic-version", "2023-06-01")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	out, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, messageStream, string(out))
+
+	resp = postJSON(t, ctx, env.srv.URL+"/v1/chat/completions",
+		`{"model":"claude","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	out, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	body := string(out)
+	assert.Contains(t, body, `"content":"Hello"`)
+	assert.Contains(t, body, `"finish_reason":"stop"`)
+	assert.Contains(t, body, `"usage":{"prompt_tokens":9,"completion_tokens":3,"total_tokens":12}`)
+	assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+
+	env.proxy.Close()
+	summary, err := env.database.AggregateUsage(ctx, models.UsageFilter{})
+	require.NoError(t, err)
+	require.Len(t, summary, 1)
+	assert.Equal(t, int64(2), summary[0].Requests)
+	assert.Equal(t, int64(18), summary[0].PromptTokens)
+	assert.Equal(t, int64(6), summary[0].CompletionTokens)
+}
+
+func TestHandleProxy_Ollama(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/chat", r.URL.Path)
+		assert.Empty(t, r.Header.Get("Authorization"))
+		var body map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		if body["stream"] == false {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"model":"llama3.1:8b","message":{"role":"assistant","content":"Hi there"},"done":true,"done_reason":"stop","prompt_eval_count":7,"eval_count":3}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":"Hi"},"done":false}`+"\n")
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":" there"},"done":false}`+"\n")
+		fmt.Fprint(w, `{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":7,"eval_count":3}`+"\n")
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "ollama", upstream, "llama", "llama3.1:8b")
+	env.conn.APIKey = ""
+	require.NoError(t, env.database.SaveConnection(context.Background(), env.conn))
+	env.model.APIMode = proxy.APIModeNative
+	require.NoError(t, env.database.SaveProviderModel(context.Background(), env.model))
+	ctx := context.Background()
+
+	resp := postJSON(t, ctx, env.srv.URL+"/v1/chat/completions", `{"model":"llama","messages":[{"role":"user","content":"hi"}]}`)
+	out, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	var completion map[string]interface{}
+	require.NoError(t, json.Unmarshal(out, &completion))
+	choice := completion["choices"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "Hi there", choice["message"].(map[string]interface{})["content"])
+	assert.Equal(t, float64(10), completion["usage"].(map[string]interface{})["total_tokens"])
+
+	resp = postJSON(t, ctx, env.srv.URL+"/v1/chat/completions", `{"model":"llama","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	out, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	body := string(out)
+	assert.Contains(t, body, `"content":" there"`)
+	assert.Contains(t, body, `"finish_reason":"stop"`)
+	assert.NotContains(t, body, "usage")
+	assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+
+	// Ollama clients calling /api/chat get the NDJSON stream line by line.
+	resp = postJSON(t, ctx, env.srv.URL+"/api/chat", `{"model":"llama","messages":[{"role":"user","content":"hi"}]}`)
+	out, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	assert.Equal(t, 3, strings.Count(string(out), "\n"))
+
+	env.proxy.Close()
+	summary, err := env.database.AggregateUsage(ctx, models.UsageFilter{})
+	require.NoError(t, err)
+	require.Len(t, summary, 1)
+	assert.Equal(t, int64(3), summary[0].Requests)
+	assert.Equal(t, int64(21), summary[0].PromptTokens)
+	assert.Equal(t, int64(9), summary[0].CompletionTokens)
+}
+
+func TestHandleProxy_ForwardsMultipartUploads(t *testing.T) {
+	audio := bytes.Repeat([]byte{0xff, 0xfb, 0x90, 0x00}, 64<<10)
+	var gotModel, gotLanguage string
+	var gotAudio, gotRaw []byte
+	var gotLength int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/audio/transcriptions", r.URL.Path)
+		gotLength = r.ContentLength
+		gotRaw, _ = io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(gotRaw))
+		require.NoError(t, r.ParseMultipartForm(1<<20))
+		gotModel, gotLanguage = r.FormValue("model"), r.FormValue("language")
+		f, _, err := r.FormFile("file")
+		require.NoError(t, err)
+		gotAudio, _ = io.ReadAll(f)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"text":"hello"}`)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "openai", upstream, "whisper", "whisper-1")
+	upload := func(model string) *http.Response {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		fw, _ := mw.CreateFormFile("file", "speech.mp3")
+		fw.Write(audio)
+		mw.WriteField("model", model)
+		mw.WriteField("language", "en")
+		pw, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition":       {`form-data; name="prompt"`},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		fmt.Fprint(pw, "caf=C3=A9")
+		mw.Close()
+		req, err := http.NewRequest(http.MethodPost, env.srv.URL+"/v1/audio/transcriptions", &buf)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+testMasterKey)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// The alias in the form is replaced by the remote model; every other part, encoded ones
+	// included, is forwarded as sent, under a known length.
+	resp := upload("whisper")
+	out, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(out))
+	assert.JSONEq(t, `{"text":"hello"}`, string(out))
+	assert.Equal(t, "whisper-1", gotModel)
+	assert.Equal(t, "en", gotLanguage)
+	assert.Equal(t, audio, gotAudio)
+	assert.Contains(t, string(gotRaw), "caf=C3=A9")
+	assert.Equal(t, int64(len(gotRaw)), gotLength)
+
+	// Untouched forms are sent byte for byte with their length.
+	env.model.RemoteModel = ""
+	require.NoError(t, env.database.SaveProviderModel(context.Background(), env.model))
+	resp = upload("whisper")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "whisper", gotModel)
+	assert.Equal(t, int64(len(gotRaw)), gotLength)
+	assert.Greater(t, gotLength, int64(len(audio)))
+}
+
+func TestHandleProxy_PreservesRequestBody(t *testing.T) {
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[]}`)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "openai", upstream, "gpt-4o", "gpt-4o-2024-08-06")
+	ctx := context.Background()
+	const rest = `, "seed": 12345678901234567890, "zeta": 1, "alpha": {"b": 2, "a": 1}}`
+
+	// Only the model value is patched; key order, spacing and big integers survive.
+	resp := postJSON(t, ctx, env.srv.URL+"/v1/chat/completions", `{"model": "gpt-4o"`+rest)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Without any rewrite the body is forwarded byte for byte.
+	env.model.RemoteModel = "gpt-4o"
+	require.NoError(t, env.database.SaveProviderModel(ctx, env.model))
+	resp = postJSON(t, ctx, env.srv.URL+"/v1/chat/completions", `{"model": "gpt-4o"`+rest)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Fields the adapter adds, such as stream_options, are appended without re-encoding the rest.
+	const custom = `{"model": "gpt-4o", "stream": true, "x_vendor": {"b": 1.50, "a": 1e3, "html": "<b>"}}`
+	resp = postJSON(t, ctx, env.srv.URL+"/v1/chat/completions", custom)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Len(t, received, 3)
+	assert.Equal(t, `{"model": "gpt-4o-2024-08-06"`+rest, received[0])
+	assert.Equal(t, `{"model": "gpt-4o"`+rest, received[1])
+	assert.Equal(t, custom[:len(custom)-1]+`,"stream_options":{"include_usage":true}}`, received[2])
+
+	// Malformed JSON is rejected instead of being forwarded as null.
+	resp = postJSON(t, ctx, env.srv.URL+"/v1/chat/completions", `{"model": "gpt-4o",`)
+	out, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Contains(t, string(out), "Request body must be a JSON object")
+	assert.Len(t, received, 3)
+}
+
+func TestHandleProxy_PatchesNativeBedrockBody(t *testing.T) {
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"content":[],"usage":{"input_tokens":1,"output_tokens":1}}`)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "aws", upstream, "claude", "claude")
+	resp := postJSON(t, context.Background(), env.srv.URL+"/model/claude/invoke",
+		`{"model": "claude", "messages": [{"role": "user", "content": "hi"}], "top_k": 5.0}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// model is dropped and the fields Bedrock requires appended; the rest is left as sent.
+	assert.Equal(t, `{"messages": [{"role": "user", "content": "hi"}], "top_k": 5.0,"max_tokens":4096,"anthropic_version":"bedrock-2023-05-31"}`, received)
+}
+
+func getWithKey(t *testing.T, url, key string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestHandleListModels(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("model listing reached the upstream: %s", r.URL.Path)
+	}))
+	defer upstream.Close()
+	env := newTestProxy(t, "openai", upstream, "gpt-4o", "gpt-4o-2024-08-06")
+	env.addDeployment(t, "vllm", upstream, "meta-llama/Llama-3.1-8B", "")
+	env.addVirtualKey(t, "sk-team", 100, 1000000)
+
+	type list struct {
+		Object string            `json:"object"`
+		Data   []proxy.ModelInfo `json:"data"`
+	}
+	var got list
+	resp := getWithKey(t, env.srv.URL+"/v1/models", "sk-team")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	resp.Body.Close()
+	assert.Equal(t, "list", got.Object)
+	require.Len(t, got.Data, 1, "only the key's assignments are listed")
+	assert.Equal(t, "gpt-4o", got.Data[0].ID)
+	assert.Equal(t, "model", got.Data[0].Object)
+	assert.Equal(t, "openai", got.Data[0].OwnedBy)
+
+	got = list{}
+	resp = getWithKey(t, env.srv.URL+"/v1/models", testMasterKey)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	resp.Body.Close()
+	require.Len(t, got.Data, 2)
+	assert.Equal(t, "gpt-4o", got.Data[0].ID)
+	assert.Equal(t, "meta-llama/Llama-3.1-8B", got.Data[1].ID)
+	assert.Equal(t, "vllm", got.Data[1].OwnedBy)
+
+	var one proxy.ModelInfo
+	resp = getWithKey(t, env.srv.URL+"/v1/models/meta-llama/Llama-3.1-8B", testMasterKey)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&one))
+	resp.Body.Close()
+	assert.Equal(t, "meta-llama/Llama-3.1-8B", one.ID)
+
+	resp = getWithKey(t, env.srv.URL+"/v1/models/meta-llama/Llama-3.1-8B", "sk-team")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "unassigned models are hidden")
+
+	var gemini struct {
+		Models []proxy.GeminiModelInfo `json:"models"`
+	}
+	resp = getWithKey(t, env.srv.URL+"/v1beta/models", "sk-team")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&gemini))
+	resp.Body.Close()
+	require.Len(t, gemini.Models, 1)
+	assert.Equal(t, "models/gpt-4o", gemini.Models[0].Name)
+
+	resp = getWithKey(t, env.srv.URL+"/v1/models", "sk-unknown")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHandleProxy_BatchesEmbeddings(t *testing.T) {
+	// Titan embeds one input per call, so three inputs take three calls, merged in input order.
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		assert.Equal(t, "/model/amazon.titan-embed-text-v2:0/invoke", r.URL.Path)
+		var body struct {
+			InputText string `json:"inputText"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Amzn-Bedrock-Input-Token-Count", "5")
+		fmt.Fprintf(w, `{"embedding":[%d],"inputTextTokenCount":5}`, len(body.InputText))
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "aws", upstream, "titan-embed", "amazon.titan-embed-text-v2:0")
+	ctx := context.Background()
+	resp := postJSON(t, ctx, env.srv.URL+"/v1/embeddings", `{"model":"titan-embed","input":["a","bb","ccc"]}`)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(3), calls.Load())
+
+	var out struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Model string `json:"model"`
+		Usage struct {
+			PromptTokens int64 `json:"prompt_tokens"`
+			TotalTokens  int64 `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	require.Len(t, out.Data, 3)
+	for i, d := range out.Data {
+		assert.Equal(t, i, d.Index)
+		assert.Equal(t, []float64{float64(i + 1)}, d.Embedding)
+	}
+	assert.Equal(t, "titan-embed", out.Model)
+	assert.Equal(t, int64(15), out.Usage.PromptTokens)
+	assert.Equal(t, int64(15), out.Usage.TotalTokens)
+
+	// The batches are recorded as one call carrying their combined usage.
+	env.proxy.Close()
+	summary, err := env.database.AggregateUsage(ctx, models.UsageFilter{ByModel: true})
+	require.NoError(t, err)
+	require.Len(t, summary, 1)
+	assert.Equal(t, int64(1), summary[0].Requests)
+	assert.Equal(t, int64(15), summary[0].PromptTokens)
+}
+
+func TestHandleProxy_BillsBatchesOfFailedEmbeddings(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			InputText string `json:"inputText"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		w.Header().Set("Content-Type", "application/json")
+		if body.InputText == "ccc" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"message":"input rejected"}`)
+			return
+		}
+		w.Header().Set("X-Amzn-Bedrock-Input-Token-Count", "5")
+		fmt.Fprint(w, `{"embedding":[1],"inputTextTokenCount":5}`)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "aws", upstream, "titan-embed", "amazon.titan-embed-text-v2:0")
+	env.addVirtualKey(t, "sk-embed", 100, 11)
+	ctx := context.Background()
+
+	resp := postJSONWithKey(t, ctx, env.srv.URL+"/v1/embeddings", "sk-embed", `{"model":"titan-embed","input":["a","bb","ccc"]}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// The two batches that succeeded were paid for upstream, so they drain the token bucket...
+	resp = postJSONWithKey(t, ctx, env.srv.URL+"/v1/embeddings", "sk-embed", `{"model":"titan-embed","input":["a","bb"]}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// ...and land in the ledger next to the batch that failed.
+	env.proxy.Close()
+	summary, err := env.database.AggregateUsage(ctx, models.UsageFilter{ByModel: true})
+	require.NoError(t, err)
+	require.Len(t, summary, 1)
+	assert.Equal(t, int64(3), summary[0].Requests)
+	assert.Equal(t, int64(10), summary[0].PromptTokens)
+}
+
+func TestHandleProxy_CachesDeterministicResponses(t *testing.T) {
+	var calls int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"stream":true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprintf(w, "data: {\"n\":%d}\n\ndata: [DONE]\n\n", n)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"n":%d}`, n)
+	}))
+	defer upstream.Close()
+
+	env := newTestProxy(t, "openai", upstream, "gpt-4o", "gpt-4o")
+	vk := env.addVirtualKey(t, "sk-cache", 100, 0)
+	vk.Key = "sk-cache"
+	vk.CacheTTLSeconds = 60
+	require.NoError(t, env.database.SaveVirtualKey(context.Background(), vk))
+
+	send := func(body string, header ...string) (string, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, env.srv.URL+"/v1/chat/completions", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer sk-cache")
+		req.Header.Set("Content-Type", "application/json")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return string(out), resp.Header.Get("X-LLM-Proxy-Cache")
+	}
+
+	const chat = `{"model":"gpt-4o","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+	body, state := send(chat)
+	assert.Equal(t, `{"n":1}`, body)
+	assert.Equal(t, "MISS", state)
+
+	// Field order does not matter.
+	body, state = send(`{"messages":[{"role":"user","content":"hi"}],"temperature":0,"model":"gpt-4o"}`)
+	assert.Equal(t, `{"n":1}`, body)
+	assert.Equal(t, "HIT", state)
+
+	// no-cache goes upstream and refreshes the entry; bypass leaves it alone.
+	body, state = send(chat, "Cache-Control", "no-cache")
+	assert.Equal(t, `{"n":2}`, body)
+	assert.Equal(t, "MISS", state)
+	body, state = send(chat, "X-LLM-Proxy-Cache", "bypass")
+	assert.Equal(t, `{"n":3}`, body)
+	assert.Empty(t, state)
+	body, state = send(chat)
+	assert.Equal(t, `{"n":2}`, body)
+	assert.Equal(t, "HIT", state)
+
+	// Streams are replayed as the frames the client first received.
+	const stream = `{"model":"gpt-4o","temperature":0,"stream":true}`
+	first, state := send(stream)
+	assert.Equal(t, "MISS", state)
+	replayed, state := send(stream)
+	assert.Equal(t, "HIT", state)
+	assert.Equal(t, first, replayed)
+
+	// Sampling at a non-zero temperature is never cached.
+	_, state = send(`{"model":"gpt-4o","temperature":0.7}`)
+	assert.Empty(t, state)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&calls))
+
+	// Another key assigned the same model does not see this key's entries.
+	other := env.addVirtualKey(t, "sk-other", 100, 0)
+	other.Key = "sk-other"
+	other.CacheTTLSeconds = 60
+	require.NoError(t, env.database.SaveVirtualKey(context.Background(), other))
+	resp := postJSONWithKey(t, context.Background(), env.srv.URL+"/v1/chat/completions", "sk-other", chat)
+	resp.Body.Close()
+	assert.Equal(t, "MISS", resp.Header.Get("X-LLM-Proxy-Cache"))
+	assert.Equal(t, int32(6), atomic.LoadInt32(&calls))
+}
+
+func TestHandleProxy_CachesAcrossAliasPool(t *testing.T) {
+	var calls atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"n":%d}`, calls.Add(1))
+	})
+	east := httptest.NewServer(handler)
+	defer east.Close()
+	west := httptest.NewServer(handler)
+	defer west.Close()
+
+	env := newTestProxy(t, "openai", east, "gpt-4o-east", "gpt-4o")
+	westModel := env.addDeployment(t, "openai", west, "gpt-4o-west", "gpt-4o")
+	ctx := context.Background()
+	vk := &models.VirtualKey{ID: models.NewID(), Name: "pool", Key: "sk-pool", CacheTTLSeconds: 60}
+	require.NoError(t, env.database.SaveVirtualKey(ctx, vk))
+	for i, pm := range []*models.ProviderModel{env.model, westModel} {
+		require.NoError(t, env.database.SaveVirtualKeyAssignment(ctx, &models.VirtualKeyAssignment{
+			ID:              models.NewID(),
+			VirtualKeyID:    vk.ID,
+			ProviderModelID: pm.ID,
+			ModelAlias:      "gpt-4o",
+			RateLimitTPS:    100,
+			Strategy:        "round-robin",
+			CreatedAt:       time.Now().Add(time.Duration(i) * time.Second),
+		}))
+	}
+
+	// Round-robin sends every other call to the other deployment, but the answer is shared.
+	for i := 0; i < 4; i++ {
+		resp := postJSONWithKey(t, ctx, env.srv.URL+"/v1/chat/completions", "sk-pool", `{"model":"gpt-4o","temperature":0}`)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, `{"n":1}`, string(body))
+		if i > 0 {
+			assert.Equal(t, "HIT", resp.Header.Get("X-LLM-Proxy-Cache"))
+		}
+	}
+	assert.Equal(t, int32(1), calls.Load())
+}
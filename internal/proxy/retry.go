@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how often a deployment is retried before the proxy fails over to the
+// next one. Retries only happen before anything has been written to the client.
+type RetryPolicy struct {
+	// MaxRetries is the number of extra attempts on the same deployment.
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// RetryPolicyFromEnv reads PROXY_MAX_RETRIES, PROXY_RETRY_BASE_DELAY and PROXY_RETRY_MAX_DELAY
+// (Go durations such as "250ms"), falling back to 2 retries between 200ms and 5s.
+func RetryPolicyFromEnv() RetryPolicy {
+	policy := RetryPolicy{MaxRetries: 2, BaseDelay: 200 * time.Millisecond, MaxDelay: 5 * time.Second}
+	if v, err := strconv.Atoi(os.Getenv("PROXY_MAX_RETRIES")); err == nil && v >= 0 {
+		policy.MaxRetries = v
+	}
+	if d, err := time.ParseDuration(os.Getenv("PROXY_RETRY_BASE_DELAY")); err == nil && d >= 0 {
+		policy.BaseDelay = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("PROXY_RETRY_MAX_DELAY")); err == nil && d >= 0 {
+		policy.MaxDelay = d
+	}
+	return policy
+}
+
+// backoff returns the wait before retry number try (0-based): exponential growth capped at
+// MaxDelay with full jitter, unless the provider asked for a specific delay via Retry-After.
+// It returns false when the provider wants us to stay away longer than MaxDelay, in which case
+// failing over beats waiting.
+func (rp RetryPolicy) backoff(try int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+			if after > rp.MaxDelay {
+				return 0, false
+			}
+			return after, true
+		}
+	}
+	ceiling := rp.BaseDelay << min(try, 30)
+	if ceiling <= 0 || ceiling > rp.MaxDelay {
+		ceiling = rp.MaxDelay
+	}
+	if ceiling <= 0 {
+		return 0, true
+	}
+	return rand.N(ceiling) + 1, true
+}
+
+// retryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// isRetryableStatus reports whether an upstream status is worth another attempt: rate limits,
+// overload (Anthropic's 529) and server-side failures.
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout, 529:
+		return true
+	}
+	return false
+}
+
+// sleep waits for d or until ctx is done, reporting whether the full wait elapsed.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
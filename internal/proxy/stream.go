@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isEventStream reports whether the upstream answered with a server-sent event stream.
+// OpenAI/Azure `stream: true` and Gemini `streamGenerateContent?alt=sse` all use this content type.
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// sseReader splits an event stream into complete frames (all lines up to and including the
+// blank line that terminates an event), so frames are never forwarded half-written.
+type sseReader struct {
+	r *bufio.Reader
+}
+
+func newSSEReader(r io.Reader) *sseReader {
+	return &sseReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next frame. A trailing partial frame is returned together with io.EOF.
+func (s *sseReader) Next() ([]byte, error) {
+	var frame []byte
+	for {
+		line, err := s.r.ReadBytes('\n')
+		frame = append(frame, line...)
+		if err != nil {
+			return frame, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return frame, nil
+		}
+	}
+}
+
+// relayEventStream forwards an SSE response to the client frame by frame, flushing after each
+// one so tokens are delivered as soon as the provider emits them instead of when the stream ends.
+// The upstream request shares the client's context, so a client disconnect aborts the read below.
+// onEvent, if set, sees each frame's data payload and may drop the frame by returning false.
+func relayEventStream(c *gin.Context, resp *http.Response, onEvent func(data []byte) bool) error {
+	header := c.Writer.Header()
+	header.Del("Content-Length")
+	header.Set("Cache-Control", "no-cache")
+	// Stop reverse proxies such as nginx from buffering the stream.
+	header.Set("X-Accel-Buffering", "no")
+	c.Writer.WriteHeader(resp.StatusCode)
+	c.Writer.Flush()
+
+	reader := newSSEReader(resp.Body)
+	for {
+		frame, err := reader.Next()
+		if len(frame) > 0 && (onEvent == nil || onEvent(eventData(frame))) {
+			if _, werr := c.Writer.Write(frame); werr != nil {
+				return werr
+			}
+			c.Writer.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// relayLines forwards a newline-delimited stream such as Ollama's NDJSON line by line, flushing
+// after each one. onLine, if set, sees every complete line.
+func relayLines(c *gin.Context, resp *http.Response, onLine func(line []byte)) error {
+	header := c.Writer.Header()
+	header.Del("Content-Length")
+	header.Set("X-Accel-Buffering", "no")
+	c.Writer.WriteHeader(resp.StatusCode)
+	c.Writer.Flush()
+
+	reader := bufio.NewReaderSize(resp.Body, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if onLine != nil {
+				onLine(bytes.TrimSpace(line))
+			}
+			if _, werr := c.Writer.Write(line); werr != nil {
+				return werr
+			}
+			c.Writer.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// replaceWithEventStream swaps resp.Body for a server-sent event stream that translate writes
+// while reading the original body, for providers whose streaming format clients cannot parse.
+// The translation runs until translate returns or the proxy closes the replacement body.
+func replaceWithEventStream(resp *http.Response, translate func(upstream io.Reader, w io.Writer) error) {
+	upstream := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer upstream.Close()
+		pw.CloseWithError(translate(upstream, pw))
+	}()
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Set("Content-Type", "text/event-stream")
+}
+
+// writeEvent writes one SSE frame carrying data.
+func writeEvent(w io.Writer, data []byte) error {
+	_, err := fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// maxBufferedBody bounds how much of a non-streaming JSON response is held in memory to read
+// its usage; larger bodies are relayed without accounting.
+const maxBufferedBody = 8 << 20
+
+// merge combines usage reported across several stream events. Providers either report it once
+// (OpenAI's final chunk) or as running totals (Gemini, Anthropic), so the largest value wins.
+func (u Usage) merge(o Usage) Usage {
+	return Usage{
+		PromptTokens:       max(u.PromptTokens, o.PromptTokens),
+		CompletionTokens:   max(u.CompletionTokens, o.CompletionTokens),
+		CachedPromptTokens: max(u.CachedPromptTokens, o.CachedPromptTokens),
+	}
+}
+
+// eventData returns the payload of an SSE frame, joining multi-line `data:` fields with newlines.
+func eventData(frame []byte) []byte {
+	var data [][]byte
+	for _, line := range bytes.Split(frame, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if rest, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = append(data, bytes.TrimPrefix(rest, []byte(" ")))
+		}
+	}
+	return bytes.Join(data, []byte("\n"))
+}
+
+// isUsageOnlyChunk reports whether an OpenAI stream chunk is the trailing `choices: []` chunk
+// produced by `stream_options.include_usage`.
+func isUsageOnlyChunk(data []byte) bool {
+	var chunk struct {
+		Choices []json.RawMessage `json:"choices"`
+		Usage   json.RawMessage   `json:"usage"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return false
+	}
+	return len(chunk.Choices) == 0 && len(chunk.Usage) > 0 && string(chunk.Usage) != "null"
+}
+
+func isJSONResponse(resp *http.Response) bool {
+	return isJSONMediaType(resp.Header.Get("Content-Type"))
+}
+
+// translateJSONResponse rewrites a JSON response body for clients that expect a different
+// protocol: successful bodies go through translate, error bodies are reshaped into OpenAI's
+// error format. Non-JSON and oversized bodies are left alone.
+func translateJSONResponse(resp *http.Response, translate func(body []byte) ([]byte, error)) error {
+	if !isJSONResponse(resp) {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBufferedBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxBufferedBody {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= http.StatusBadRequest:
+		body = openAIError(body, resp.StatusCode)
+	case resp.StatusCode < http.StatusMultipleChoices:
+		if body, err = translate(body); err != nil {
+			return err
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
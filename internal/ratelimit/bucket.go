@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket that, unlike rate.Limiter, can be charged after the fact and
+// credited back, which is what reserving an estimate and reconciling it with real usage needs.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perSecond float64, burst int64) *tokenBucket {
+	return &tokenBucket{rate: perSecond, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// take removes n tokens. Without allowDebt it fails when fewer than n tokens are available;
+// with it the bucket may go negative.
+func (b *tokenBucket) take(n float64, allowDebt bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if !allowDebt && b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// refund returns n tokens, never filling the bucket beyond its burst size.
+func (b *tokenBucket) refund(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens = math.Min(b.burst, b.tokens+n)
+}
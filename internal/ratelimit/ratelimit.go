@@ -2,14 +2,13 @@ package ratelimit
 
 import (
 	"sync"
-	"time"
 
 	"golang.org/x/time/rate"
 )
 
 type Limiter struct {
 	tpsLimiter   *rate.Limiter
-	tokenLimiter *rate.Limiter
+	tokenLimiter *tokenBucket
 }
 
 type Manager struct {
@@ -36,10 +35,9 @@ func (m *Manager) GetLimiter(key string, tps float64, tokenLimit int64) *Limiter
 		tpsLim = rate.NewLimiter(rate.Limit(tps), int(tps)+1)
 	}
 
-	var tokenLim *rate.Limiter
+	var tokenLim *tokenBucket
 	if tokenLimit > 0 {
-		limit := rate.Limit(float64(tokenLimit) / 60.0)
-		tokenLim = rate.NewLimiter(limit, int(tokenLimit))
+		tokenLim = newTokenBucket(float64(tokenLimit)/60.0, tokenLimit)
 	}
 
 	l := &Limiter{
@@ -61,5 +59,48 @@ func (l *Limiter) AllowTokens(n int) bool {
 	if l.tokenLimiter == nil {
 		return true
 	}
-	return l.tokenLimiter.AllowN(time.Now(), n)
+	return l.tokenLimiter.take(float64(n), false)
+}
+
+// TokenReservation holds tokens taken up front for a request until its real usage is known.
+type TokenReservation struct {
+	limiter  *Limiter
+	reserved int64
+	once     sync.Once
+}
+
+// ReserveTokens takes an estimated n tokens before a request is sent. It fails when the bucket
+// cannot cover the estimate, or is already exhausted if n is zero. An estimate larger than the
+// bucket could ever hold is capped at its size, so such a request waits for a full bucket
+// instead of being refused forever; Settle then charges whatever it really used.
+func (l *Limiter) ReserveTokens(n int64) (*TokenReservation, bool) {
+	if l.tokenLimiter == nil {
+		return &TokenReservation{limiter: l, reserved: n}, true
+	}
+	n = min(n, int64(l.tokenLimiter.burst))
+	r := &TokenReservation{limiter: l, reserved: n}
+	if !l.tokenLimiter.take(float64(max(n, 1)), false) {
+		return nil, false
+	}
+	// Only the estimate itself is held; the extra token for n == 0 was just a probe.
+	if n == 0 {
+		l.tokenLimiter.refund(1)
+	}
+	return r, true
+}
+
+// Settle reconciles the reservation with the actual usage, charging any shortfall or refunding
+// any surplus. Only the first call has an effect.
+func (r *TokenReservation) Settle(actual int64) {
+	r.once.Do(func() {
+		bucket := r.limiter.tokenLimiter
+		if bucket == nil {
+			return
+		}
+		if diff := actual - r.reserved; diff > 0 {
+			bucket.take(float64(diff), true)
+		} else if diff < 0 {
+			bucket.refund(float64(-diff))
+		}
+	})
 }
@@ -33,3 +33,30 @@ func TestLimiter_TokenLimit(t *testing.T) {
 	// If we ask for 6001, it should fail immediately (assuming full bucket)
 	assert.False(t, limiter.AllowTokens(6001))
 }
+
+func TestLimiter_ReserveTokens(t *testing.T) {
+	manager := ratelimit.NewManager()
+	limiter := manager.GetLimiter("reserve-key", 0, 1000)
+
+	// An estimate larger than the whole budget takes all of it rather than never fitting.
+	r, ok := limiter.ReserveTokens(1500)
+	assert.True(t, ok)
+	_, ok = limiter.ReserveTokens(1)
+	assert.False(t, ok)
+	r.Settle(0)
+
+	r, ok = limiter.ReserveTokens(800)
+	assert.True(t, ok)
+	_, ok = limiter.ReserveTokens(800)
+	assert.False(t, ok)
+
+	// Actual usage came in well under the estimate, so the surplus is refunded.
+	r.Settle(100)
+	r2, ok := limiter.ReserveTokens(800)
+	assert.True(t, ok)
+
+	// Usage above the estimate is charged on top and puts the bucket in debt.
+	r2.Settle(2000)
+	_, ok = limiter.ReserveTokens(0)
+	assert.False(t, ok)
+}
@@ -0,0 +1,188 @@
+// Package router spreads a model alias over a pool of deployments (ProviderModels, possibly on
+// different connections) and tracks the in-flight and latency figures its strategies rely on.
+// Deployments whose connection's circuit breaker is open are left out of the rotation.
+package router
+
+import (
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/breaker"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+const (
+	RoundRobin     = "round-robin"
+	WeightedRandom = "weighted-random"
+	LeastInFlight  = "least-in-flight"
+	LowestLatency  = "lowest-latency"
+)
+
+// latencyDecay is the weight given to the newest sample in the latency moving average.
+const latencyDecay = 0.3
+
+// ValidStrategy reports whether s names a known strategy. The empty string means RoundRobin.
+func ValidStrategy(s string) bool {
+	switch s {
+	case "", RoundRobin, WeightedRandom, LeastInFlight, LowestLatency:
+		return true
+	}
+	return false
+}
+
+// Deployment is one member of an alias's pool.
+type Deployment struct {
+	Model *models.ProviderModel
+	// Assignment grants the calling key access; nil for master-key requests.
+	Assignment *models.VirtualKeyAssignment
+	Weight     int
+}
+
+type stats struct {
+	inFlight int
+	latency  float64 // Moving average in milliseconds; 0 until the first sample
+}
+
+type Router struct {
+	mu       sync.Mutex
+	counters map[string]uint64
+	stats    map[string]*stats
+	breakers *breaker.Set
+}
+
+func New() *Router {
+	return NewWithBreakers(breaker.DefaultConfig)
+}
+
+// NewWithBreakers is New with custom circuit breaker thresholds.
+func NewWithBreakers(cfg breaker.Config) *Router {
+	return &Router{
+		counters: make(map[string]uint64),
+		stats:    make(map[string]*stats),
+		breakers: breaker.NewSet(cfg),
+	}
+}
+
+// Breaker returns the circuit breaker guarding a connection.
+func (r *Router) Breaker(connectionID string) *breaker.Breaker {
+	return r.breakers.Get(connectionID)
+}
+
+// Health returns the breaker state of every connection that has carried traffic, keyed by ID.
+func (r *Router) Health() map[string]breaker.Snapshot {
+	return r.breakers.Snapshots()
+}
+
+// Available reports whether d's connection is currently accepting traffic.
+func (r *Router) Available(d Deployment) bool {
+	return r.breakers.Get(d.Model.ConnectionID).Ready()
+}
+
+// Order returns the pool in the order it should be tried: the strategy's pick first, the
+// remaining deployments after it as fallbacks. poolKey identifies the pool for round-robin state.
+// Deployments on connections with an open breaker are dropped, so the result may be empty.
+func (r *Router) Order(poolKey, strategy string, pool []Deployment) []Deployment {
+	ordered := make([]Deployment, 0, len(pool))
+	for _, d := range pool {
+		if r.Available(d) {
+			ordered = append(ordered, d)
+		}
+	}
+	if len(ordered) <= 1 {
+		return ordered
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch strategy {
+	case WeightedRandom:
+		// Sample without replacement, proportionally to weight.
+		for i := range ordered {
+			total := 0
+			for _, d := range ordered[i:] {
+				total += weight(d)
+			}
+			n := rand.IntN(total)
+			for j := i; j < len(ordered); j++ {
+				if n -= weight(ordered[j]); n < 0 {
+					ordered[i], ordered[j] = ordered[j], ordered[i]
+					break
+				}
+			}
+		}
+	case LeastInFlight:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return float64(r.statsFor(ordered[i]).inFlight)/float64(weight(ordered[i])) <
+				float64(r.statsFor(ordered[j]).inFlight)/float64(weight(ordered[j]))
+		})
+	case LowestLatency:
+		// Deployments without samples sort first so every member gets measured.
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return r.statsFor(ordered[i]).latency < r.statsFor(ordered[j]).latency
+		})
+	default:
+		// Weighted round-robin: each deployment gets `weight` consecutive slots per cycle.
+		total := 0
+		for _, d := range ordered {
+			total += weight(d)
+		}
+		slot := int(r.counters[poolKey] % uint64(total))
+		r.counters[poolKey]++
+		pick := 0
+		for i, d := range ordered {
+			if slot -= weight(d); slot < 0 {
+				pick = i
+				break
+			}
+		}
+		ordered = append(ordered[pick:], ordered[:pick]...)
+	}
+	return ordered
+}
+
+// Begin marks a request to d as in flight. The returned function must be called once the
+// provider has answered, with the time it took to respond.
+func (r *Router) Begin(d Deployment) (done func(latency time.Duration)) {
+	r.mu.Lock()
+	s := r.statsFor(d)
+	s.inFlight++
+	r.mu.Unlock()
+
+	var once sync.Once
+	return func(latency time.Duration) {
+		once.Do(func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			s.inFlight--
+			if latency <= 0 {
+				return
+			}
+			ms := float64(latency.Microseconds()) / 1000
+			if s.latency == 0 {
+				s.latency = ms
+			} else {
+				s.latency = latencyDecay*ms + (1-latencyDecay)*s.latency
+			}
+		})
+	}
+}
+
+// statsFor must be called with r.mu held.
+func (r *Router) statsFor(d Deployment) *stats {
+	s, ok := r.stats[d.Model.ID]
+	if !ok {
+		s = &stats{}
+		r.stats[d.Model.ID] = s
+	}
+	return s
+}
+
+func weight(d Deployment) int {
+	if d.Weight <= 0 {
+		return 1
+	}
+	return d.Weight
+}
@@ -0,0 +1,91 @@
+package router_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/breaker"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/router"
+)
+
+func pool(weights ...int) []router.Deployment {
+	var out []router.Deployment
+	for i, w := range weights {
+		id := string(rune('a' + i))
+		out = append(out, router.Deployment{Model: &models.ProviderModel{ID: id}, Weight: w})
+	}
+	return out
+}
+
+func picks(r *router.Router, strategy string, p []router.Deployment, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		counts[r.Order("pool", strategy, p)[0].Model.ID]++
+	}
+	return counts
+}
+
+func TestOrder_RoundRobinHonoursWeights(t *testing.T) {
+	r := router.New()
+	counts := picks(r, router.RoundRobin, pool(1, 2, 1), 400)
+	assert.Equal(t, map[string]int{"a": 100, "b": 200, "c": 100}, counts)
+}
+
+func TestOrder_KeepsEveryDeploymentAsFallback(t *testing.T) {
+	r := router.New()
+	for _, s := range []string{router.RoundRobin, router.WeightedRandom, router.LeastInFlight, router.LowestLatency} {
+		ordered := r.Order("pool", s, pool(1, 1, 1))
+		ids := map[string]bool{}
+		for _, d := range ordered {
+			ids[d.Model.ID] = true
+		}
+		assert.Len(t, ids, 3, s)
+	}
+}
+
+func TestOrder_WeightedRandom(t *testing.T) {
+	r := router.New()
+	counts := picks(r, router.WeightedRandom, pool(9, 1), 2000)
+	assert.InDelta(t, 1800, counts["a"], 150)
+}
+
+func TestOrder_LeastInFlight(t *testing.T) {
+	r := router.New()
+	p := pool(1, 1)
+	done := r.Begin(p[0])
+	assert.Equal(t, "b", r.Order("pool", router.LeastInFlight, p)[0].Model.ID)
+	done(time.Millisecond)
+	assert.Equal(t, "a", r.Order("pool", router.LeastInFlight, p)[0].Model.ID)
+}
+
+func TestOrder_LowestLatency(t *testing.T) {
+	r := router.New()
+	p := pool(1, 1)
+	r.Begin(p[0])(300 * time.Millisecond)
+	r.Begin(p[1])(100 * time.Millisecond)
+	assert.Equal(t, "b", r.Order("pool", router.LowestLatency, p)[0].Model.ID)
+
+	// One slow sample moves the average but does not erase history.
+	r.Begin(p[1])(400 * time.Millisecond)
+	assert.Equal(t, "b", r.Order("pool", router.LowestLatency, p)[0].Model.ID)
+}
+
+func TestOrder_SkipsOpenBreakers(t *testing.T) {
+	r := router.NewWithBreakers(breaker.Config{ConsecutiveFailures: 1, Cooldown: time.Hour})
+	p := pool(1, 1)
+	p[0].Model.ConnectionID = "dead-region"
+	p[1].Model.ConnectionID = "healthy-region"
+
+	b := r.Breaker("dead-region")
+	b.Allow()
+	b.Record(false)
+
+	for i := 0; i < 4; i++ {
+		ordered := r.Order("pool", router.RoundRobin, p)
+		assert.Len(t, ordered, 1)
+		assert.Equal(t, "b", ordered[0].Model.ID)
+	}
+	assert.Equal(t, "open", r.Health()["dead-region"].State)
+}
@@ -1,7 +1,14 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
@@ -12,10 +19,38 @@ func Start(database db.DB, port int) error {
 	r := gin.Default()
 
 	p := proxy.NewProxy(database)
+	// Flush the usage ledger after in-flight requests have drained.
+	defer p.Close()
 
+	r.GET("/health/upstreams", p.HandleUpstreamHealth)
+	// Model discovery is answered by the proxy itself; a GET carries no model to route by.
+	r.GET("/v1/models", p.HandleListModels)
+	r.GET("/v1/models/*model", p.HandleGetModel)
+	r.GET("/v1beta/models", p.HandleListModels)
+	r.GET("/v1beta/models/*model", p.HandleGetModel)
 	r.NoRoute(p.HandleProxy)
 
 	addr := fmt.Sprintf(":%d", port)
 	fmt.Printf("Starting LLM Proxy Server on port %d...\n", port)
-	return r.Run(addr)
+	srv := &http.Server{Addr: addr, Handler: r}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down LLM Proxy Server...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
 }
@@ -0,0 +1,118 @@
+// Package tokencount estimates how many tokens a request will consume before it is sent
+// upstream. It does not tokenize: the estimates are heuristics that are reconciled with the usage
+// the provider reports once the response arrives.
+//
+// OpenAI models are estimated by splitting text the way the cl100k/o200k pre-tokenizer does and
+// charging each piece from average word lengths of that encoding, without the multi-megabyte
+// merge tables. It is only checked against tiktoken on a few short English strings and may be
+// further off for code or other languages. Other models fall back to a character count.
+package tokencount
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Counter counts the tokens of a piece of text.
+type Counter interface {
+	Count(text string) int
+}
+
+// encodingProfile holds the averages used to estimate counts for one OpenAI encoding.
+type encodingProfile struct {
+	name string
+	// wordLen is the longest plain ASCII word that is normally a single token.
+	wordLen int
+	// charsPerToken is the average number of characters per token in longer words.
+	charsPerToken float64
+	// runeCost is the average token cost of a character outside the Latin script.
+	runeCost float64
+}
+
+var (
+	CL100K Counter = &encodingProfile{name: "cl100k_base", wordLen: 7, charsPerToken: 4, runeCost: 1.0}
+	O200K  Counter = &encodingProfile{name: "o200k_base", wordLen: 8, charsPerToken: 4.5, runeCost: 0.6}
+	// Heuristic is used for models whose vocabulary is unknown.
+	Heuristic Counter = heuristic{}
+)
+
+// splitPattern is the cl100k pre-tokenizer pattern. RE2 has no lookahead, so `\s+(?!\S)` is
+// folded into `\s+`; that only moves one space between adjacent pieces and does not change counts.
+var splitPattern = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// ForModel picks the encoding used by model, matching on the provider-side model name.
+func ForModel(model string) Counter {
+	m := strings.ToLower(model)
+	switch {
+	case strings.Contains(m, "gpt-4o"), strings.Contains(m, "gpt-4.1"), strings.Contains(m, "gpt-4.5"),
+		strings.Contains(m, "gpt-5"), strings.HasPrefix(m, "o1"), strings.HasPrefix(m, "o3"),
+		strings.HasPrefix(m, "o4"), strings.Contains(m, "chatgpt"):
+		return O200K
+	case strings.Contains(m, "gpt-4"), strings.Contains(m, "gpt-3.5"), strings.Contains(m, "gpt-35"),
+		strings.Contains(m, "text-embedding"):
+		return CL100K
+	default:
+		return Heuristic
+	}
+}
+
+func (e *encodingProfile) Count(text string) int {
+	total := 0.0
+	for _, piece := range splitPattern.FindAllString(text, -1) {
+		total += e.pieceCost(piece)
+	}
+	return int(math.Ceil(total))
+}
+
+func (e *encodingProfile) pieceCost(piece string) float64 {
+	word := strings.TrimLeft(piece, " ")
+	if word == "" || strings.TrimSpace(piece) == "" {
+		return 1
+	}
+	first, _ := utf8.DecodeRuneInString(word)
+	switch {
+	case unicode.IsDigit(first):
+		// Digits are pre-split into groups of at most three, each a single token.
+		return 1
+	case unicode.IsLetter(first):
+		var latin, other int
+		for _, r := range word {
+			if r < utf8.RuneSelf || unicode.Is(unicode.Latin, r) {
+				latin++
+			} else {
+				other++
+			}
+		}
+		cost := float64(other) * e.runeCost
+		if latin > 0 {
+			if latin <= e.wordLen {
+				cost++
+			} else {
+				cost += math.Ceil(float64(latin) / e.charsPerToken)
+			}
+		}
+		return math.Max(cost, 1)
+	default:
+		// Runs of punctuation and symbols merge less readily than letters.
+		return math.Ceil(float64(utf8.RuneCountInString(strings.TrimSpace(word))) / 2)
+	}
+}
+
+type heuristic struct{}
+
+// Count assumes four ASCII characters per token and one token per other character, which
+// errs on the high side for most vocabularies.
+func (heuristic) Count(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
@@ -0,0 +1,52 @@
+package tokencount_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/tokencount"
+)
+
+func TestForModel(t *testing.T) {
+	assert.Equal(t, tokencount.O200K, tokencount.ForModel("gpt-4o-mini"))
+	assert.Equal(t, tokencount.O200K, tokencount.ForModel("o3-mini"))
+	assert.Equal(t, tokencount.CL100K, tokencount.ForModel("gpt-4-turbo"))
+	assert.Equal(t, tokencount.CL100K, tokencount.ForModel("gpt-35-turbo"))
+	assert.Equal(t, tokencount.Heuristic, tokencount.ForModel("anthropic.claude-3-sonnet"))
+}
+
+func TestCount(t *testing.T) {
+	// tiktoken: "hello world" is 2 tokens and "1234567" is 3 in both encodings.
+	assert.Equal(t, 2, tokencount.CL100K.Count("hello world"))
+	assert.Equal(t, 3, tokencount.O200K.Count("1234567"))
+
+	// tiktoken cl100k_base counts 10 tokens for this sentence.
+	n := tokencount.CL100K.Count("The quick brown fox jumps over the lazy dog.")
+	assert.InDelta(t, 10, n, 1)
+
+	assert.Equal(t, 3, tokencount.Heuristic.Count("twelve chars"))
+}
+
+func TestEstimateRequest(t *testing.T) {
+	var body map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"model": "gpt-4o",
+		"max_tokens": 100,
+		"messages": [
+			{"role": "system", "content": "You are terse."},
+			{"role": "user", "content": [
+				{"type": "text", "text": "Describe this"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,AAAA"}}
+			]}
+		]
+	}`), &body)
+	assert.NoError(t, err)
+
+	prompt := tokencount.EstimatePrompt("gpt-4o", body)
+	// 2 messages * 3 + 3 priming + "You are terse." (4) + "Describe this" (2) + image (85)
+	assert.Equal(t, 100, prompt)
+	assert.Equal(t, int64(200), tokencount.EstimateRequest("gpt-4o", body))
+
+	assert.Equal(t, int64(0), tokencount.EstimateRequest("gpt-4o", nil))
+}
@@ -0,0 +1,108 @@
+package tokencount
+
+import (
+	"encoding/json"
+)
+
+const (
+	// perMessageTokens covers the role and separator tokens chat formats add around each message.
+	perMessageTokens = 3
+	// replyPrimingTokens covers the assistant header every chat reply is primed with.
+	replyPrimingTokens = 3
+	// imageTokens is a flat estimate for an image input (OpenAI's low-detail price).
+	imageTokens = 85
+)
+
+// EstimateRequest returns the tokens a request may consume: the estimated prompt plus the
+// maximum number of output tokens the client asked for. It understands OpenAI chat, completions
+// and embeddings bodies, Anthropic Messages and Gemini generateContent.
+func EstimateRequest(model string, body map[string]interface{}) int64 {
+	if body == nil {
+		return 0
+	}
+	return int64(EstimatePrompt(model, body)) + MaxOutputTokens(body)
+}
+
+// EstimatePrompt estimates the input tokens of a request body.
+func EstimatePrompt(model string, body map[string]interface{}) int {
+	counter := ForModel(model)
+	e := &estimator{counter: counter}
+
+	if messages, ok := body["messages"].([]interface{}); ok {
+		for _, m := range messages {
+			e.tokens += perMessageTokens
+			e.add(m)
+		}
+		e.tokens += replyPrimingTokens
+	}
+	for _, field := range []string{"system", "prompt", "input", "contents", "systemInstruction", "system_instruction"} {
+		if v, ok := body[field]; ok {
+			e.add(v)
+		}
+	}
+	for _, field := range []string{"tools", "functions", "tool_choice", "response_format"} {
+		if v, ok := body[field]; ok {
+			if raw, err := json.Marshal(v); err == nil {
+				e.tokens += counter.Count(string(raw))
+			}
+		}
+	}
+	return e.tokens
+}
+
+// MaxOutputTokens returns the output cap requested by the client, or zero if none was set.
+func MaxOutputTokens(body map[string]interface{}) int64 {
+	for _, field := range []string{"max_completion_tokens", "max_tokens", "max_output_tokens", "max_tokens_to_sample"} {
+		if n, ok := body[field].(float64); ok && n > 0 {
+			return int64(n)
+		}
+		if n, ok := body[field].(int); ok && n > 0 {
+			return int64(n)
+		}
+	}
+	if cfg, ok := body["generationConfig"].(map[string]interface{}); ok {
+		if n, ok := cfg["maxOutputTokens"].(float64); ok && n > 0 {
+			return int64(n)
+		}
+	}
+	return 0
+}
+
+type estimator struct {
+	counter Counter
+	tokens  int
+}
+
+// add walks an arbitrary JSON value and counts the text it carries. Keys that hold binary data
+// or identifiers are skipped; images are charged a flat amount.
+func (e *estimator) add(v interface{}) {
+	switch v := v.(type) {
+	case string:
+		e.tokens += e.counter.Count(v)
+	case []interface{}:
+		for _, item := range v {
+			e.add(item)
+		}
+	case map[string]interface{}:
+		if isImagePart(v) {
+			e.tokens += imageTokens
+			return
+		}
+		for k, item := range v {
+			switch k {
+			case "role", "type", "id", "tool_call_id", "mimeType", "mime_type", "media_type":
+				continue
+			}
+			e.add(item)
+		}
+	}
+}
+
+func isImagePart(part map[string]interface{}) bool {
+	if t, _ := part["type"].(string); t == "image_url" || t == "image" || t == "input_image" {
+		return true
+	}
+	_, inline := part["inlineData"]
+	_, inline2 := part["inline_data"]
+	return inline || inline2
+}
@@ -0,0 +1,156 @@
+// Package usage writes the per-request usage ledger off the request path.
+package usage
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+)
+
+const (
+	DefaultBatchSize     = 100
+	DefaultFlushInterval = 5 * time.Second
+	queueSize            = 10000
+)
+
+// Recorder buffers usage records and saves them in batches, either when a batch is full or when
+// the flush interval elapses, so the database is never on a request's critical path.
+type Recorder struct {
+	db            db.DB
+	queue         chan models.UsageRecord
+	batchSize     int
+	flushInterval time.Duration
+
+	done chan struct{}
+
+	mu      sync.Mutex
+	closed  bool               // Set by Close; the queue no longer accepts records
+	pending map[string]float64 // Cost queued but not yet written, by virtual key
+}
+
+func NewRecorder(database db.DB, batchSize int, flushInterval time.Duration) *Recorder {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+	r := &Recorder{
+		db:            database,
+		queue:         make(chan models.UsageRecord, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+		pending:       make(map[string]float64),
+	}
+	go r.run()
+	return r
+}
+
+// Record queues rec for writing. It never blocks; if the queue is full, or the recorder has been
+// closed, the record is dropped and logged rather than slowing down the proxy.
+func (r *Recorder) Record(rec models.UsageRecord) {
+	if rec.ID == "" {
+		rec.ID = models.NewID()
+	}
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = time.Now()
+	}
+	rec.CreatedAt = rec.CreatedAt.UTC()
+	rec.Day = rec.CreatedAt.Format(time.DateOnly)
+
+	// Held across the send so Close cannot close the queue under it, and so the batch holding rec
+	// cannot settle its cost before it is added.
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		log.Printf("usage recorder closed, dropping record for key %s model %s", rec.VirtualKeyID, rec.ModelAlias)
+		return
+	}
+	select {
+	case r.queue <- rec:
+		if rec.CostUSD > 0 {
+			r.pending[rec.VirtualKeyID] += rec.CostUSD
+		}
+	default:
+		log.Printf("usage queue full, dropping record for key %s model %s", rec.VirtualKeyID, rec.ModelAlias)
+	}
+}
+
+// PendingCost returns the cost of virtualKeyID's records that have not been written yet, which a
+// read of the ledger does not see.
+func (r *Recorder) PendingCost(virtualKeyID string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pending[virtualKeyID]
+}
+
+// settle takes records that were written, or failed to be, off the pending cost.
+func (r *Recorder) settle(recs []models.UsageRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rec := range recs {
+		if rec.CostUSD <= 0 {
+			continue
+		}
+		if left := r.pending[rec.VirtualKeyID] - rec.CostUSD; left > 1e-12 {
+			r.pending[rec.VirtualKeyID] = left
+		} else {
+			delete(r.pending, rec.VirtualKeyID)
+		}
+	}
+}
+
+// Close stops accepting records and waits until everything queued has been written. Records
+// arriving afterwards, from requests still running when the server gave up waiting, are dropped.
+func (r *Recorder) Close() {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+	<-r.done
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]models.UsageRecord, 0, r.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := r.db.SaveUsageRecords(ctx, batch); err != nil {
+			log.Printf("failed to save %d usage records: %v", len(batch), err)
+		}
+		// Settled only after the write. A reader that takes the pending cost before reading the
+		// ledger may then count a record twice, but never misses it.
+		r.settle(batch)
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case rec, ok := <-r.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) >= r.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package usage_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/db"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/models"
+	"github.com/supakornemchananon/go-llm-proxy-server/internal/usage"
+)
+
+func TestRecorder_DropsRecordsAfterClose(t *testing.T) {
+	database, err := db.InitDB("sqlite", filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	recorder := usage.NewRecorder(database, usage.DefaultBatchSize, time.Hour)
+
+	recorder.Record(models.UsageRecord{VirtualKeyID: "vk", ModelAlias: "gpt-4o", PromptTokens: 10})
+	recorder.Close()
+
+	// A handler still running after shutdown gave up waiting for it.
+	assert.NotPanics(t, func() {
+		recorder.Record(models.UsageRecord{VirtualKeyID: "vk", ModelAlias: "gpt-4o", PromptTokens: 20})
+	})
+	recorder.Close()
+
+	summary, err := database.AggregateUsage(context.Background(), models.UsageFilter{})
+	require.NoError(t, err)
+	require.Len(t, summary, 1)
+	assert.Equal(t, int64(1), summary[0].Requests)
+	assert.Equal(t, int64(10), summary[0].PromptTokens)
+}